@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -23,6 +25,7 @@ type entry struct {
 var (
 	entries     = []entry{}   // ordered list of entries = cron-expressions and target-output-ports
 	whenTemp    *string       // state variable for flag parsing, keeps -when value until following -to
+	parsed      []entry       // state variable for flag parsing, collects the entries from -when and -to
 	netout      *bufio.Writer //TODO necessary to keep as global variable?
 	wakeupFrame = &flowd.Frame{
 		Type:     "data",
@@ -30,6 +33,43 @@ var (
 	}
 )
 
+// parseEntries checks the parsed flags and parses the cron expressions of the entries, with their next event after now
+func parseEntries(flags *flag.FlagSet, now time.Time) ([]entry, error) {
+	// check flags
+	if flags.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected free argument(s) encountered: %v", flags.Args())
+	}
+	if whenTemp != nil {
+		return nil, errors.New("-when without following -to, but both required")
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("missing cron expression(s) in -when")
+	}
+
+	// parse cron expressions
+	// NOTE: range over array and array slices is ordered (vs. maps)
+	for index, entry := range parsed {
+		// parse cron expression
+		schedule, err := cronexpr.Parse(*entry.cronExpression)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cron expression '%s': %s", *entry.cronExpression, err)
+		}
+		// save schedule
+		parsed[index].schedule = schedule
+		// generate and check for next event time
+		parsed[index].nextEvent = schedule.Next(now)
+		if parsed[index].nextEvent.IsZero() {
+			// entry has no future events
+			return nil, fmt.Errorf("cron expression '%s' has no future events", *entry.cronExpression)
+		}
+		// else activate
+		parsed[index].active = true
+		// GC string
+		parsed[index].cronExpression = nil
+	}
+	return parsed, nil
+}
+
 func main() {
 	// get configuration from flags = Unix IIP
 	var when whenFlag
@@ -38,53 +78,35 @@ func main() {
 	flag.Var(&when, "when", "cron expression when to send IP")
 	flag.Var(&to, "to", "port to send IP from for preceding -when")
 	flag.Parse()
-	// check flags
-	if flag.NArg() != 0 {
-		fmt.Fprintln(os.Stderr, "ERROR: unexpected free argument(s) encountered:", flag.Args())
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
-	}
-	if whenTemp != nil {
-		fmt.Fprintln(os.Stderr, "ERROR: -when without following -to, but both required")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
-	}
-	if len(entries) == 0 {
-		fmt.Fprintln(os.Stderr, "ERROR: missing cron expression(s) in -when")
+	var err error
+	now := time.Now()
+	if entries, err = parseEntries(flag.CommandLine, now); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
 		printUsage()
 		flag.PrintDefaults() // prints to STDERR
 		os.Exit(2)
 	}
 
-	// parse cron expressions
-	// NOTE: range over array and array slices is ordered (vs. maps)
-	now := time.Now()
-	for index, entry := range entries {
-		// parse cron expression
-		if schedule, err := cronexpr.Parse(*entry.cronExpression); err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: parsing cron expression '%s': %s\n", *entry.cronExpression, err)
-			os.Exit(2)
-		} else {
-			// save schedule
-			entries[index].schedule = schedule
-			// generate and check for next event time
-			entries[index].nextEvent = schedule.Next(now)
-			if entries[index].nextEvent.IsZero() {
-				// entry has no future events
-				fmt.Fprintf(os.Stderr, "ERROR: cron expression '%s' has no future events\n", *entry.cronExpression)
-				os.Exit(2)
-			}
-			// else activate
-			entries[index].active = true
-			// GC string
-			entries[index].cronExpression = nil
+	// accept new configuration at runtime, which replaces all entries
+	confs := make(chan []entry)
+	unixfbp.WatchConf(func(args []string) error {
+		flags := flag.NewFlagSet(unixfbp.ConfPort, flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		flags.Var(&when, "when", "cron expression when to send IP")
+		flags.Var(&to, "to", "port to send IP from for preceding -when")
+		whenTemp, parsed = nil, nil
+		if err := flags.Parse(args); err != nil {
+			return err
 		}
-	}
+		next, err := parseEntries(flags, time.Now())
+		if err != nil {
+			return err
+		}
+		confs <- next
+		return nil
+	})
 
 	// connect to FBP network
-	var err error
 	for portName := range unixfbp.OutPorts {
 		// open all given ports, assuming they will be needed at some point and so that the other side does not block
 		netout, _, err = unixfbp.OpenOutPort(portName)
@@ -133,6 +155,7 @@ func main() {
 		}
 		if !foundNext {
 			// done, exit
+			// NOTE: also with CONF inport, since the network expects the component to exit now
 			if !unixfbp.Quiet {
 				fmt.Fprintln(os.Stderr, "all entries have no more future events - exiting.")
 			}
@@ -143,7 +166,12 @@ func main() {
 		if unixfbp.Debug {
 			fmt.Fprintln(os.Stderr, "sleeping until next event")
 		}
-		time.Sleep(time.Until(entries[minIndex].nextEvent))
+		select {
+		case <-time.After(time.Until(entries[minIndex].nextEvent)):
+		case entries = <-confs:
+			// find nearest next event of the new entries
+			continue
+		}
 
 		// send notification
 		//TODO optimize: entry or index as parameter?
@@ -182,6 +210,7 @@ func sendNotification(index int) {
 func printUsage() {
 	fmt.Fprintln(os.Stderr, "Arguments: [flags] {-when [cron-expression] -to [output-port]}...")
 	fmt.Fprintln(os.Stderr, "multiple when+to possible; expression format at https://github.com/gorhill/cronexpr")
+	fmt.Fprintln(os.Stderr, "new configuration in the same format is accepted on inport CONF at runtime")
 }
 
 // flag acceptors of -when [cron-expression] -to [output-port] couples
@@ -217,7 +246,7 @@ func (f *toFlag) Set(value string) error {
 		return fmt.Errorf("-to without preceding -when")
 	}
 	// all data given for a rule, save it
-	entries = append(entries, entry{
+	parsed = append(parsed, entry{
 		cronExpression: whenTemp,
 		outport:        value,
 	})
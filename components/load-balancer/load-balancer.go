@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/ERnsTL/flowd/libflowd"
 	"github.com/ERnsTL/flowd/libunixfbp"
@@ -21,12 +22,29 @@ Features:
 - gives warning if no takers available
 - can switch enabled outports by command on SWITCH port so that the worker on that pipe can gracefully shut down
 - uses simple round-robin load balancing
+- on close of the inport, forwards the PortClose to all outports and exits once all frames are delivered
 */
 
 //TODO measure service uptime and print it once a day
 //TODO add feedback-based balancing = know, how many frames / packets are queued on each output port, then write to the one with the shortest queue.
 
-var netin *bufio.Reader // only for checking if buffered data is available
+// portStatus is the availability of an outport, set by its handler and by switch commands
+type portStatus struct {
+	sync.Mutex
+	available bool
+}
+
+func (s *portStatus) set(available bool) {
+	s.Lock()
+	s.available = available
+	s.Unlock()
+}
+
+func (s *portStatus) get() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.available
+}
 
 func main() {
 	// flag variables
@@ -35,7 +53,7 @@ func main() {
 	unixfbp.DefFlags()
 	flag.BoolVar(&control, "switch", false, "open control port to switch active outports")
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if flag.NArg() != 0 {
 		fmt.Fprintln(os.Stderr, "ERROR: unexpected free arguments given")
 		flag.PrintDefaults() // prints to STDERR
 		os.Exit(2)
@@ -47,7 +65,6 @@ func main() {
 	}
 
 	// connect to the network
-	var err error
 	netin, _, err := unixfbp.OpenInPort("IN")
 	if err != nil {
 		fmt.Println("ERROR:", err)
@@ -55,21 +72,28 @@ func main() {
 	}
 	if control {
 		// open control port
-		_, _, err = unixfbp.OpenOutPort("SWITCH")
+		_, _, err = unixfbp.OpenInPort("SWITCH")
 		if err != nil {
 			fmt.Println("ERROR:", err)
 			os.Exit(2)
 		}
 	}
 	outHandlers := make([]chan *flowd.Frame, len(unixfbp.OutPorts))
-	outPortNames := make([]string, len(unixfbp.OutPorts)) // NOTE: because cannot take address of map[string]bool entry
-	portsAvailable := make([]bool, len(unixfbp.OutPorts)) //TODO optimize: keep list of ready-to-send ports in own list -> no iteration over portsAvailable
+	outPortNames := make([]string, len(unixfbp.OutPorts))       // NOTE: because cannot take address of map[string]bool entry
+	portsAvailable := make([]portStatus, len(unixfbp.OutPorts)) //TODO optimize: keep list of ready-to-send ports in own list -> no iteration over portsAvailable
+	var handlersDone sync.WaitGroup
 	var curIndex int
 	for portName, _ := range unixfbp.OutPorts {
 		// create buffered chan
 		outHandlers[curIndex] = make(chan *flowd.Frame, 5)
+		// NOTE: available from the start, frames are buffered until the handler has opened its outport
+		portsAvailable[curIndex].set(true)
 		// handle that outport
-		handleOutPort(portName, outHandlers[curIndex], &portsAvailable[curIndex])
+		handlersDone.Add(1)
+		go func(portName string, inChan <-chan *flowd.Frame, status *portStatus) {
+			defer handlersDone.Done()
+			handleOutPort(portName, inChan, status)
+		}(portName, outHandlers[curIndex], &portsAvailable[curIndex])
 		outPortNames[curIndex] = portName
 		// next index
 		curIndex++
@@ -133,7 +157,7 @@ func main() {
 						}
 					}
 					// set value
-					portsAvailable[index] = enable
+					portsAvailable[index].set(enable)
 				}
 			}
 		}
@@ -141,13 +165,23 @@ func main() {
 		// read frame
 		frame, err = flowd.Deserialize(netin)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "ERROR: reading frame:", err)
+			}
+			break
+		}
+		if frame.Type == "control" && frame.BodyType == "PortClose" && frame.Port == "IN" {
+			// forward to all outports
+			for _, outHandler := range outHandlers {
+				outHandler <- frame
+			}
+			break
 		}
 
 		// check if current port is available
 		tryIndex = curIndex //TODO optimize - do without that; and without looping over portsAvailable
 	tryAgain:
-		if !portsAvailable[curIndex] {
+		if !portsAvailable[curIndex].get() {
 			// try next outport, wrapping around if necessary
 			curIndex++
 			if curIndex == len(portsAvailable) {
@@ -171,17 +205,29 @@ func main() {
 			curIndex = 0
 		}
 	}
+
+	// shut down outport handlers, closing the outports
+	for _, outHandler := range outHandlers {
+		close(outHandler)
+	}
+	handlersDone.Wait()
 }
 
-func handleOutPort(portName string, inChan <-chan *flowd.Frame, status *bool) {
+// NOTE: opens the named pipe itself instead of using unixfbp.OpenOutPort(), which would modify unixfbp.OutPorts concurrently
+func handleOutPort(portName string, inChan <-chan *flowd.Frame, status *portStatus) {
+	path := unixfbp.OutPorts[portName].Path
 	// connect port - this may block, which is fine
-	outW, _, err := unixfbp.OpenOutPort(portName)
+	outPipe, err := os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe)
 	if err != nil {
-		fmt.Println("ERROR:", err)
+		fmt.Printf("ERROR: opening outport %s at path %s: %s\n", portName, path, err)
 		os.Exit(2)
 	}
-	*status = true
-	defer outW.Flush()
+	outW := bufio.NewWriter(outPipe)
+	status.set(true)
+	defer func() {
+		outW.Flush()
+		outPipe.Close()
+	}()
 	// forward frames
 	for frame := range inChan {
 		// forward it
@@ -194,18 +240,19 @@ func handleOutPort(portName string, inChan <-chan *flowd.Frame, status *bool) {
 				fmt.Fprintln(os.Stderr, "ERROR: serializing frame:", err.Error())
 			}
 			// take out of list of available ports
-			*status = false
+			status.set(false)
 			// reset and try to connect again - will block until other side connects
-			outW, _, err = unixfbp.OpenOutPort(portName)
-			if err != nil {
-				fmt.Println("ERROR:", err)
+			outPipe.Close()
+			if outPipe, err = os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe); err != nil {
+				fmt.Printf("ERROR: reopening outport %s at path %s: %s\n", portName, path, err)
 				os.Exit(2)
 			}
-			*status = true
-			defer outW.Flush()
+			outW.Reset(outPipe)
+			status.set(true)
 		}
-		// flush if no packets waiting on input
-		if netin.Buffered() == 0 {
+		// flush if no frames waiting for this outport
+		// NOTE: not checking netin.Buffered(), since the main loop reads from netin concurrently
+		if len(inChan) == 0 {
 			if err = outW.Flush(); err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: flushing port '%s': %s\n", portName, err)
 			}
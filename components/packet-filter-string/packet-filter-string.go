@@ -3,61 +3,112 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync/atomic"
 
 	"github.com/ERnsTL/flowd/libflowd"
 	"github.com/ERnsTL/flowd/libunixfbp"
 )
 
-func main() {
-	// flag variables
-	var filterStrings []string
-	var pass, drop, and, or bool
-	// get configuration from arguments = Unix IIP
-	unixfbp.DefFlags()
-	flag.BoolVar(&and, "and", false, "all given substrings must be present in packet body")
-	flag.BoolVar(&or, "or", false, "any of the given substrings must be present in packet body")
-	flag.BoolVar(&pass, "pass", false, "let matching packets pass")
-	flag.BoolVar(&drop, "drop", false, "drop matching packets")
-	flag.Parse()
+// filter is the configuration of the component, replaced as a whole on new configuration
+type filter struct {
+	substrings [][]byte
+	and        bool // all substrings must be present, otherwise any
+	pass       bool // let matching packets pass, otherwise drop them
+}
 
-	// check flags
-	if (!and && !or) || (and && or) {
-		if flag.NArg() == 1 {
+// filterFlags holds the flag values of a configuration
+type filterFlags struct {
+	pass, drop, and, or bool
+}
+
+func (f *filterFlags) define(flags *flag.FlagSet) {
+	flags.BoolVar(&f.and, "and", false, "all given substrings must be present in packet body")
+	flags.BoolVar(&f.or, "or", false, "any of the given substrings must be present in packet body")
+	flags.BoolVar(&f.pass, "pass", false, "let matching packets pass")
+	flags.BoolVar(&f.drop, "drop", false, "drop matching packets")
+}
+
+// newFilter checks the flag values and substrings of a configuration
+func newFilter(f filterFlags, substrings []string) (*filter, error) {
+	if (!f.and && !f.or) || (f.and && f.or) {
+		if len(substrings) == 1 {
 			// do not annoy user if only one substring -> set to or (or and)
-			and = false
-			or = true
+			f.and = false
+			f.or = true
 		} else {
-			fmt.Fprintln(os.Stderr, "ERROR: either -and or -or expected - unable to proceed")
-			printUsage()
-			flag.PrintDefaults() // prints to STDERR
-			os.Exit(2)
+			return nil, errors.New("either -and or -or expected")
 		}
 	}
-	if (!pass && !drop) || (pass && drop) {
-		fmt.Fprintln(os.Stderr, "ERROR: either -pass or -drop expected - unable to proceed")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
+	if (!f.pass && !f.drop) || (f.pass && f.drop) {
+		return nil, errors.New("either -pass or -drop expected")
+	}
+	if len(substrings) == 0 {
+		return nil, errors.New("no filter substrings given")
+	}
+	result := &filter{and: f.and, pass: f.pass}
+	for _, substring := range substrings {
+		result.substrings = append(result.substrings, []byte(substring))
+	}
+	return result, nil
+}
+
+// matches checks the conditions on the frame body
+func (f *filter) matches(body []byte) bool {
+	for _, substring := range f.substrings {
+		if bytes.Contains(body, substring) != f.and {
+			// and-condition failed resp. or-condition met
+			return !f.and
+		}
 	}
-	if flag.NArg() == 0 {
-		fmt.Fprintln(os.Stderr, "ERROR: no filter substrings given")
+	return f.and
+}
+
+func main() {
+	// get configuration from arguments = Unix IIP
+	var initial filterFlags
+	unixfbp.DefFlags()
+	initial.define(flag.CommandLine)
+	flag.Parse()
+
+	// check flags
+	first, err := newFilter(initial, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err, "- unable to proceed")
 		printUsage()
 		flag.PrintDefaults() // prints to STDERR
 		os.Exit(2)
 	}
-	//TODO optimize - convert search substrings to []byte, since frame.Body is []byte
-	filterStrings = flag.Args()
+	var current atomic.Value
+	current.Store(first)
 
 	if !unixfbp.Quiet {
 		fmt.Fprintln(os.Stderr, "starting up")
 	}
 
+	// accept new configuration at runtime
+	unixfbp.WatchConf(func(args []string) error {
+		var f filterFlags
+		flags := flag.NewFlagSet(unixfbp.ConfPort, flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		f.define(flags)
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		next, err := newFilter(f, flags.Args())
+		if err != nil {
+			return err
+		}
+		current.Store(next)
+		return nil
+	})
+
 	// connect to FBP network
-	var err error
 	netin, _, err := unixfbp.OpenInPort("IN")
 	if err != nil {
 		fmt.Println("ERROR:", err)
@@ -77,36 +128,6 @@ func main() {
 	var frame *flowd.Frame
 
 	// main work loop
-	/* pseudo-code:
-	and-pass:
-		for:
-			if !contains:
-				continue nextframe
-		forward
-
-	and-drop:
-		for:
-			if !contains:
-				forward
-				continue nextframe / break
-		continue / continue next frame = drop
-
-	or-pass:
-		for:
-			if contains:
-				forward
-				continue nextframe / break
-		continue next frame = drop
-
-	or-drop:
-		for:
-			if contains:
-				continue nextframe / break
-		forward
-
-	-> group by condition = outer if and
-	*/
-nextframe:
 	for {
 		// read frame
 		frame, err = flowd.Deserialize(netin)
@@ -121,50 +142,9 @@ nextframe:
 
 		// apply filter only to non-bracket IPs
 		if !(frame.Type == "control" && (frame.BodyType == "BracketOpen" || frame.BodyType == "BracketClose")) {
-			// check conditions on body
-			//TODO code could be more readable by using a matched bool variable
-			if and {
-				// check for substrings in body
-				for _, string := range filterStrings {
-					if !bytes.Contains(frame.Body, []byte(string)) {
-						// and-condition has been failed, act according to target
-						if drop {
-							// condition for drop failed, thus forward it to output port
-							forwardFrame(frame, netout)
-							// next frame
-							continue nextframe // or break
-						} else {
-							continue nextframe
-						}
-					}
-				}
-				// and-condition has been met, act according to target
-				if drop {
-					continue nextframe
-				} else {
-					// nothing to do here, goes on to pass
-				}
-			} else {
-				// check for substrings in body
-				for _, string := range filterStrings {
-					if bytes.Contains(frame.Body, []byte(string)) {
-						// passed, act according to target
-						if drop {
-							continue nextframe
-						} else {
-							// condition for pass has been met, thus forward it to output port
-							forwardFrame(frame, netout)
-							// next frame
-							continue nextframe // or break
-						}
-					}
-				}
-				// or-condition has been failed, act according to target
-				if pass {
-					continue nextframe
-				} else {
-					// nothing to do here, goes on to pass
-				}
+			f := current.Load().(*filter)
+			if f.matches(frame.Body) != f.pass {
+				continue
 			}
 		}
 
@@ -175,6 +155,7 @@ nextframe:
 
 func printUsage() {
 	fmt.Fprintln(os.Stderr, "Arguments: [-pass|-drop] [-and|-or] [flags] [substring]...")
+	fmt.Fprintln(os.Stderr, "new configuration in the same format is accepted on inport CONF at runtime")
 }
 
 //TODO optimize: give netout as parameter or have it as global variable?
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ERnsTL/flowd/libflowd"
 	"github.com/ERnsTL/flowd/libunixfbp"
@@ -29,72 +31,66 @@ var (
 	rules = []rule{}
 )
 
-func main() {
-	// flag variables
-	var field, present, missing, nomatchPort string
-	var equals equalsFlag
-	var hasprefix prefixFlag
-	var to toFlag
-	// get configuration from arguments = Unix IIP
-	unixfbp.DefFlags()
-	flag.StringVar(&field, "field", "", "header field to inspect")
-	flag.StringVar(&present, "present", "", "outport for packets with header field present")
-	flag.StringVar(&missing, "missing", "NOMATCH", "outport for packets with header field missing")
-	flag.StringVar(&nomatchPort, "nomatch", "NOMATCH", "outport for unmatched packets")
-	flag.Var(&hasprefix, "hasprefix", "matching on prefix in header field value")
-	flag.Var(&equals, "equals", "matching equal value of header field")
-	flag.Var(&to, "to", "outport for matching packets")
-	flag.Parse()
+// router is the configuration of the component, replaced as a whole on new configuration
+type router struct {
+	field       string
+	fieldGetter fieldGetter
+	ruleFuncs   []ruleMatcher
+}
+
+// routerFlags holds the flag values of a configuration; the rules are collected in rules
+type routerFlags struct {
+	field, present, missing, nomatchPort string
+}
+
+func (f *routerFlags) define(flags *flag.FlagSet) {
+	flags.StringVar(&f.field, "field", "", "header field to inspect")
+	flags.StringVar(&f.present, "present", "", "outport for packets with header field present")
+	flags.StringVar(&f.missing, "missing", "NOMATCH", "outport for packets with header field missing")
+	flags.StringVar(&f.nomatchPort, "nomatch", "NOMATCH", "outport for unmatched packets")
+	flags.Var(&prefixFlag{}, "hasprefix", "matching on prefix in header field value")
+	flags.Var(&equalsFlag{}, "equals", "matching equal value of header field")
+	flags.Var(&toFlag{}, "to", "outport for matching packets")
+}
+
+// newRouter checks the flag values of a configuration and generates the frame matchers from them and the rules
+func newRouter(f routerFlags, freeArgs []string) (*router, error) {
+	// empty rules list afterwards
+	defer func() { rules = nil }()
 
 	// check flags
-	if len(rules) > 0 && rules[len(rules)-1].value == "" {
-		fmt.Fprintln(os.Stderr, "ERROR:", getLastRuleType(), "without following -to, but both required")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
+	if len(rules) > 0 && rules[len(rules)-1].targetport == "" {
+		return nil, fmt.Errorf("%s without following -to, but both required", getLastRuleType())
 	}
 	//TODO allow both -present and detailed conditions -> if len(rules) > 0 then append present-ruleFunc as last when no details condition matched
-	if (present != "" && len(rules) != 0) || (present == "" && len(rules) == 0) {
-		fmt.Fprintln(os.Stderr, "ERROR: either -present or specific condition expected")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
+	if (f.present != "" && len(rules) != 0) || (f.present == "" && len(rules) == 0) {
+		return nil, fmt.Errorf("either -present or specific condition expected")
 	}
-	if field == "" {
-		fmt.Fprintln(os.Stderr, "ERROR: -field missing")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
+	if f.field == "" {
+		return nil, fmt.Errorf("-field missing")
 	}
-	if flag.NArg() != 0 {
-		fmt.Fprintln(os.Stderr, "ERROR: unexpected free argument encountered")
-		printUsage()
-		flag.PrintDefaults() // prints to STDERR
-		os.Exit(2)
-	}
-
-	if !unixfbp.Quiet {
-		fmt.Fprintln(os.Stderr, "starting up")
+	if len(freeArgs) != 0 {
+		return nil, fmt.Errorf("unexpected free argument encountered")
 	}
 
 	// generate frame matchers
 	//TODO possible optimization regarding *string return value
-	var ruleFuncs []ruleMatcher
+	result := &router{field: f.field}
 	// header value missing
-	if missing != "" {
-		ruleFuncs = append(ruleFuncs, func(value *string) *string {
+	if f.missing != "" {
+		result.ruleFuncs = append(result.ruleFuncs, func(value *string) *string {
 			if value == nil {
-				return &missing
+				return &f.missing
 			}
 			// no match
 			return nil
 		})
 	}
 	// header value present
-	if present != "" {
-		ruleFuncs = append(ruleFuncs, func(value *string) *string {
+	if f.present != "" {
+		result.ruleFuncs = append(result.ruleFuncs, func(value *string) *string {
 			if value != nil {
-				return &present
+				return &f.present
 			}
 			// no match
 			return nil
@@ -113,9 +109,9 @@ func main() {
 			// append rule function depending on rule type
 			if rule.isEquals {
 				if unixfbp.Debug {
-					fmt.Fprintf(os.Stderr, "\tif %s equals %s, forward to %s\n", field, matchValueCopy, targetPortCopy)
+					fmt.Fprintf(os.Stderr, "\tif %s equals %s, forward to %s\n", f.field, matchValueCopy, targetPortCopy)
 				}
-				ruleFuncs = append(ruleFuncs, func(value *string) *string {
+				result.ruleFuncs = append(result.ruleFuncs, func(value *string) *string {
 					if value == nil {
 						// not responsible
 						return nil
@@ -128,9 +124,9 @@ func main() {
 				})
 			} else if rule.isHasPrefix {
 				if unixfbp.Debug {
-					fmt.Fprintf(os.Stderr, "\tif %s has prefix %s, forward to %s\n", field, matchValueCopy, targetPortCopy)
+					fmt.Fprintf(os.Stderr, "\tif %s has prefix %s, forward to %s\n", f.field, matchValueCopy, targetPortCopy)
 				}
-				ruleFuncs = append(ruleFuncs, func(value *string) *string {
+				result.ruleFuncs = append(result.ruleFuncs, func(value *string) *string {
 					if value == nil {
 						// not responsible
 						return nil
@@ -142,48 +138,86 @@ func main() {
 					return nil
 				})
 			} else {
-				fmt.Fprintln(os.Stderr, "ERROR: unknown rule type - exiting.")
-				os.Exit(2)
+				return nil, fmt.Errorf("unknown rule type")
 			}
 		}
 		if unixfbp.Debug {
-			fmt.Fprintf(os.Stderr, "\tif %s missing, forward to %s\n", field, nomatchPort)
+			fmt.Fprintf(os.Stderr, "\tif %s missing, forward to %s\n", f.field, f.nomatchPort)
 		}
 	}
 	// default catch-all rule
-	ruleFuncs = append(ruleFuncs, func(value *string) *string {
-		return &nomatchPort
+	result.ruleFuncs = append(result.ruleFuncs, func(value *string) *string {
+		return &f.nomatchPort
 	})
-	// empty rules list
-	rules = nil
 
 	// header field getter
-	var fieldGetter fieldGetter
-	switch field {
+	switch f.field {
 	case "Type":
-		fieldGetter = func(frame *flowd.Frame) *string {
+		result.fieldGetter = func(frame *flowd.Frame) *string {
 			return &frame.Type
 		}
 	case "BodyType":
-		fieldGetter = func(frame *flowd.Frame) *string {
+		result.fieldGetter = func(frame *flowd.Frame) *string {
 			return &frame.BodyType
 		}
 	default:
-		fieldGetter = func(frame *flowd.Frame) *string {
+		result.fieldGetter = func(frame *flowd.Frame) *string {
 			if frame.Extensions == nil {
 				// nothing there
 				return nil
 			}
-			if value, exists := frame.Extensions[field]; exists {
+			if value, exists := frame.Extensions[f.field]; exists {
 				return &value
 			}
 			// field missing
 			return nil
 		}
 	}
+	return result, nil
+}
+
+func main() {
+	// get configuration from arguments = Unix IIP
+	var initial routerFlags
+	unixfbp.DefFlags()
+	initial.define(flag.CommandLine)
+	flag.Parse()
+
+	// check flags
+	first, err := newRouter(initial, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		printUsage()
+		flag.PrintDefaults() // prints to STDERR
+		os.Exit(2)
+	}
+	var current atomic.Value
+	current.Store(first)
+
+	if !unixfbp.Quiet {
+		fmt.Fprintln(os.Stderr, "starting up")
+	}
+
+	// accept new configuration at runtime
+	// NOTE: configurations are parsed one at a time, so the rules collected during flag parsing are not shared
+	unixfbp.WatchConf(func(args []string) error {
+		var f routerFlags
+		flags := flag.NewFlagSet(unixfbp.ConfPort, flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		f.define(flags)
+		rules = nil
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		next, err := newRouter(f, flags.Args())
+		if err != nil {
+			return err
+		}
+		current.Store(next)
+		return nil
+	})
 
 	// connect to FBP network
-	var err error
 	netin, _, err := unixfbp.OpenInPort("IN")
 	if err != nil {
 		fmt.Println("ERROR:", err)
@@ -218,28 +252,18 @@ nextframe:
 		}
 
 		// get field value
-		/*
-			if frame.Extensions != nil {
-				if value, found := frame.Extensions["Myfield"]; found {
-					fmt.Fprintf(os.Stderr, "in frame directly: field has value %s\n", value)
-				} else {
-					fmt.Fprintln(os.Stderr, "in frame directly: field not found")
-				}
-			} else {
-				fmt.Fprintln(os.Stderr, "in frame directly: field not found")
-			}
-		*/
-		fieldValue = fieldGetter(frame)
+		r := current.Load().(*router)
+		fieldValue = r.fieldGetter(frame)
 		if unixfbp.Debug {
 			if fieldValue != nil {
-				fmt.Fprintf(os.Stderr, "field %s has value %s\n", field, *fieldValue)
+				fmt.Fprintf(os.Stderr, "field %s has value %s\n", r.field, *fieldValue)
 			} else {
-				fmt.Fprintf(os.Stderr, "field %s has value %v\n", field, fieldValue)
+				fmt.Fprintf(os.Stderr, "field %s has value %v\n", r.field, fieldValue)
 			}
 		}
 
 		// check which rule applies
-		for _, ruleFunc := range ruleFuncs {
+		for _, ruleFunc := range r.ruleFuncs {
 			if targetPort := ruleFunc(fieldValue); targetPort != nil {
 				// rule applies, forward frame to returned port
 				if unixfbp.Debug {
@@ -267,6 +291,7 @@ nextframe:
 
 func printUsage() {
 	fmt.Fprintln(os.Stderr, "Arguments: [-field] [-missing] [-present] {[-equals|-hasprefix] [-to]}...")
+	fmt.Fprintln(os.Stderr, "new configuration in the same format is accepted on inport CONF at runtime")
 }
 
 // flag acceptors of ( -equals [value] or -hasprefix [prefix] ) and -to [output-port] couples
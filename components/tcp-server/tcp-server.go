@@ -79,6 +79,10 @@ func main() {
 	fmt.Fprintln(os.Stderr, "open socket")
 	listener, err := net.ListenTCP(serverAddr.Network(), serverAddr)
 	checkError(err)
+	// signal readiness to flowd resp. systemd
+	if err = unixfbp.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: signaling readiness:", err)
+	}
 
 	// pre-declare often-used IPs/frames
 	closeNotification := flowd.Frame{
@@ -99,6 +99,10 @@ func main() {
 	fmt.Fprintln(os.Stderr, "open socket")
 	listener, err := net.ListenUnix(serverAddr.Network(), serverAddr)
 	checkError(err)
+	// signal readiness to flowd resp. systemd
+	if err = unixfbp.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: signaling readiness:", err)
+	}
 	//TODO clean up regular filesystem-bound socket after exit (use defer)
 
 	// pre-declare often-used IPs/frames
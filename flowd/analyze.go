@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Analysis of the network graph for review of large networks.
+
+Using -analyze, the network definition is analyzed on the level of processes, as given in the definition (replicated
+processes count once) and connections between them. Network ports and IIPs are not processes, so a process fed only
+by a network inport is a source and a process writing only to a network outport is a sink.
+
+Reported are the sources and sinks, the topological layers, the strongly connected components with more than one
+process or a connection to itself (feedback loops), the longest path through the network, fan-in and fan-out of each
+process and the processes from which no path leads to a sink or network outport, for example a loop without exit.
+Feedback loops are treated as one step in the layers and the longest path.
+*/
+
+// Analysis is the result of analyzing a network graph
+type Analysis struct {
+	Processes   int           `json:"processes"`
+	Connections int           `json:"connections"` // between processes, including network ports
+	IIPs        int           `json:"iips"`
+	Sources     []string      `json:"sources"` // processes without upstream processes
+	Sinks       []string      `json:"sinks"`   // processes without downstream processes
+	Layers      [][]string    `json:"layers"`  // topological layers, feedback loops in one layer
+	Cycles      [][]string    `json:"cycles"`  // feedback loops
+	LongestPath [][]string    `json:"longestPath"`
+	Fan         []*ProcessFan `json:"fan"`
+	// processes from which no path leads to a sink or network outport
+	Unterminated []string `json:"unterminated"`
+}
+
+// ProcessFan is the number of connections into and out of a process
+type ProcessFan struct {
+	Process  string   `json:"process"`
+	In       int      `json:"in"`  // connections into inports, including from network inports
+	Out      int      `json:"out"` // connections from outports, including to network outports
+	IIPs     int      `json:"iips"`
+	NetIns   []string `json:"netins,omitempty"`  // network inports bound to the process
+	NetOuts  []string `json:"netouts,omitempty"` // network outports bound to the process
+	position int
+}
+
+// analyzeNetwork analyzes the graph of the network definition
+// NOTE: all lists of processes are in definition order
+func analyzeNetwork(nw *fbp.Fbp) *Analysis {
+	analysis := &Analysis{Processes: len(nw.Processes), Sources: []string{}, Sinks: []string{}, Layers: [][]string{}, Cycles: [][]string{}, LongestPath: [][]string{}, Fan: []*ProcessFan{}, Unterminated: []string{}}
+	fans := map[string]*ProcessFan{}
+	for index, process := range nw.Processes {
+		fan := &ProcessFan{Process: process.Name, position: index}
+		fans[process.Name] = fan
+		analysis.Fan = append(analysis.Fan, fan)
+	}
+
+	// connections, without duplicates for the graph algorithms
+	downstreams := make([][]int, len(nw.Processes))
+	upstreams := make([][]int, len(nw.Processes))
+	connected := map[[2]int]bool{}
+	for _, conn := range nw.Connections {
+		target := fans[conn.Target.Process]
+		if target == nil {
+			continue
+		}
+		if conn.Source == nil {
+			target.IIPs++
+			analysis.IIPs++
+			continue
+		}
+		source := fans[conn.Source.Process]
+		if source == nil {
+			continue
+		}
+		source.Out++
+		target.In++
+		analysis.Connections++
+		if edge := [2]int{source.position, target.position}; !connected[edge] {
+			connected[edge] = true
+			downstreams[source.position] = append(downstreams[source.position], target.position)
+			upstreams[target.position] = append(upstreams[target.position], source.position)
+		}
+	}
+	for _, name := range sortedEndpoints(nw.Inports) {
+		if fan := fans[nw.Inports[name].Process]; fan != nil {
+			fan.In++
+			fan.NetIns = append(fan.NetIns, name)
+			analysis.Connections++
+		}
+	}
+	for _, name := range sortedEndpoints(nw.Outports) {
+		if fan := fans[nw.Outports[name].Process]; fan != nil {
+			fan.Out++
+			fan.NetOuts = append(fan.NetOuts, name)
+			analysis.Connections++
+		}
+	}
+
+	// sources and sinks
+	for _, fan := range analysis.Fan {
+		if len(upstreams[fan.position]) == 0 {
+			analysis.Sources = append(analysis.Sources, fan.Process)
+		}
+		if len(downstreams[fan.position]) == 0 {
+			analysis.Sinks = append(analysis.Sinks, fan.Process)
+		}
+	}
+
+	// feedback loops, see stronglyConnected() for the order
+	components, componentOf := stronglyConnected(downstreams)
+	names := func(positions []int) []string {
+		list := make([]string, len(positions))
+		for index, position := range positions {
+			list[index] = nw.Processes[position].Name
+		}
+		return list
+	}
+	cycles := [][]int{}
+	for _, component := range components {
+		if len(component) > 1 || connected[[2]int{component[0], component[0]}] {
+			cycles = append(cycles, component)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+	for _, cycle := range cycles {
+		analysis.Cycles = append(analysis.Cycles, names(cycle))
+	}
+
+	// layers and longest path on the graph of the components, which has no cycles
+	layer := make([]int, len(components))
+	length := make([]int, len(components)) // processes on the longest path ending in the component
+	previous := make([]int, len(components))
+	longest := -1
+	for component := range components {
+		previous[component] = -1
+		for _, position := range components[component] {
+			for _, upstream := range upstreams[position] {
+				from := componentOf[upstream]
+				if from == component {
+					continue
+				}
+				if layer[from]+1 > layer[component] {
+					layer[component] = layer[from] + 1
+				}
+				if previous[component] == -1 || length[from] > length[previous[component]] {
+					previous[component] = from
+				}
+			}
+		}
+		length[component] = len(components[component])
+		if previous[component] != -1 {
+			length[component] += length[previous[component]]
+		}
+		if longest == -1 || length[component] > length[longest] {
+			longest = component
+		}
+	}
+	for position, process := range nw.Processes {
+		index := layer[componentOf[position]]
+		for len(analysis.Layers) <= index {
+			analysis.Layers = append(analysis.Layers, []string{})
+		}
+		analysis.Layers[index] = append(analysis.Layers[index], process.Name)
+	}
+	for component := longest; component != -1; component = previous[component] {
+		analysis.LongestPath = append([][]string{names(components[component])}, analysis.LongestPath...)
+	}
+
+	// processes without path to a sink or network outport, searching upstream from these
+	terminated := make([]bool, len(nw.Processes))
+	pending := []int{}
+	for _, fan := range analysis.Fan {
+		if len(downstreams[fan.position]) == 0 || len(fan.NetOuts) > 0 {
+			terminated[fan.position] = true
+			pending = append(pending, fan.position)
+		}
+	}
+	for len(pending) > 0 {
+		position := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, upstream := range upstreams[position] {
+			if !terminated[upstream] {
+				terminated[upstream] = true
+				pending = append(pending, upstream)
+			}
+		}
+	}
+	for _, fan := range analysis.Fan {
+		if !terminated[fan.position] {
+			analysis.Unterminated = append(analysis.Unterminated, fan.Process)
+		}
+	}
+
+	return analysis
+}
+
+// stronglyConnected returns the strongly connected components of the graph given as downstream nodes of each node
+// and the component of each node, using Tarjan's algorithm
+// NOTE: the components are in topological order, the nodes of each component in ascending order
+func stronglyConnected(downstreams [][]int) (components [][]int, componentOf []int) {
+	index, lowlink := make([]int, len(downstreams)), make([]int, len(downstreams))
+	onStack := make([]bool, len(downstreams))
+	componentOf = make([]int, len(downstreams))
+	stack := []int{}
+	counter := 0
+	var visit func(node int)
+	visit = func(node int) {
+		counter++
+		index[node], lowlink[node] = counter, counter
+		stack = append(stack, node)
+		onStack[node] = true
+		for _, next := range downstreams[node] {
+			if index[next] == 0 {
+				visit(next)
+				if lowlink[next] < lowlink[node] {
+					lowlink[node] = lowlink[next]
+				}
+			} else if onStack[next] && index[next] < lowlink[node] {
+				lowlink[node] = index[next]
+			}
+		}
+		if lowlink[node] != index[node] {
+			return
+		}
+		// node is the root of a component
+		component := []int{}
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == node {
+				break
+			}
+		}
+		components = append(components, component)
+	}
+	for node := range downstreams {
+		if index[node] == 0 {
+			visit(node)
+		}
+	}
+	// Tarjan finds the components in reverse topological order
+	for left, right := 0, len(components)-1; left < right; left, right = left+1, right-1 {
+		components[left], components[right] = components[right], components[left]
+	}
+	for component, nodes := range components {
+		sort.Ints(nodes)
+		for _, node := range nodes {
+			componentOf[node] = component
+		}
+	}
+	return components, componentOf
+}
+
+// printAnalysis outputs the analysis as text or JSON
+func printAnalysis(analysis *Analysis, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(analysis)
+	case "text":
+	default:
+		return fmt.Errorf("unknown output format '%s' - expected text or json", format)
+	}
+	fmt.Printf("processes: %d, connections: %d, IIPs: %d\n", analysis.Processes, analysis.Connections, analysis.IIPs)
+	printList := func(heading string, names []string) {
+		fmt.Println(heading)
+		if len(names) == 0 {
+			fmt.Println("  none")
+		}
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	printList("sources:", analysis.Sources)
+	printList("sinks:", analysis.Sinks)
+	fmt.Println("layers:")
+	for index, layer := range analysis.Layers {
+		fmt.Printf("  %d: %s\n", index, strings.Join(layer, ", "))
+	}
+	fmt.Println("feedback loops:")
+	if len(analysis.Cycles) == 0 {
+		fmt.Println("  none")
+	}
+	for _, cycle := range analysis.Cycles {
+		fmt.Printf("  %s\n", strings.Join(cycle, ", "))
+	}
+	steps, count := []string{}, 0
+	for _, step := range analysis.LongestPath {
+		if len(step) > 1 {
+			steps = append(steps, "{"+strings.Join(step, ", ")+"}")
+		} else {
+			steps = append(steps, step[0])
+		}
+		count += len(step)
+	}
+	fmt.Printf("longest path (%d processes):\n", count)
+	if len(steps) > 0 {
+		fmt.Printf("  %s\n", strings.Join(steps, " -> "))
+	}
+	fmt.Println("fan-in and fan-out:")
+	for _, fan := range analysis.Fan {
+		ports := ""
+		if len(fan.NetIns) > 0 {
+			ports += ", network inports " + strings.Join(fan.NetIns, ", ")
+		}
+		if len(fan.NetOuts) > 0 {
+			ports += ", network outports " + strings.Join(fan.NetOuts, ", ")
+		}
+		fmt.Printf("  %s: in %d, out %d, IIPs %d%s\n", fan.Process, fan.In, fan.Out, fan.IIPs, ports)
+	}
+	printList("without path to a sink or network outport:", analysis.Unterminated)
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Configuration of running processes through their CONF inport.
+
+By convention, components accepting new configuration at runtime have the inport CONF, on which each data frame
+carries a complete new configuration in the same format as the IIP to ARGS, see unixfbp.WatchConf(). An invalid
+configuration is reported by the component, which keeps its current one.
+
+A process gets the CONF inport if there is an IIP or connection into it, otherwise using the process metadata
+conf=runtime:
+
+	'-pass -or sudo' -> ARGS Filter(bin/packet-filter-string:conf=runtime)
+
+New configuration is pushed to a running process, all instances if replicated, using POST /conf?process=NAME with
+the configuration as request body, on the status socket given using -status-socket, using the command conf of the
+network sub-protocol on the online configuration server given using -olc, or using the daemon command conf:
+
+	curl --unix-socket status.sock --data-binary '-drop -or cron' http://flowd/conf?process=Filter
+	{"protocol": "network", "command": "conf", "payload": {"process": "Filter", "conf": "-drop -or cron"}}
+	{"command": "conf", "network": "filter", "process": "Filter", "conf": "-drop -or cron"}
+
+Since the online configuration server is unauthenticated, the conf command and /conf are only accepted on it if allowed
+using -olc-conf, see olc.go.
+
+NOTE: if the CONF inport is also connected to another process, frames of both may get mixed up if large.
+*/
+
+const (
+	confPort     = "CONF"
+	confMetadata = "conf"
+	confRuntime  = "runtime"
+	confTimeout  = 5 * time.Second // for the component to open its CONF inport and read the configuration
+)
+
+// needsConfPort returns whether the process gets the CONF inport only because of the conf=runtime metadata
+func needsConfPort(proc *Process) bool {
+	if proc.Metadata[confMetadata] != confRuntime {
+		return false
+	}
+	for _, inport := range proc.InPorts {
+		if inport.LocalPort == confPort {
+			return false
+		}
+	}
+	for _, iip := range proc.IIPs {
+		if iip.Port == confPort {
+			return false
+		}
+	}
+	return true
+}
+
+// pushConf delivers the configuration to the CONF inport of the running process, to all instances if replicated
+func pushConf(procs Network, nw *fbp.Fbp, name string, conf string) error {
+	instances, err := processInstances(procs, name)
+	if err != nil {
+		return err
+	}
+	for _, procName := range instances {
+		proc := procs[procName]
+		instancesLock.Lock()
+		running := proc.Instance != nil && proc.Instance.Cmd != nil
+		instancesLock.Unlock()
+		if !running {
+			return fmt.Errorf("process %s is not running", procName)
+		}
+		plan, err := planInstance(proc, nw)
+		if err != nil {
+			return err
+		}
+		if plan.Host != "" {
+			return fmt.Errorf("process %s: configuration of processes on remote hosts currently unimplemented", procName)
+		}
+		path := ""
+		for _, port := range plan.Ports {
+			if port.Inport && port.Port == confPort {
+				path = port.Path
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("process %s has no %s inport - connect it or set process metadata %s=%s", procName, confPort, confMetadata, confRuntime)
+		}
+		if err = writeConf(path, conf); err != nil {
+			return fmt.Errorf("process %s: %s", procName, err)
+		}
+		if !quiet {
+			fmt.Printf("sent configuration to %s.%s\n", procName, confPort)
+		}
+	}
+	return nil
+}
+
+// writeConf writes the configuration frame into the named pipe, waiting for the component to open it
+// NOTE: the component opens its CONF inport again after each configuration, so it may be closed for a moment
+func writeConf(path string, conf string) error {
+	deadline := time.Now().Add(confTimeout)
+	var confPipe *os.File
+	var err error
+	for {
+		// NOTE: opening non-blocking fails with ENXIO instead of blocking while there is no reader
+		if confPipe, err = os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe); err == nil {
+			break
+		}
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENXIO {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("component is not reading its %s inport", confPort)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer confPipe.Close()
+	confPipe.SetWriteDeadline(deadline)
+	writer := bufio.NewWriter(confPipe)
+	frame := &flowd.Frame{Type: "data", BodyType: "Conf", Port: confPort, Body: []byte(conf)}
+	if err = frame.Serialize(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// serveConf pushes the configuration given as request body to the process given as query parameter
+func serveConf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST with the configuration as body", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("process")
+	if name == "" {
+		http.Error(w, "missing query parameter process", http.StatusBadRequest)
+		return
+	}
+	if live == nil || live.procs == nil {
+		http.Error(w, "network not running", http.StatusServiceUnavailable)
+		return
+	}
+	conf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = pushConf(live.procs, live.nw, name, string(conf)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
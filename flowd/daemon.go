@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+Daemon hosting multiple named networks, run using "flowd daemon".
+
+Each network is deployed into its own directory below the state directory given using -dir, holding its deployment
+and its named pipes. It runs as a separate flowd process in its own process group, so networks are isolated from each
+other and from the daemon. Networks still running when the daemon is shut down are started again once it comes up.
+
+The daemon is controlled through a Unix socket using JSON: each connection carries one request line and gets one
+response line, except for logs with follow, which keeps streaming responses with new log lines until the client
+disconnects:
+
+	{"command": "deploy", "network": "chat", "definition": "...", "args": ["-set", "PORT=7000"], "start": true}
+	{"command": "deploy", "network": "copy", "path": "/srv/networks/copy.fbp"}
+	{"command": "start", "network": "chat"}
+	{"command": "stop", "network": "chat"}
+	{"command": "list"}
+	{"command": "status", "network": "chat"}
+	{"command": "logs", "network": "chat", "lines": 100, "follow": true}
+	{"command": "graph", "network": "chat", "format": "mermaid"}
+	{"command": "conf", "network": "chat", "process": "Filter", "conf": "-pass -or sudo"}
+	{"command": "remove", "network": "chat"}
+
+The graph of a running network includes its live state, see graph.go. New configuration is pushed to a process of a
+running network using conf, see conf.go.
+
+NOTE: the working directory of the networks is the one of the daemon, relative component paths are resolved from there.
+*/
+
+const (
+	daemonLogLines = 1000 // log lines kept per network
+	deploymentFile = "deployment.json"
+	definitionFile = "network.fbp"
+	statusFile     = "status.sock" // status socket of the running network, see graph.go
+
+	// states of hosted networks
+	stateDeployed = "deployed" // not started or stopped
+	stateRunning  = "running"
+	stateStopping = "stopping"
+	stateExited   = "exited" // exited by itself
+)
+
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// DaemonRequest is a request on the control socket
+type DaemonRequest struct {
+	Command    string   `json:"command"`
+	Network    string   `json:"network,omitempty"`
+	Definition string   `json:"definition,omitempty"` // deploy: network definition in .fbp format
+	Path       string   `json:"path,omitempty"`       // deploy: or path of a network definition file on this host
+	Args       []string `json:"args,omitempty"`       // deploy: further flowd flags
+	Start      bool     `json:"start,omitempty"`      // deploy: start right away
+	Lines      int      `json:"lines,omitempty"`      // logs: number of recent lines, 0 = all kept
+	Follow     bool     `json:"follow,omitempty"`     // logs: keep streaming new lines
+	Format     string   `json:"format,omitempty"`     // graph: one of the graph* formats, default JSON
+	Process    string   `json:"process,omitempty"`    // conf: process to configure
+	Conf       string   `json:"conf,omitempty"`       // conf: new configuration
+}
+
+// DaemonResponse is a response on the control socket
+type DaemonResponse struct {
+	OK       bool                   `json:"ok"`
+	Error    string                 `json:"error,omitempty"`
+	Network  *HostedNetworkStatus   `json:"network,omitempty"`
+	Networks []*HostedNetworkStatus `json:"networks,omitempty"`
+	Lines    []string               `json:"lines,omitempty"`
+	Graph    json.RawMessage        `json:"graph,omitempty"` // JSON graph, or the graph in other formats as string
+}
+
+// HostedNetworkStatus is the state of a hosted network as returned on the control socket
+type HostedNetworkStatus struct {
+	Name       string     `json:"name"`
+	Definition string     `json:"definition"`
+	Args       []string   `json:"args"`
+	State      string     `json:"state"` // one of the state* constants above
+	PID        int        `json:"pid,omitempty"`
+	Started    *time.Time `json:"started,omitempty"`
+	Exited     *time.Time `json:"exited,omitempty"`
+	ExitCode   *int       `json:"exitCode,omitempty"`
+}
+
+// Deployment is the persisted configuration of a hosted network
+type Deployment struct {
+	Definition string   `json:"definition"` // path of the network definition file
+	Args       []string `json:"args"`
+	Autostart  bool     `json:"autostart"` // start once the daemon comes up, = was running
+}
+
+// hostedNetwork is a network hosted by the daemon, guarded by the daemon mutex
+type hostedNetwork struct {
+	name       string
+	dir        string
+	deployment Deployment
+	state      string
+	cmd        *exec.Cmd
+	started    time.Time
+	exited     time.Time
+	exitCode   int
+	done       chan struct{} // closed once the flowd process has exited
+	log        *logBuffer
+}
+
+// daemon hosts the deployed networks
+type daemon struct {
+	dir       string
+	flowdPath string
+	mutex     sync.Mutex
+	networks  map[string]*hostedNetwork
+}
+
+func runDaemon(args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	dir := flags.String("dir", "/var/lib/flowd", "state directory holding the deployed networks")
+	socketPath := flags.String("socket", "", "Unix socket for the control API (default: control.sock in the state directory)")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "daemon [-dir state-dir] [-socket path]")
+		flags.PrintDefaults()
+		return 2
+	}
+	if *socketPath == "" {
+		*socketPath = filepath.Join(*dir, "control.sock")
+	}
+	flowdPath, err := os.Executable()
+	if err != nil {
+		fmt.Println("ERROR: finding flowd executable:", err)
+		return 1
+	}
+	if err = os.MkdirAll(*dir, 0750); err != nil {
+		fmt.Println("ERROR: creating state directory:", err)
+		return 1
+	}
+	d, err := newDaemon(*dir, flowdPath)
+	if err != nil {
+		fmt.Println("ERROR: loading deployed networks:", err)
+		return 1
+	}
+
+	// control socket
+	if conn, err := net.Dial("unix", *socketPath); err == nil {
+		conn.Close()
+		fmt.Printf("ERROR: daemon already listening on %s\n", *socketPath)
+		return 1
+	}
+	os.Remove(*socketPath)
+	listener, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		fmt.Println("ERROR: listening on control socket:", err)
+		return 1
+	}
+	defer os.Remove(*socketPath)
+	if err = os.Chmod(*socketPath, 0660); err != nil {
+		fmt.Println("WARNING: setting permissions of control socket:", err)
+	}
+	fmt.Printf("INFO: listening on %s, hosting %d networks\n", *socketPath, len(d.networks))
+	d.autostart()
+
+	// shutdown on signal
+	// NOTE: running networks are stopped, but started again once the daemon comes up
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("INFO: got %s - stopping networks and exiting.\n", sig)
+		d.stopAll()
+		close(shutdown)
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-shutdown:
+				return 0
+			default:
+			}
+			fmt.Println("ERROR: accepting control connection:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go d.serve(conn)
+	}
+}
+
+// newDaemon loads the networks deployed in the state directory
+func newDaemon(dir string, flowdPath string) (*daemon, error) {
+	d := &daemon{dir: dir, flowdPath: flowdPath, networks: map[string]*hostedNetwork{}}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), deploymentFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		n := &hostedNetwork{name: entry.Name(), dir: filepath.Join(dir, entry.Name()), state: stateDeployed, log: newLogBuffer(daemonLogLines)}
+		if err = json.Unmarshal(data, &n.deployment); err != nil {
+			return nil, fmt.Errorf("network %s: %s", n.name, err)
+		}
+		d.networks[n.name] = n
+	}
+	return d, nil
+}
+
+// autostart starts the networks which were running when the daemon was shut down
+func (d *daemon) autostart() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, n := range d.networks {
+		if !n.deployment.Autostart {
+			continue
+		}
+		if err := d.start(n); err != nil {
+			fmt.Printf("ERROR: starting network %s: %s\n", n.name, err)
+		}
+	}
+}
+
+// serve handles one connection on the control socket
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return
+	}
+	req := &DaemonRequest{}
+	if err = json.Unmarshal(line, req); err != nil {
+		encoder.Encode(&DaemonResponse{Error: "decoding request: " + err.Error()})
+		return
+	}
+	if req.Command == "logs" && req.Follow {
+		d.followLogs(req, conn, encoder)
+		return
+	}
+	encoder.Encode(d.handle(req))
+}
+
+// handle executes a request, except following logs
+func (d *daemon) handle(req *DaemonRequest) *DaemonResponse {
+	var status *HostedNetworkStatus
+	var err error
+	switch req.Command {
+	case "deploy":
+		status, err = d.deploy(req)
+	case "start", "status", "logs", "remove":
+		d.mutex.Lock()
+		n, found := d.networks[req.Network]
+		switch {
+		case !found:
+			err = fmt.Errorf("no such network: %s", req.Network)
+		case req.Command == "start":
+			err = d.start(n)
+		case req.Command == "logs":
+			d.mutex.Unlock()
+			return &DaemonResponse{OK: true, Lines: n.log.tail(req.Lines)}
+		case req.Command == "remove":
+			err = d.remove(n)
+		}
+		if err == nil && req.Command != "remove" {
+			status = n.status()
+		}
+		d.mutex.Unlock()
+	case "stop":
+		status, err = d.stop(req.Network, false)
+	case "list":
+		return &DaemonResponse{OK: true, Networks: d.list()}
+	case "graph":
+		graph, err := d.graph(req.Network, req.Format)
+		if err != nil {
+			return &DaemonResponse{Error: err.Error()}
+		}
+		return &DaemonResponse{OK: true, Graph: graph}
+	case "conf":
+		err = d.conf(req.Network, req.Process, req.Conf)
+	default:
+		err = fmt.Errorf("unknown command: %s", req.Command)
+	}
+	if err != nil {
+		return &DaemonResponse{Error: err.Error()}
+	}
+	if req.Command != "status" && !quiet {
+		fmt.Printf("INFO: %s network %s: ok\n", req.Command, req.Network)
+	}
+	return &DaemonResponse{OK: true, Network: status}
+}
+
+// deploy stores the network definition and flowd flags of a network, replacing an existing deployment
+func (d *daemon) deploy(req *DaemonRequest) (*HostedNetworkStatus, error) {
+	if !networkNamePattern.MatchString(req.Network) {
+		return nil, fmt.Errorf("invalid network name '%s': expected letters, digits, _ and -", req.Network)
+	}
+	if (req.Definition == "") == (req.Path == "") {
+		return nil, errors.New("expected either definition or path of the network definition")
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n, found := d.networks[req.Network]
+	if found && (n.state == stateRunning || n.state == stateStopping) {
+		return nil, fmt.Errorf("network %s is running - stop it first", req.Network)
+	}
+	if !found {
+		n = &hostedNetwork{name: req.Network, dir: filepath.Join(d.dir, req.Network), state: stateDeployed, log: newLogBuffer(daemonLogLines)}
+	}
+	if err := os.MkdirAll(n.dir, 0750); err != nil {
+		return nil, err
+	}
+	deployment := Deployment{Definition: req.Path, Args: req.Args}
+	if deployment.Args == nil {
+		deployment.Args = []string{}
+	}
+	if req.Definition != "" {
+		deployment.Definition = filepath.Join(n.dir, definitionFile)
+		if err := ioutil.WriteFile(deployment.Definition, []byte(req.Definition), 0640); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(req.Path); err != nil {
+		return nil, err
+	}
+	if absPath, err := filepath.Abs(deployment.Definition); err == nil {
+		deployment.Definition = absPath
+	}
+	n.deployment = deployment
+	if err := n.save(); err != nil {
+		return nil, err
+	}
+	d.networks[n.name] = n
+	n.log.add(fmt.Sprintf("flowd daemon: deployed %s", deployment.Definition))
+	if req.Start {
+		if err := d.start(n); err != nil {
+			return nil, err
+		}
+	}
+	return n.status(), nil
+}
+
+// start launches the flowd process of the network
+// NOTE: mutex must be held
+func (d *daemon) start(n *hostedNetwork) error {
+	if n.state == stateRunning || n.state == stateStopping {
+		return fmt.Errorf("network %s is already running", n.name)
+	}
+	fifos := filepath.Join(n.dir, "fifos")
+	if err := os.MkdirAll(fifos, 0750); err != nil {
+		return err
+	}
+	cmd := exec.Command(d.flowdPath, append(append([]string{"-fifodir", fifos, "-status-socket", filepath.Join(n.dir, statusFile)}, n.deployment.Args...), n.deployment.Definition)...)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	// NOTE: own process group to be able to stop it including all components
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	n.cmd, n.state, n.started, n.done = cmd, stateRunning, time.Now(), make(chan struct{})
+	n.deployment.Autostart = true
+	if err = n.save(); err != nil {
+		fmt.Printf("WARNING: saving deployment of network %s: %s\n", n.name, err)
+	}
+	n.log.add(fmt.Sprintf("flowd daemon: started with PID %d", cmd.Process.Pid))
+	go d.supervise(n, cmd, reader, n.done)
+	return nil
+}
+
+// supervise collects the output of the flowd process of a network and records its exit
+func (d *daemon) supervise(n *hostedNetwork, cmd *exec.Cmd, output *os.File, done chan struct{}) {
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		defer output.Close()
+		// NOTE: not using bufio.Scanner, which stops on long lines, after which flowd would die of SIGPIPE
+		reader := bufio.NewReader(output)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				n.log.add(strings.TrimSuffix(line, "\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	cmd.Wait()
+	// NOTE: components left over, eg. after flowd exited on an error, would keep the output open
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	<-logged
+	d.mutex.Lock()
+	n.exited, n.exitCode, n.cmd = time.Now(), cmd.ProcessState.ExitCode(), nil
+	if n.state == stateStopping {
+		n.state = stateDeployed
+	} else {
+		// exited by itself, so not to be started again once the daemon comes up
+		n.state = stateExited
+		n.deployment.Autostart = false
+		if err := n.save(); err != nil {
+			fmt.Printf("WARNING: saving deployment of network %s: %s\n", n.name, err)
+		}
+	}
+	d.mutex.Unlock()
+	n.log.add(fmt.Sprintf("flowd daemon: exited with code %d", cmd.ProcessState.ExitCode()))
+	if !quiet {
+		fmt.Printf("INFO: network %s exited with code %d\n", n.name, cmd.ProcessState.ExitCode())
+	}
+	close(done)
+}
+
+// graph returns the graph of a network, including live state if running
+// NOTE: for a network not running, the graph of its network definition is generated by flowd
+func (d *daemon) graph(name string, format string) (json.RawMessage, error) {
+	if format == "" {
+		format = graphJSON
+	}
+	d.mutex.Lock()
+	n, found := d.networks[name]
+	var running bool
+	var deployment Deployment
+	if found {
+		running, deployment = n.state == stateRunning, n.deployment
+	}
+	d.mutex.Unlock()
+	if !found {
+		return nil, fmt.Errorf("no such network: %s", name)
+	}
+	var output []byte
+	var err error
+	if running {
+		var response *http.Response
+		if response, err = statusClient(filepath.Join(n.dir, statusFile)).Get("http://flowd/graph?format=" + url.QueryEscape(format)); err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if output, err = ioutil.ReadAll(response.Body); err == nil && response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(output)))
+		}
+	} else {
+		cmd := exec.Command(d.flowdPath, append(append([]string{"-graph", "-graph-format", format}, deployment.Args...), deployment.Definition)...)
+		if output, err = cmd.Output(); err != nil {
+			err = fmt.Errorf("generating graph: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if format == graphJSON {
+		return json.RawMessage(output), nil
+	}
+	return json.Marshal(string(output))
+}
+
+// conf pushes new configuration to a process of a running network through its status socket
+func (d *daemon) conf(name string, process string, conf string) error {
+	if process == "" {
+		return errors.New("expected process to configure")
+	}
+	d.mutex.Lock()
+	n, found := d.networks[name]
+	var running bool
+	if found {
+		running = n.state == stateRunning
+	}
+	d.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("no such network: %s", name)
+	}
+	if !running {
+		return fmt.Errorf("network %s is not running", name)
+	}
+	response, err := statusClient(filepath.Join(n.dir, statusFile)).Post("http://flowd/conf?process="+url.QueryEscape(process), "text/plain", strings.NewReader(conf))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		output, _ := ioutil.ReadAll(response.Body)
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// statusClient returns an HTTP client for the status socket of a running network
+func statusClient(path string) *http.Client {
+	return &http.Client{Timeout: 10 * time.Second, Transport: statusTransport(path)}
+}
+
+// statusTransport connects HTTP requests to the status socket of a running network, whatever the host in the URL
+func statusTransport(path string) *http.Transport {
+	return &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}}
+}
+
+// stop terminates the flowd process of a network including all components, waiting for its exit
+// NOTE: with keepAutostart, the network is started again once the daemon comes up
+func (d *daemon) stop(name string, keepAutostart bool) (*HostedNetworkStatus, error) {
+	d.mutex.Lock()
+	n, found := d.networks[name]
+	if !found {
+		d.mutex.Unlock()
+		return nil, fmt.Errorf("no such network: %s", name)
+	}
+	if n.state != stateRunning {
+		d.mutex.Unlock()
+		return nil, fmt.Errorf("network %s is not running", name)
+	}
+	n.state = stateStopping
+	if !keepAutostart {
+		n.deployment.Autostart = false
+		if err := n.save(); err != nil {
+			fmt.Printf("WARNING: saving deployment of network %s: %s\n", n.name, err)
+		}
+	}
+	pid, done := n.cmd.Process.Pid, n.done
+	d.mutex.Unlock()
+
+	n.log.add("flowd daemon: stopping")
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		n.log.add("flowd daemon: still running after shutdown grace period - killing")
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-done
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return n.status(), nil
+}
+
+// stopAll stops all running networks in parallel for daemon shutdown
+func (d *daemon) stopAll() {
+	var wg sync.WaitGroup
+	for _, status := range d.list() {
+		if status.State != stateRunning {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			d.stop(name, true)
+		}(status.Name)
+	}
+	wg.Wait()
+}
+
+// remove deletes a stopped network including its directory
+// NOTE: mutex must be held
+func (d *daemon) remove(n *hostedNetwork) error {
+	if n.state == stateRunning || n.state == stateStopping {
+		return fmt.Errorf("network %s is running - stop it first", n.name)
+	}
+	if err := os.RemoveAll(n.dir); err != nil {
+		return err
+	}
+	delete(d.networks, n.name)
+	return nil
+}
+
+// list returns the status of all networks sorted by name
+func (d *daemon) list() []*HostedNetworkStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	statuses := []*HostedNetworkStatus{}
+	for _, n := range d.networks {
+		statuses = append(statuses, n.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// followLogs streams the log lines of a network until the client disconnects
+func (d *daemon) followLogs(req *DaemonRequest, conn net.Conn, encoder *json.Encoder) {
+	d.mutex.Lock()
+	n, found := d.networks[req.Network]
+	d.mutex.Unlock()
+	if !found {
+		encoder.Encode(&DaemonResponse{Error: "no such network: " + req.Network})
+		return
+	}
+	lines, follower := n.log.follow(req.Lines)
+	defer n.log.unfollow(follower)
+	if err := encoder.Encode(&DaemonResponse{OK: true, Lines: lines}); err != nil {
+		return
+	}
+	// NOTE: the client sends nothing more, so reading returns once it has disconnected
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+	for {
+		select {
+		case line := <-follower:
+			if err := encoder.Encode(&DaemonResponse{OK: true, Lines: []string{line}}); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// status returns the state of the network for the control API
+// NOTE: daemon mutex must be held
+func (n *hostedNetwork) status() *HostedNetworkStatus {
+	status := &HostedNetworkStatus{Name: n.name, Definition: n.deployment.Definition, Args: n.deployment.Args, State: n.state}
+	if !n.started.IsZero() {
+		started := n.started
+		status.Started = &started
+	}
+	if n.cmd != nil {
+		status.PID = n.cmd.Process.Pid
+	} else if !n.exited.IsZero() {
+		exited, exitCode := n.exited, n.exitCode
+		status.Exited, status.ExitCode = &exited, &exitCode
+	}
+	return status
+}
+
+// save writes the deployment of the network into its directory
+func (n *hostedNetwork) save() error {
+	data, err := json.MarshalIndent(n.deployment, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(n.dir, deploymentFile)
+	if err = ioutil.WriteFile(path+".tmp", append(data, '\n'), 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// logBuffer keeps the recent log lines of a network and passes new ones on to followers
+type logBuffer struct {
+	mutex     sync.Mutex
+	lines     []string
+	size      int
+	followers map[chan string]bool
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{size: size, followers: map[chan string]bool{}}
+}
+
+// add appends a line, dropping the oldest one if full
+// NOTE: followers not keeping up miss lines instead of blocking the network output
+func (b *logBuffer) add(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.size {
+		b.lines = append(b.lines[:0], b.lines[len(b.lines)-b.size:]...)
+	}
+	for follower := range b.followers {
+		select {
+		case follower <- line:
+		default:
+		}
+	}
+}
+
+// tail returns the last count lines, all if count <= 0
+func (b *logBuffer) tail(count int) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.tailLocked(count)
+}
+
+func (b *logBuffer) tailLocked(count int) []string {
+	if count <= 0 || count > len(b.lines) {
+		count = len(b.lines)
+	}
+	return append([]string{}, b.lines[len(b.lines)-count:]...)
+}
+
+// follow returns the last count lines and a channel receiving the lines added from now on
+func (b *logBuffer) follow(count int) ([]string, chan string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	follower := make(chan string, 100)
+	b.followers[follower] = true
+	return b.tailLocked(count), follower
+}
+
+func (b *logBuffer) unfollow(follower chan string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.followers, follower)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Semantic diff between two network definitions.
+
+Using -diff, the two given network definitions are parsed, including their includes and with variables substituted,
+and compared independent of ordering and formatting. Reported are the added, removed and changed processes (component
+and metadata), connections between processes, IIPs and network inports and outports.
+
+IIPs are compared per target port: if both networks have one IIP for a port, a different value is reported as changed,
+otherwise as removed and added.
+*/
+
+// kinds of changes
+const (
+	diffAdded   = "added"
+	diffRemoved = "removed"
+	diffChanged = "changed"
+)
+
+// NetworkDiff is the difference between two networks, each list sorted by name
+type NetworkDiff struct {
+	Processes   []*DiffEntry `json:"processes"`
+	Connections []*DiffEntry `json:"connections"`
+	IIPs        []*DiffEntry `json:"iips"`
+	Inports     []*DiffEntry `json:"inports"`
+	Outports    []*DiffEntry `json:"outports"`
+}
+
+// DiffEntry is an added, removed or changed element of the network
+type DiffEntry struct {
+	Change string `json:"change"` // one of the diff* constants above
+	// process name, connection as PROCESS.PORT -> PROCESS.PORT, IIP target port as PROCESS.PORT or network port name
+	Name string `json:"name"`
+	// component of the process, data of the IIP or process port of the network port, for changes only if changed
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// metadata of the process, for changes only the changed keys; Name is the key
+	Metadata []*DiffEntry `json:"metadata,omitempty"`
+}
+
+// Empty returns whether both networks are the same
+func (diff *NetworkDiff) Empty() bool {
+	return len(diff.Processes) == 0 && len(diff.Connections) == 0 && len(diff.IIPs) == 0 && len(diff.Inports) == 0 && len(diff.Outports) == 0
+}
+
+// diffNetworks compares the old network with the new one
+func diffNetworks(old *fbp.Fbp, current *fbp.Fbp) *NetworkDiff {
+	diff := &NetworkDiff{Processes: []*DiffEntry{}, Connections: []*DiffEntry{}, IIPs: []*DiffEntry{}}
+
+	// processes
+	oldProcs, newProcs := map[string]*fbp.Process{}, map[string]*fbp.Process{}
+	oldNames, newNames := []string{}, []string{}
+	for _, proc := range old.Processes {
+		oldProcs[proc.Name] = proc
+		oldNames = append(oldNames, proc.Name)
+	}
+	for _, proc := range current.Processes {
+		newProcs[proc.Name] = proc
+		newNames = append(newNames, proc.Name)
+	}
+	for _, name := range unionKeys(oldNames, newNames) {
+		oldProc, newProc := oldProcs[name], newProcs[name]
+		switch {
+		case newProc == nil:
+			diff.Processes = append(diff.Processes, &DiffEntry{Change: diffRemoved, Name: name, Old: oldProc.Component, Metadata: diffMetadata(oldProc.Metadata, nil)})
+		case oldProc == nil:
+			diff.Processes = append(diff.Processes, &DiffEntry{Change: diffAdded, Name: name, New: newProc.Component, Metadata: diffMetadata(nil, newProc.Metadata)})
+		default:
+			entry := &DiffEntry{Change: diffChanged, Name: name, Metadata: diffMetadata(oldProc.Metadata, newProc.Metadata)}
+			if oldProc.Component != newProc.Component {
+				entry.Old, entry.New = oldProc.Component, newProc.Component
+			}
+			if entry.Old != "" || entry.New != "" || len(entry.Metadata) > 0 {
+				diff.Processes = append(diff.Processes, entry)
+			}
+		}
+	}
+
+	// connections and IIPs
+	oldConns, oldIIPs := connectionSets(old)
+	newConns, newIIPs := connectionSets(current)
+	oldNames, newNames = []string{}, []string{}
+	for name := range oldConns {
+		oldNames = append(oldNames, name)
+	}
+	for name := range newConns {
+		newNames = append(newNames, name)
+	}
+	for _, name := range unionKeys(oldNames, newNames) {
+		if !newConns[name] {
+			diff.Connections = append(diff.Connections, &DiffEntry{Change: diffRemoved, Name: name})
+		} else if !oldConns[name] {
+			diff.Connections = append(diff.Connections, &DiffEntry{Change: diffAdded, Name: name})
+		}
+	}
+	oldNames, newNames = []string{}, []string{}
+	for target := range oldIIPs {
+		oldNames = append(oldNames, target)
+	}
+	for target := range newIIPs {
+		newNames = append(newNames, target)
+	}
+	for _, target := range unionKeys(oldNames, newNames) {
+		oldData, newData := oldIIPs[target], newIIPs[target]
+		if len(oldData) == 1 && len(newData) == 1 {
+			if oldData[0] != newData[0] {
+				diff.IIPs = append(diff.IIPs, &DiffEntry{Change: diffChanged, Name: target, Old: oldData[0], New: newData[0]})
+			}
+			continue
+		}
+		// NOTE: multiple IIPs into the same port are compared as multiset
+		remaining := map[string]int{}
+		for _, data := range newData {
+			remaining[data]++
+		}
+		for _, data := range oldData {
+			if remaining[data] > 0 {
+				remaining[data]--
+			} else {
+				diff.IIPs = append(diff.IIPs, &DiffEntry{Change: diffRemoved, Name: target, Old: data})
+			}
+		}
+		for _, data := range newData {
+			if remaining[data] > 0 {
+				remaining[data]--
+				diff.IIPs = append(diff.IIPs, &DiffEntry{Change: diffAdded, Name: target, New: data})
+			}
+		}
+	}
+
+	// network ports
+	diff.Inports = diffNetPorts(old.Inports, current.Inports)
+	diff.Outports = diffNetPorts(old.Outports, current.Outports)
+
+	return diff
+}
+
+// connectionSets returns the connections between processes and the IIPs by target port of the network
+func connectionSets(nw *fbp.Fbp) (connections map[string]bool, iips map[string][]string) {
+	connections, iips = map[string]bool{}, map[string][]string{}
+	for _, conn := range nw.Connections {
+		target := conn.Target.Process + "." + generatePortName(conn.Target)
+		if conn.Source == nil {
+			iips[target] = append(iips[target], conn.Data)
+			continue
+		}
+		connections[conn.Source.Process+"."+generatePortName(conn.Source)+" -> "+target] = true
+	}
+	return connections, iips
+}
+
+func diffMetadata(old map[string]string, current map[string]string) (entries []*DiffEntry) {
+	oldKeys, newKeys := []string{}, []string{}
+	for key := range old {
+		oldKeys = append(oldKeys, key)
+	}
+	for key := range current {
+		newKeys = append(newKeys, key)
+	}
+	for _, key := range unionKeys(oldKeys, newKeys) {
+		oldValue, inOld := old[key]
+		newValue, inNew := current[key]
+		switch {
+		case !inNew:
+			entries = append(entries, &DiffEntry{Change: diffRemoved, Name: key, Old: oldValue})
+		case !inOld:
+			entries = append(entries, &DiffEntry{Change: diffAdded, Name: key, New: newValue})
+		case oldValue != newValue:
+			entries = append(entries, &DiffEntry{Change: diffChanged, Name: key, Old: oldValue, New: newValue})
+		}
+	}
+	return entries
+}
+
+func diffNetPorts(old map[string]*fbp.Endpoint, current map[string]*fbp.Endpoint) []*DiffEntry {
+	entries := []*DiffEntry{}
+	for _, name := range unionKeys(sortedEndpoints(old), sortedEndpoints(current)) {
+		switch {
+		case current[name] == nil:
+			entries = append(entries, &DiffEntry{Change: diffRemoved, Name: name, Old: old[name].Process + "." + generatePortName(old[name])})
+		case old[name] == nil:
+			entries = append(entries, &DiffEntry{Change: diffAdded, Name: name, New: current[name].Process + "." + generatePortName(current[name])})
+		default:
+			oldPort, newPort := old[name].Process+"."+generatePortName(old[name]), current[name].Process+"."+generatePortName(current[name])
+			if oldPort != newPort {
+				entries = append(entries, &DiffEntry{Change: diffChanged, Name: name, Old: oldPort, New: newPort})
+			}
+		}
+	}
+	return entries
+}
+
+// unionKeys returns the names given in either list, sorted and without duplicates
+func unionKeys(a []string, b []string) []string {
+	found := map[string]bool{}
+	keys := []string{}
+	for _, key := range append(append([]string{}, a...), b...) {
+		if !found[key] {
+			found[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printDiff outputs the diff as text or JSON
+func printDiff(diff *NetworkDiff, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(diff)
+	case "text":
+	default:
+		return fmt.Errorf("unknown output format '%s' - expected text or json", format)
+	}
+	if diff.Empty() {
+		fmt.Println("networks are equivalent")
+		return nil
+	}
+	markers := map[string]string{diffAdded: "+", diffRemoved: "-", diffChanged: "~"}
+	section := func(heading string, entries []*DiffEntry, describe func(entry *DiffEntry) string) {
+		if len(entries) == 0 {
+			return
+		}
+		fmt.Println(heading)
+		for _, entry := range entries {
+			fmt.Printf("  %s %s\n", markers[entry.Change], describe(entry))
+		}
+	}
+	section("processes:", diff.Processes, func(entry *DiffEntry) string {
+		description := entry.Name
+		switch {
+		case entry.Change == diffAdded:
+			description += " (" + entry.New + ")"
+		case entry.Change == diffRemoved:
+			description += " (" + entry.Old + ")"
+		case entry.Old != "" || entry.New != "":
+			description += fmt.Sprintf(": component %s -> %s", entry.Old, entry.New)
+		}
+		metadata := []string{}
+		for _, key := range entry.Metadata {
+			switch key.Change {
+			case diffAdded:
+				metadata = append(metadata, fmt.Sprintf("+%s=%s", key.Name, key.New))
+			case diffRemoved:
+				metadata = append(metadata, fmt.Sprintf("-%s=%s", key.Name, key.Old))
+			default:
+				metadata = append(metadata, fmt.Sprintf("%s=%s -> %s", key.Name, key.Old, key.New))
+			}
+		}
+		if len(metadata) > 0 {
+			description += ", metadata " + strings.Join(metadata, ", ")
+		}
+		return description
+	})
+	section("connections:", diff.Connections, func(entry *DiffEntry) string {
+		return entry.Name
+	})
+	section("IIPs:", diff.IIPs, func(entry *DiffEntry) string {
+		switch entry.Change {
+		case diffAdded:
+			return fmt.Sprintf("'%s' -> %s", entry.New, entry.Name)
+		case diffRemoved:
+			return fmt.Sprintf("'%s' -> %s", entry.Old, entry.Name)
+		}
+		return fmt.Sprintf("%s: '%s' -> '%s'", entry.Name, entry.Old, entry.New)
+	})
+	netPort := func(entry *DiffEntry) string {
+		switch entry.Change {
+		case diffAdded:
+			return fmt.Sprintf("%s (%s)", entry.Name, entry.New)
+		case diffRemoved:
+			return fmt.Sprintf("%s (%s)", entry.Name, entry.Old)
+		}
+		return fmt.Sprintf("%s: %s -> %s", entry.Name, entry.Old, entry.New)
+	}
+	section("network inports:", diff.Inports, netPort)
+	section("network outports:", diff.Outports, netPort)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+/*
+Export of a network as a standalone POSIX shell script, like the hand-written examples/chat-server.sh.
+
+The script creates the named pipes, starts each component with the argv flowd would use, delivers the IIPs not going
+to ARGS as framed IIPs into their named pipes, waits for all components to exit and removes the named pipes.
+
+NOTE: argv[0] cannot be set in POSIX sh, so components get their executable path instead of the process name as argv[0].
+NOTE: merging of inports with multiple upstreams, recording, replaying and network ports bound to sockets are done by flowd itself and cannot be exported.
+*/
+
+// exportShellScript writes the launch plan as a POSIX shell script
+func exportShellScript(plan *NetworkPlan, source string, out io.Writer) error {
+	if len(plan.Merges) > 0 {
+		return errors.New("network has inports with multiple upstreams or recorded inports, which require merging by flowd")
+	}
+	if len(plan.Replays) > 0 {
+		return errors.New("replays of capture files require flowd")
+	}
+	for _, proc := range plan.Processes {
+		if proc.Host != "" {
+			return fmt.Errorf("process %s runs on remote host %s, which requires flowd", proc.Name, proc.Host)
+		}
+	}
+	if len(plan.NetIns) > 0 || len(plan.NetOuts) > 0 {
+		return errors.New("network ports bound to sockets require flowd; bind them to named pipes using -in and -out")
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "# generated by flowd -export-sh from", source)
+	fmt.Fprintln(w, "set -u")
+	fmt.Fprintln(w)
+
+	// named pipes and clean up
+	fifos := make([]string, len(plan.FIFOs))
+	for index, path := range plan.FIFOs {
+		fifos[index] = shellquote.Join(path)
+	}
+	fmt.Fprintln(w, "cleanup() {")
+	if len(fifos) > 0 {
+		fmt.Fprintf(w, "  rm -f %s\n", strings.Join(fifos, " "))
+	} else {
+		// NOTE: function body must not be empty
+		fmt.Fprintln(w, "  :")
+	}
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# handle shutdown: clean up and stop all components")
+	fmt.Fprintln(w, "# NOTE: kill 0 signals the script itself too, which has to survive it to exit with 130")
+	fmt.Fprintln(w, "on_signal() {")
+	fmt.Fprintln(w, "  trap '' INT TERM")
+	fmt.Fprintln(w, "  cleanup")
+	fmt.Fprintln(w, "  kill 0")
+	fmt.Fprintln(w, "  wait")
+	fmt.Fprintln(w, "  exit 130")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "trap on_signal INT TERM")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# run component with output prefixed by process name")
+	fmt.Fprintln(w, "run() {")
+	fmt.Fprintln(w, "  name=$1")
+	fmt.Fprintln(w, "  shift")
+	fmt.Fprintln(w, "  \"$@\" 2>&1 | sed -e \"s/^/$name: /\"")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# create named pipes (FIFOs)")
+	for _, path := range fifos {
+		fmt.Fprintf(w, "[ -p %s ] || mkfifo -m 0770 %s\n", path, path)
+	}
+	fmt.Fprintln(w)
+
+	// components
+	fmt.Fprintln(w, "# start components")
+	for _, proc := range plan.Processes {
+		fmt.Fprintf(w, "echo %s\n", shellquote.Join(fmt.Sprintf("launching %s (component: %s)", proc.Name, proc.Component)))
+		command := append([]string{proc.Component}, proc.Args[1:]...)
+		if len(proc.Env) > 0 {
+			command = append(append([]string{"env"}, proc.Env...), command...)
+		}
+		fmt.Fprintf(w, "run %s %s &\n", shellquote.Join(proc.Name), shellquote.Join(command...))
+	}
+	fmt.Fprintln(w)
+
+	// IIPs
+	fmt.Fprintln(w, "# deliver IIPs")
+	fmt.Fprintln(w, "# NOTE: opening a named pipe blocks until the component has opened it, thus in background")
+	for _, iip := range plan.IIPs {
+		if iip.Path == "" {
+			// delivered as program arguments
+			continue
+		}
+		// NOTE: same frame as flowd sends, see framing format
+		fmt.Fprintf(w, "%s > %s &\n", iipPrintf(iip, shellquoteWord), shellquote.Join(iip.Path))
+	}
+	fmt.Fprintln(w)
+
+	// wait and clean up
+	fmt.Fprintln(w, "# wait for network to exit")
+	fmt.Fprintln(w, "wait")
+	fmt.Fprintln(w, "echo 'INFO: All processes have exited. Exiting.'")
+	fmt.Fprintln(w, "cleanup")
+	return w.Flush()
+}
+
+// shellquoteWord quotes a single word for the shell
+func shellquoteWord(word string) string {
+	return shellquote.Join(word)
+}
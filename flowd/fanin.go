@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/ERnsTL/flowd/libunixfbp"
+)
+
+/*
+Fan-in = multiple upstream outports connected to the same inport of a process.
+
+If all upstream processes would open the same named pipe for writing, their frames could get interleaved
+in the middle of a frame as soon as a write is larger than PIPE_BUF. Therefore, each upstream gets its own
+named pipe and flowd merges the frames coming in from them, frame by frame, into the named pipe of the inport.
+
+Recorded connections (see record.go) are handled the same way, being fan-ins with possibly only one upstream.
+
+NOTE: this requires framed connections; raw data streams cannot be merged in a meaningful way.
+*/
+
+// merge orderings for fan-in inports
+const (
+	mergeArrival    = "arrival"    // forward frames in order of arrival
+	mergeRoundRobin = "roundrobin" // take one frame from each upstream having one ready in turn
+)
+
+const fanInBuffer = 10 // number of frames buffered per upstream
+
+// FanIn holds information about an inport with multiple upstream connections, which are merged by flowd
+type FanIn struct {
+	Proc      string `json:"process"`          // name of the receiving process
+	Port      string `json:"port"`             // name of the receiving inport
+	Path      string `json:"path"`             // path of the named pipe of the receiving inport
+	Upstreams []Port `json:"upstreams"`        // upstream connections; Path is the named pipe for each upstream
+	Order     string `json:"order"`            // one of the merge* constants above
+	Record    string `json:"record,omitempty"` // capture file to append all frames going into the inport to, if recorded
+}
+
+// detectFanIns finds inports with multiple upstream connections or which are recorded, assigns a separate named pipe to each upstream and returns the list of inports to be merged
+// NOTE: records maps PROCESS.PORT to the capture file
+// NOTE: if all is given, all connected inports are passed through flowd, eg. for counting frames
+func detectFanIns(procs Network, defaultOrder string, records map[string]string, all bool) (fanIns []*FanIn, err error) {
+	recordsDone := map[string]bool{}
+	for _, proc := range procs {
+		// group connections by inport
+		upstreams := map[string][]Port{}
+		for _, inport := range proc.InPorts {
+			upstreams[inport.LocalPort] = append(upstreams[inport.LocalPort], inport)
+		}
+		for portName, ports := range upstreams {
+			record, recorded := records[proc.Name+"."+portName]
+			if len(ports) < 2 && !recorded && !all {
+				continue
+			}
+			recordsDone[proc.Name+"."+portName] = true
+			// merge ordering from process metadata or default
+			order := defaultOrder
+			if value, found := proc.Metadata["merge"]; found {
+				order = value
+			}
+			if order != mergeArrival && order != mergeRoundRobin {
+				return nil, fmt.Errorf("process %s: unknown merge order '%s' - expected %s or %s", proc.Name, order, mergeArrival, mergeRoundRobin)
+			}
+			fanIn := &FanIn{
+				Proc:   proc.Name,
+				Port:   portName,
+				Path:   fifoPath(proc.Name, portName),
+				Order:  order,
+				Record: record,
+			}
+			// give each upstream its own named pipe
+			for _, port := range ports {
+				if port.RemoteProc == "NETIN" {
+					// network inport, path is given by the outer network
+					port.Path = unixfbp.InPorts[port.RemotePort].Path
+				} else {
+					port.Path = fanInPath(proc.Name, portName, port.RemoteProc, port.RemotePort)
+					// let the upstream process write into it
+					upstream, exists := procs[port.RemoteProc]
+					if !exists {
+						return nil, fmt.Errorf("process %s: upstream process %s missing for inport %s", proc.Name, port.RemoteProc, portName)
+					}
+					for index, outport := range upstream.OutPorts {
+						if outport.LocalPort == port.RemotePort && outport.RemoteProc == proc.Name && outport.RemotePort == portName {
+							upstream.OutPorts[index].Path = port.Path
+						}
+					}
+				}
+				fanIn.Upstreams = append(fanIn.Upstreams, port)
+			}
+			// remember at receiving process
+			if proc.FanIns == nil {
+				proc.FanIns = map[string]*FanIn{}
+			}
+			proc.FanIns[portName] = fanIn
+			fanIns = append(fanIns, fanIn)
+		}
+	}
+	for name := range records {
+		if !recordsDone[name] {
+			return nil, fmt.Errorf("cannot record %s: no such connected process inport", name)
+		}
+	}
+	return fanIns, nil
+}
+
+// fifoDir is the directory where the named pipes are created, set using -fifodir
+var fifoDir = "/dev/shm"
+
+// fifoPath returns the path of the named pipe for the given process inport
+func fifoPath(procName string, portName string) string {
+	return fmt.Sprintf("%s/%s.%s", fifoDir, procName, portName)
+}
+
+// fanInPath returns the path of the named pipe for one upstream of a merged inport
+func fanInPath(procName string, portName string, fromProc string, fromPort string) string {
+	return fmt.Sprintf("%s/%s.%s.from.%s.%s", fifoDir, procName, portName, fromProc, fromPort)
+}
+
+// startFanIn creates the named pipes for a merged inport and starts merging the upstream frames into it
+// NOTE: opening the named pipes blocks until the other sides have opened them, so this all happens in Goroutines
+func startFanIn(fanIn *FanIn) {
+	// create named pipes
+	// NOTE: the receiving process might not have been started yet, so create its inport too
+	syscall.Mkfifo(fanIn.Path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+	sources := make([]chan *flowd.Frame, len(fanIn.Upstreams))
+	for index, upstream := range fanIn.Upstreams {
+		if upstream.RemoteProc != "NETIN" {
+			syscall.Mkfifo(upstream.Path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+		}
+		sources[index] = make(chan *flowd.Frame, fanInBuffer)
+		// read frames from upstream
+		counter := live.frameCounter(connectionKey(upstream.RemoteProc, upstream.RemotePort, fanIn.Proc, fanIn.Port))
+		if upstream.RemoteProc == "NETIN" {
+			counter = live.frameCounter(netPortKey("NETIN", upstream.RemotePort))
+		}
+		go func(upstream Port, frames chan *flowd.Frame, counter *uint64) {
+			// NOTE: closing the channel marks this upstream as done
+			defer close(frames)
+			inPipe, err := os.OpenFile(upstream.Path, os.O_RDONLY, os.ModeNamedPipe)
+			if err != nil {
+				fmt.Printf("ERROR: opening pipe from %s.%s to %s.%s at path %s for merging: %s\n", upstream.RemoteProc, upstream.RemotePort, fanIn.Proc, fanIn.Port, upstream.Path, err)
+				return
+			}
+			defer inPipe.Close()
+			if err = readFrames(bufio.NewReader(inPipe), frames, counter); err != nil {
+				fmt.Printf("ERROR: reading frames from %s.%s for merging into %s.%s: %s\n", upstream.RemoteProc, upstream.RemotePort, fanIn.Proc, fanIn.Port, err)
+			}
+		}(upstream, sources[index], counter)
+	}
+
+	// merge frames into the inport
+	// NOTE: the frames can be tapped and frames injected using the shell, see shell.go
+	tap := live.portTap(fanIn.Proc, fanIn.Port)
+	go func() {
+		outPipe, err := os.OpenFile(fanIn.Path, os.O_WRONLY, os.ModeNamedPipe)
+		if err != nil {
+			fmt.Printf("ERROR: opening pipe to %s.%s at path %s for merging: %s\n", fanIn.Proc, fanIn.Port, fanIn.Path, err)
+			return
+		}
+		var capture *Capture
+		if fanIn.Record != "" {
+			if capture, err = openCapture(fanIn.Record); err != nil {
+				fmt.Printf("ERROR: opening capture file for recording %s.%s: %s\n", fanIn.Proc, fanIn.Port, err)
+				outPipe.Close()
+				return
+			}
+			defer capture.Close()
+		}
+		if err = mergeFrames(sources, bufio.NewWriter(outPipe), fanIn.Port, fanIn.Order, capture, tap); err != nil {
+			fmt.Printf("ERROR: merging frames into %s.%s: %s\n", fanIn.Proc, fanIn.Port, err)
+		}
+		tap.close()
+		// NOTE: closing gives EOF to the receiving process, once all upstreams are done
+		if err = outPipe.Close(); err != nil {
+			fmt.Printf("ERROR: closing pipe to %s.%s: %s\n", fanIn.Proc, fanIn.Port, err)
+		}
+		if debug {
+			fmt.Printf("DEBUG: all upstreams of %s.%s done\n", fanIn.Proc, fanIn.Port)
+		}
+	}()
+}
+
+// readFrames forwards the frames from an upstream into the given channel until EOF or error
+// NOTE: if counter is given, the frames are counted for the live graph, see graph.go
+func readFrames(stream *bufio.Reader, frames chan<- *flowd.Frame, counter *uint64) error {
+	for {
+		frame, err := flowd.Deserialize(stream)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		countFrame(counter)
+		frames <- frame
+	}
+}
+
+// discardFrames drops the frames an upstream sends after its PortClose, until it is done
+func discardFrames(source <-chan *flowd.Frame, port string) {
+	dropped := 0
+	for range source {
+		dropped++
+	}
+	if dropped > 0 {
+		fmt.Printf("WARNING: dropped %d frames sent into %s after PortClose\n", dropped, port)
+	}
+}
+
+// mergeFrames serializes the frames from all sources into the given writer until all sources are closed
+// NOTE: PortClose notifications from single upstreams are held back; one is forwarded after all upstreams are done
+// NOTE: if capture is given, all forwarded frames are recorded into it
+// NOTE: if tap is given, all forwarded frames are published to it and frames injected into it are forwarded too
+func mergeFrames(sources []chan *flowd.Frame, out *bufio.Writer, port string, order string, capture *Capture, tap *portTap) error {
+	// prepare select over all sources, with and without default case
+	// NOTE: both slices share the same backing array, so disabling a case applies to both
+	cases := make([]reflect.SelectCase, len(sources), len(sources)+2)
+	for index, source := range sources {
+		cases[index] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(source)}
+	}
+	// NOTE: injected frames are taken like from another upstream, which is never done
+	injected := len(cases)
+	if tap != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(tap.inject)})
+	}
+	casesNonBlocking := append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+
+	var chosen int
+	var value reflect.Value
+	var ok bool
+	remaining := len(sources)
+	next := 0 // round-robin position
+	portClose := false
+	for remaining > 0 {
+		chosen = -1
+		if order == mergeRoundRobin {
+			// take from the next upstream in turn which has a frame ready
+			for n := 0; n < len(sources); n++ {
+				index := (next + n) % len(sources)
+				if !cases[index].Chan.IsValid() {
+					continue
+				}
+				select {
+				case frame, open := <-sources[index]:
+					chosen, value, ok = index, reflect.ValueOf(frame), open
+				default:
+					continue
+				}
+				break
+			}
+		}
+		if chosen == -1 {
+			// take from any upstream
+			if chosen, value, ok = reflect.Select(casesNonBlocking); chosen == len(cases) {
+				// nothing ready - send out what is buffered, then wait for the next frame
+				if err := out.Flush(); err != nil {
+					return fmt.Errorf("flushing: %s", err)
+				}
+				chosen, value, ok = reflect.Select(cases)
+			}
+		}
+		if !ok {
+			// upstream is done
+			cases[chosen].Chan = reflect.Value{}
+			remaining--
+			continue
+		}
+		if chosen != injected {
+			next = chosen + 1
+		}
+
+		// forward frame
+		frame := value.Interface().(*flowd.Frame)
+		if frame.Type == "control" && frame.BodyType == "PortClose" && chosen != injected {
+			// upstream is done, even if its named pipe stays open like for a network inport
+			portClose = true
+			cases[chosen].Chan = reflect.Value{}
+			remaining--
+			// NOTE: keep reading from the upstream, otherwise its writer would block once the buffers are full
+			go discardFrames(sources[chosen], port)
+			continue
+		}
+		if err := frame.Serialize(out); err != nil {
+			return fmt.Errorf("serializing frame: %s", err)
+		}
+		if capture != nil {
+			if err := capture.Write(frame); err != nil {
+				return fmt.Errorf("recording frame: %s", err)
+			}
+		}
+		tap.publish(frame)
+	}
+
+	// all upstreams done
+	if portClose {
+		portCloseFrame := flowd.PortClose(port)
+		if err := portCloseFrame.Serialize(out); err != nil {
+			return fmt.Errorf("serializing PortClose: %s", err)
+		}
+		if capture != nil {
+			if err := capture.Write(&portCloseFrame); err != nil {
+				return fmt.Errorf("recording PortClose: %s", err)
+			}
+		}
+		tap.publish(&portCloseFrame)
+	}
+	return out.Flush()
+}
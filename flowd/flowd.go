@@ -4,15 +4,19 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ERnsTL/flowd/libflowd"
 	"github.com/ERnsTL/flowd/libunixfbp"
-	"github.com/kballard/go-shellquote"
 	"github.com/oleksandr/fbp"
 )
 
@@ -36,17 +40,64 @@ func main() {
 		defer pprof.StopCPUProfile()
 	*/
 
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runTests(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		os.Exit(runDaemon(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "shell" {
+		os.Exit(runShell(os.Args[2:]))
+	}
+
 	// read program arguments
-	var help, graph, dependencies, printruntime bool
-	var olc string
+	var help, graph, analyze, diff, formatNw, lint, dependencies, printruntime, plan, exportSh, countFrames, olcConf, olcShell bool
+	var olc, mergeOrder, paramsFile, format, exportSystemd, systemdMode, replayPace, graphFormat, statusSocket string
+	var stallTimeout, networkTimeout, every time.Duration
+	var cronSchedule, historyFile, summaryFile string
+	inEndpoints, outEndpoints, params := keyValueFlag{}, keyValueFlag{}, keyValueFlag{}
+	records, replayFiles := keyValueFlag{}, keyValueFlag{}
 	unixfbp.DefFlags()
 	flag.BoolVar(&help, "h", false, "print usage information")
 	//flag.BoolVar(&debug, "debug", false, "give detailed event output")
 	//flag.BoolVar(&quiet, "quiet", false, "no informational output except errors")
 	flag.StringVar(&olc, "olc", "", "host:port for online configuration using JSON FBP protocol")
-	flag.BoolVar(&graph, "graph", false, "output visualization of given network in GraphViz format and exit")
+	flag.BoolVar(&olcConf, "olc-conf", false, "allow pushing configuration to running processes using the network:conf command or /conf of -olc (unauthenticated)")
+	flag.BoolVar(&olcShell, "olc-shell", false, "allow flowd shell attached using -olc to tap, inject, stop and restart, not only list processes (unauthenticated)")
+	flag.BoolVar(&graph, "graph", false, "output visualization of given network in the format given by -graph-format and exit")
+	flag.StringVar(&graphFormat, "graph-format", graphDOT, "output format for -graph: "+graphDOT+" (GraphViz), "+graphMermaid+", "+graphD2+" or "+graphJSON)
+	flag.StringVar(&statusSocket, "status-socket", "", "Unix socket serving the graph of the running network including live state over HTTP at /graph?format=FORMAT, configuration of processes and the API of flowd shell")
+	flag.BoolVar(&countFrames, "count-frames", false, "pass all connections through flowd to count their frames for the live graph (framed connections only)")
+	flag.BoolVar(&analyze, "analyze", false, "output analysis of given network graph with sources, sinks, layers, feedback loops, longest path and fan-in/fan-out, then exit")
+	flag.BoolVar(&diff, "diff", false, "compare the two given network definitions and output added, removed and changed processes, connections, IIPs and network ports, then exit")
+	flag.BoolVar(&formatNw, "fmt", false, "rewrite the given network definition files in canonical form (from STDIN to STDOUT if none given), then exit")
+	flag.BoolVar(&lint, "lint", false, "check given network definition for style issues and likely mistakes, then exit (exit code 1 if any found)")
 	flag.BoolVar(&dependencies, "deps", false, "output required components for given network and exit")
 	flag.BoolVar(&printruntime, "time", false, "output net runtime of network on shutdown")
+	flag.BoolVar(&plan, "plan", false, "output launch plan of given network with argv, named pipes and IIPs, then exit")
+	flag.BoolVar(&exportSh, "export-sh", false, "output given network as standalone POSIX shell script and exit")
+	flag.StringVar(&exportSystemd, "export-systemd", "", "write systemd units for given network into this directory and exit")
+	flag.StringVar(&systemdMode, "systemd-mode", systemdModeNetwork, "units generated by -export-systemd: "+systemdModeNetwork+" = one unit running flowd, "+systemdModeProcess+" = one unit per process plus a target")
+	flag.StringVar(&format, "format", "text", "output format for -plan, -analyze and -diff: text or json")
+	flag.Var(inEndpoints, "in", "endpoint for network inport or process inport PROCESS.PORT as PORT=endpoint, eg. IN=unix:///run/x.sock, IN=tcp://:7000 or IN=/path/to/fifo (multiple possible)")
+	flag.Var(outEndpoints, "out", "endpoint for network outport as PORT=endpoint, like -in (multiple possible)")
+	flag.Var(params, "set", "value for variable ${NAME} in network definition as NAME=value (multiple possible)")
+	flag.StringVar(&paramsFile, "params", "", "file with NAME=value lines for variables in network definition")
+	flag.Var(records, "record", "append all frames going into a process inport to a capture file as PROCESS.PORT=file (multiple possible)")
+	flag.Var(replayFiles, "replay", "feed the frames of a capture file into a process inport as PROCESS.PORT=file (multiple possible)")
+	flag.StringVar(&replayPace, "replay-pace", paceOriginal, "pacing of replayed frames: "+paceOriginal+" = time between frames as recorded, "+paceFast+" = as fast as possible")
+	flag.StringVar(&notation, "notation", "", "notation of the network definition: "+notationNoFlo+" (.fbp as used by NoFlo), "+notationJPM+" (free-form as used by JavaFBP) or "+notationYAML+", default by file extension "+jpmExtension+", .yaml or .yml")
+	flag.StringVar(&fifoDir, "fifodir", fifoDir, "directory for the named pipes between processes")
+	flag.DurationVar(&networkTimeout, "timeout", 0, "shut down the network if it runs longer than this and exit with code 124 (0 = no limit)")
+	flag.DurationVar(&every, "every", 0, "run the network repeatedly at this interval, each run with fresh named pipes")
+	flag.StringVar(&cronSchedule, "cron", "", "run the network repeatedly at the times given by this cron expression, eg. '0 3 * * *'")
+	flag.StringVar(&historyFile, "history", "", "with -every or -cron, record start, end and result of each run into this JSON file")
+	flag.StringVar(&summaryFile, "summary", "", "write exit summary with the number of processes exited unsuccessfully into this JSON file on shutdown")
+	flag.DurationVar(&stallTimeout, "stall", 0, "report processes blocked in opening named pipes, full connections without read progress and deadlocks after this time, eg. 30s (Linux only)")
+	flag.Var(sshHosts, "host", "ssh destination for processes with metadata host=NAME as NAME=destination, eg. db1=user@db1.example.com (multiple possible, default: NAME itself)")
+	flag.StringVar(&remoteDir, "remote-dir", "", "working directory of processes on remote hosts (default: current directory)")
+	flag.StringVar(&mergeOrder, "merge", mergeArrival, "default frame ordering for inports with multiple upstreams: "+mergeArrival+" or "+mergeRoundRobin)
 	flag.Parse()
 	if help {
 		printUsage()
@@ -60,14 +111,97 @@ func main() {
 		os.Exit(1)
 	}
 
+	// format network definitions
+	if formatNw {
+		if flag.NArg() == 0 {
+			if networkNotation("") != notationNoFlo {
+				fmt.Println("ERROR: flag -fmt currently unimplemented for notation", notation, "- only for .fbp format")
+				os.Exit(1)
+			}
+			os.Stdout.Write(formatNetwork(getNetworkDefinition()))
+			return
+		}
+		for _, path := range flag.Args() {
+			if strings.HasSuffix(path, ".drw") {
+				fmt.Println("ERROR: flag -fmt currently unimplemented for .drw network definitions, only for .fbp format")
+				os.Exit(1)
+			}
+			if networkNotation(path) != notationNoFlo {
+				fmt.Printf("ERROR: flag -fmt currently unimplemented for %s, only for .fbp format\n", path)
+				os.Exit(1)
+			}
+			changed, err := formatNetworkFile(path)
+			if err != nil {
+				fmt.Printf("ERROR: formatting network definition %s: %s\n", path, err)
+				os.Exit(1)
+			}
+			if changed {
+				fmt.Println(path)
+			}
+		}
+		return
+	}
+
+	// compare network definitions
+	if diff {
+		if flag.NArg() != 2 {
+			fmt.Println("ERROR: -diff requires two network definition files")
+			os.Exit(1)
+		}
+		fileParams := map[string]string{}
+		if paramsFile != "" {
+			var err error
+			if fileParams, err = loadParamsFile(paramsFile); err != nil {
+				fmt.Println("ERROR: reading parameters file:", err)
+				os.Exit(1)
+			}
+		}
+		networks := make([]*fbp.Fbp, 2)
+		for index, path := range flag.Args() {
+			if strings.HasSuffix(path, ".drw") {
+				fmt.Println("ERROR: flag -diff currently unimplemented for .drw network definitions, only for .fbp format")
+				os.Exit(1)
+			}
+			var err error
+			if networks[index], err = loadNetworkFile(path, []map[string]string{params, fileParams}); err != nil {
+				fmt.Printf("ERROR: loading network definition %s: %s\n", path, err)
+				os.Exit(1)
+			}
+		}
+		if err := printDiff(diffNetworks(networks[0], networks[1]), format); err != nil {
+			fmt.Println("ERROR: comparing networks:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// scheduled runs
+	if every > 0 || cronSchedule != "" {
+		if flag.NArg() != 1 {
+			fmt.Println("ERROR: scheduled runs require the network definition as file")
+			os.Exit(1)
+		}
+		os.Exit(runScheduled(flag.CommandLine, os.Args[1:], every, cronSchedule, historyFile))
+	}
+
 	//TODO integrate .drw network definitions into the .fbp structure
 	//TODO enable -graph and -deps for them and also piping the network definition in for .drw networks
 	var procs Network
+	var netins, netouts []*NetEndpoint
+	var replays []*Replay
 	var nw *fbp.Fbp // TODO improve flowd.Network structure -> is currently missing network inports and outports -> startInstance() needs nw passed to know about these
 	if flag.NArg() == 1 && strings.HasSuffix(flag.Arg(0), ".drw") {
 		// checks
-		if graph || dependencies {
-			fmt.Println("ERROR: flags -deps and -graph currently unimplemented for .drw network definitions, only for .fbp format")
+		if graph || analyze || lint || dependencies {
+			fmt.Println("ERROR: flags -deps, -graph, -analyze and -lint currently unimplemented for .drw network definitions, only for .fbp format")
+			os.Exit(1)
+		}
+		if len(params) > 0 || paramsFile != "" {
+			fmt.Println("ERROR: flags -set and -params currently unimplemented for .drw network definitions, only for .fbp format")
+			os.Exit(1)
+		}
+		if len(replayFiles) > 0 {
+			fmt.Println("ERROR: flag -replay currently unimplemented for .drw network definitions, only for .fbp format")
 			os.Exit(1)
 		}
 		// load from file
@@ -84,15 +218,56 @@ func main() {
 		//TODO directly initializing Inports gives error "unknown field in struct literal -> some inner structure"
 		nw.Inports = map[string]*fbp.Endpoint{}
 		nw.Outports = map[string]*fbp.Endpoint{}
+		if err = replicateProcesses(procs, nw); err != nil {
+			fmt.Println("ERROR: replicating processes:", err)
+			os.Exit(1)
+		}
 	} else {
 
 		// get network definition
 		nwBytes := getNetworkDefinition()
 
+		// substitute variables
+		fileParams := map[string]string{}
+		if paramsFile != "" {
+			var err error
+			if fileParams, err = loadParamsFile(paramsFile); err != nil {
+				fmt.Println("ERROR: reading parameters file:", err)
+				os.Exit(1)
+			}
+		}
+		nwBytes, err := substituteParams(nwBytes, params, fileParams)
+		if err != nil {
+			fmt.Println("ERROR: substituting variables in network definition:", err)
+			os.Exit(1)
+		}
+
 		// parse and validate network
-		nw = parseNetworkDefinition(nwBytes)
-		if olc != "" && (len(nw.Inports) > 0 || len(nw.Outports) > 0) {
-			fmt.Println("ERROR: NETIN and NETOUT require -olc, otherwise use TCP/UDP/SSH/UNIX/etc. components")
+		nw = parseNetwork(nwBytes, flag.Arg(0))
+
+		// check for style issues and likely mistakes
+		if lint {
+			findings := lintNetwork(nw)
+			source := "STDIN"
+			if flag.NArg() == 1 {
+				source = flag.Arg(0)
+			}
+			for _, finding := range findings {
+				fmt.Printf("%s: %s\n", source, finding)
+			}
+			if len(findings) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
+		// inline included network definitions
+		baseDir, including := ".", []string{}
+		if flag.NArg() == 1 {
+			baseDir, including = filepath.Dir(flag.Arg(0)), []string{filepath.Clean(flag.Arg(0))}
+		}
+		if err = inlineIncludes(nw, baseDir, []map[string]string{params, fileParams}, including); err != nil {
+			fmt.Println("ERROR: including network definitions:", err)
 			os.Exit(1)
 		}
 
@@ -101,14 +276,10 @@ func main() {
 			displayNetworkDefinition(nw)
 		}
 
-		// network definition sanity checks
-		//TODO check for multiple connections to same component's port
-		//TODO decide if this should be allowed - no not usually, because then frames might be interleaved - bad if ordering is important
-
 		// output graph visualization
 		// NOTE: originally intended to output the parsed graph (fbp.Fbp type), but that does not have Inports and Outports process names nicely available and IIP special cases
 		if graph {
-			if err := exportNetworkGraph(nw); err != nil {
+			if err := exportNetworkGraph(nw, graphFormat); err != nil {
 				fmt.Println("ERROR: generating graph visualization: ", err)
 				os.Exit(1)
 			} else {
@@ -116,6 +287,15 @@ func main() {
 			}
 		}
 
+		// output analysis of the network graph
+		if analyze {
+			if err := printAnalysis(analyzeNetwork(nw), format); err != nil {
+				fmt.Println("ERROR: analyzing network:", err)
+				os.Exit(1)
+			}
+			return
+		}
+
 		// output required components for this network
 		if dependencies {
 			dependencies := map[string]bool{} // use map to ignore duplicates (uniq)
@@ -135,8 +315,69 @@ func main() {
 			return
 		}
 
+		// bind inports and outports of processes given as PROCESS.PORT using -in and -out, like network ports
+		if err = exportProcessPorts(nw, inEndpoints, outEndpoints); err != nil {
+			fmt.Println("ERROR: binding process ports:", err)
+			os.Exit(1)
+		}
+
+		// feed capture files into process inports
+		if replays, err = bindReplays(nw, replayFiles, replayPace); err != nil {
+			fmt.Println("ERROR: binding replays:", err)
+			os.Exit(1)
+		}
+
 		// generate network data structures
 		procs = networkDefinition2Processes(nw)
+		if err = replicateProcesses(procs, nw); err != nil {
+			fmt.Println("ERROR: replicating processes:", err)
+			os.Exit(1)
+		}
+
+		// bind network inports and outports to their endpoints
+		if netins, netouts, err = bindNetPorts(nw, inEndpoints, outEndpoints); err != nil {
+			fmt.Println("ERROR: binding network ports:", err)
+			os.Exit(1)
+		}
+	}
+
+	// network definition sanity checks
+	// NOTE: multiple connections to the same inport are merged frame-wise by flowd, otherwise frames could be interleaved
+	// NOTE: recorded connections are passed through flowd the same way
+	fanIns, err := detectFanIns(procs, mergeOrder, records, countFrames)
+	if err != nil {
+		fmt.Println("ERROR: checking inports with multiple upstreams:", err)
+		os.Exit(1)
+	}
+	after, err := startupOrder(procs)
+	if err != nil {
+		fmt.Println("ERROR: checking startup order:", err)
+		os.Exit(1)
+	}
+
+	// output launch plan, shell script or systemd units
+	if plan || exportSh || exportSystemd != "" {
+		networkPlan, err := planNetwork(procs, nw, fanIns, netins, netouts, replays)
+		if err == nil && plan {
+			err = printPlan(networkPlan, format)
+		} else if err == nil && exportSystemd != "" {
+			var written []string
+			written, err = exportSystemdUnits(networkPlan, procs, flag.Arg(0), systemdFlowdArgs(flag.CommandLine, os.Args[1:]), systemdMode, exportSystemd)
+			for _, path := range written {
+				fmt.Println("wrote", path)
+			}
+		} else if err == nil {
+			source := "STDIN"
+			if flag.NArg() == 1 {
+				source = flag.Arg(0)
+			}
+			err = exportShellScript(networkPlan, source, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("ERROR: generating launch plan:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// subscribe to ctrl+c to do graceful shutdown
@@ -144,32 +385,95 @@ func main() {
 
 	// launch network
 	exitChan := make(chan string)
+	networkPlan, err := planNetwork(procs, nw, fanIns, netins, netouts, replays)
+	if err != nil {
+		fmt.Println("ERROR: preparing launch:", err)
+		os.Exit(1)
+	}
+	// serve live state
+	live = newLiveState(nw, procs)
+	if statusSocket != "" {
+		if err = serveStatusSocket(statusSocket); err != nil {
+			fmt.Println("ERROR: listening on status socket:", err)
+			os.Exit(1)
+		}
+		defer os.Remove(statusSocket)
+	}
+	// launch stall detection
+	if stallTimeout > 0 {
+		stalls = newStallMonitor(networkPlan, stallTimeout)
+		go stalls.run()
+	}
+	// launch bridges for connections crossing hosts
+	for _, bridge := range networkPlan.Bridges {
+		if !quiet {
+			fmt.Printf("bridging %s -> %s\n", bridgeEnd(bridge.Writer, bridge.FromHost), bridgeEnd(bridge.Reader, bridge.ToHost))
+		}
+		startBridge(bridge)
+	}
 	// launch handler(s) for INPORT, if required
-	// NOTE: not necessary, because this will be picked up in startInstance()
-
+	// NOTE: named pipes given by an outer flowd or using -in will be picked up in startInstance()
+	var netListeners []net.Listener
+	for _, netin := range netins {
+		netListeners = append(netListeners, handleNetIn(netin))
+	}
 	// launch handler(s) for NETOUT, if required
-	/*
-		if len(nw.Outports) > 0 {
-			//fmt.Println("WARNING: NETOUT currently unimplemented")
-			netout := newComponentInstance()
-			go handleNetOut(netout)
-			instances["NETOUT"] = netout
+	for _, netout := range netouts {
+		netListeners = append(netListeners, handleNetOut(netout))
+	}
+	// launch mergers for inports with multiple upstreams
+	for _, fanIn := range fanIns {
+		if !quiet && fanIn.Record != "" {
+			fmt.Printf("recording %s.%s into %s\n", fanIn.Proc, fanIn.Port, fanIn.Record)
 		}
-	*/
-	// launch processes
-	for _, proc := range procs {
+		if !quiet && len(fanIn.Upstreams) > 1 {
+			fmt.Printf("merging %d upstreams into %s.%s (order: %s)\n", len(fanIn.Upstreams), fanIn.Proc, fanIn.Port, fanIn.Order)
+		}
+		startFanIn(fanIn)
+	}
+	// launch replays of capture files
+	for _, replay := range replays {
 		if !quiet {
-			fmt.Printf("launching %s (component: %s)\n", proc.Name, proc.Path)
+			fmt.Printf("replaying %s into %s.%s (pace: %s)\n", replay.File, replay.Proc, replay.Port, replay.Pace)
+		}
+		startReplay(replay)
+	}
+	// launch processes
+	// NOTE: in name order, each after the processes it has to wait for are ready
+	startup = newStartupState(procs)
+	names := make([]string, 0, len(procs))
+	for name := range procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		proc := procs[name]
+		where := ""
+		if host := proc.Metadata[hostMetadata]; host != "" {
+			where = " on host " + host
+		}
+		if !quiet && len(after[name]) > 0 {
+			fmt.Printf("launching %s%s once %s ready (component: %s)\n", proc.Name, where, strings.Join(after[name], ", "), proc.Path)
+		} else if !quiet {
+			fmt.Printf("launching %s%s (component: %s)\n", proc.Name, where, proc.Path)
 		}
 
 		// start component as subprocess, with arguments
 		procs[proc.Name].Instance = newComponentInstance() //TODO optimize function call away
-		go startInstance(proc, procs, nw, exitChan)        //TODO maybe make procs, nw and exitChan global
+		go func(proc *Process, after []string) {
+			if !startup.waitFor(after) {
+				// network is shutting down
+				startup.markReady(proc.Name)
+				exitChan <- proc.Name
+				return
+			}
+			startInstance(proc, procs, nw, exitChan) //TODO maybe make procs, nw and exitChan global
+		}(proc, after[name])
 	}
 
 	// start up online configuration
 	if olc != "" {
-		startOLC(olc)
+		startOLC(olc, olcConf, olcShell)
 	}
 
 	// run while there are still components running
@@ -180,26 +484,58 @@ func main() {
 		begin = time.Now()
 	}
 	instanceCount := len(procs)
+	summary := RunSummary{Processes: len(procs)}
+	var timeoutChan, killChan <-chan time.Time
+	if networkTimeout > 0 {
+		timeoutChan = time.After(networkTimeout)
+	}
 	for instanceCount > 0 {
 		//TODO check for signal here
-		procName := <-exitChan
+		var procName string
+		select {
+		case procName = <-exitChan:
+		case <-timeoutChan:
+			fmt.Printf("ERROR: network exceeded timeout of %s - shutting down.\n", networkTimeout)
+			startup.cancel()
+			signalInstances(procs, syscall.SIGTERM)
+			closeNetPorts(netListeners)
+			killChan = time.After(shutdownGrace)
+			continue
+		case <-killChan:
+			// NOTE: IIP deliveries to killed processes would block forever, so do not wait for them
+			fmt.Println("ERROR: processes still running after shutdown grace period - killing them and exiting.")
+			signalInstances(procs, syscall.SIGKILL)
+			closeNetPorts(netListeners)
+			writeRunSummary(summaryFile, summary)
+			os.Exit(exitTimeout)
+		}
 		//TODO detect if component exited intentionally (all data processed) or if it failed -> INFO, WARNING or ERROR and different behavior
 		if debug {
 			fmt.Println("DEBUG: Removing process instance for", procName)
 		}
 		// remove instance information from the process
-		//instancesLock.Lock()
-		//delete(instances, procName)
-		//instancesLock.Unlock()
+		instancesLock.Lock()
+		if failedInstance(procs[procName]) {
+			summary.FailedProcesses++
+		}
 		procs[procName].Instance = nil
+		instancesLock.Unlock()
 		instanceCount--
 	}
+	closeNetPorts(netListeners)
+	if summary.FailedProcesses > 0 {
+		fmt.Printf("WARNING: %d of %d processes exited unsuccessfully.\n", summary.FailedProcesses, summary.Processes)
+	}
+	writeRunSummary(summaryFile, summary)
 	if !quiet {
 		fmt.Println("INFO: All processes have exited. Exiting.")
 	}
 	if printruntime {
 		fmt.Println(time.Since(begin).String())
 	}
+	if killChan != nil {
+		os.Exit(exitTimeout)
+	}
 
 	// detect voluntary network shutdown
 	//TODO how to decide that it should happen? should 1 component be able to trigger network shutdown?
@@ -210,8 +546,34 @@ func main() {
 func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan string) {
 	//TODO implement exit channel behavior to goroutine ("we are going down for shutdown!")
 
-	// start component as subprocess, with arguments
-	cmd := exec.Command(proc.Path)
+	// set arguments
+	plan, err := planInstance(proc, nw)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		live.setProcessState(proc.Name, processFailed)
+		startup.markReady(proc.Name)
+		exitChan <- proc.Name
+		return
+	}
+	// start component as subprocess, with arguments - or on its remote host using ssh
+	var cmd *exec.Cmd
+	var sshStdin io.WriteCloser
+	if plan.Host != "" {
+		if cmd, err = remoteCommand(plan); err != nil {
+			fmt.Printf("ERROR: preparing launch of %s on host %s: %v\n", proc.Name, plan.Host, err)
+			live.setProcessState(proc.Name, processFailed)
+			startup.markReady(proc.Name)
+			exitChan <- proc.Name
+			return
+		}
+		// NOTE: the remote component is killed once this gets closed, see remoteScript()
+		if sshStdin, err = cmd.StdinPipe(); err != nil {
+			fmt.Println("ERROR: could not allocate pipe to ssh stdin:", err)
+		}
+	} else {
+		cmd = exec.Command(proc.Path)
+		cmd.Args = plan.Args
+	}
 	// connect to STDOUT
 	cout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -236,85 +598,14 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 		fmt.Println("ERROR: could not allocate pipe to component stderr:", err)
 		exitChan <- proc.Name
 	}
-	// set arguments
-	//TODO optimize appends and allocations
-	cmd.Args = []string{proc.Name}
-	// add ports for IIPs
-	//TODO optimize: proc.IIPs is traversed more than once
-	for _, iip := range proc.IIPs {
-		if iip.Port != "ARGS" {
-			// regular IIP - make port for that and create named pipe and deliver IIP
-			proc.InPorts = append(proc.InPorts, Port{
-				LocalPort: iip.Port,
-				// leave RemotePort and RemotePort unset
-			})
-		}
-	}
-	/// add arguments for libunixfbp
-	var path string
-	for _, inport := range proc.InPorts {
-		path = ""
-		// check if this port is target of a network INPORT
-		if len(nw.Inports) > 0 {
-			for inPortName, inPort := range nw.Inports {
-				if inPort.Process == proc.Name && inPort.Port == inport.LocalPort {
-					// this component is target of a network INPORT
-					///TODO see what makes more sense -- the unixfbp parameters would be consistent and are given automatically by flowd (could make exception for subnets), but nwName and using that as prefix is simpler and less parsing
-					//path = fmt.Sprintf("/dev/shm/%s.%s", nwName, inPortName)
-					path = unixfbp.InPorts[inPortName].Path
-					if debug {
-						fmt.Println("yes, INPORT-connected: INPORT", inPortName, "goes into component", proc.Name, "port", inport.LocalPort)
-					}
-					break
-				}
-			}
-		}
-		if path == "" {
-			// make that named pipe (FIFO)
-			path = fmt.Sprintf("/dev/shm/%s.%s", proc.Name, inport.LocalPort)
-			//os.Remove(path)
-			syscall.Mkfifo(path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
-		}
-		// append to arguments
-		cmd.Args = append(cmd.Args, "-inport", inport.LocalPort, "-inpath", path) //TODO optimize string concatenation
-	}
-	for _, outport := range proc.OutPorts {
-		path = ""
-		// check if this port is source of a network OUTPORT
-		if len(nw.Outports) > 0 {
-			for outPortName, outPort := range nw.Outports {
-				if outPort.Process == proc.Name && outPort.Port == outport.LocalPort {
-					// this component is source of a network OUTPORT
-					//path = fmt.Sprintf("/dev/shm/%s.%s", nwName, outPortName)
-					path = unixfbp.OutPorts[outPortName].Path
-					if debug {
-						fmt.Println("yes, OUTPORT-connected: component", proc.Name, "port", outport.LocalPort, "goes into OUTPORT", outPortName)
-					}
-					break
-				}
-			}
-		}
-		if path == "" {
-			// make that named pipe (FIFO)
-			path = fmt.Sprintf("/dev/shm/%s.%s", outport.RemoteProc, outport.RemotePort)
-			// NOTE: create it only once - otherwise both ends would create their own version, creating weird timing-based hangs
-			/*
-				os.Remove(path)
-				syscall.Mkfifo(path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
-			*/
-		}
-		// append to arguments
-		cmd.Args = append(cmd.Args, "-outport="+outport.LocalPort, "-outpath="+path) //TODO optimize string concatenation
-	}
-	// send IIPs: ARGS go into component argv, others need named pipes
-	if len(proc.IIPs) > 0 && proc.IIPs[0].Port == "ARGS" {
-		// add free arguments
-		args, err := shellquote.Split(proc.IIPs[0].Data)
-		if err != nil {
-			fmt.Printf("ERROR: could not split arguments in IIP to ARGS for component %s: %s\n", proc.Name, err)
-			exitChan <- proc.Name
+	// create named pipes
+	// NOTE: for remote processes, they are created on the remote host
+	for _, path := range plan.FIFOs {
+		if plan.Host != "" {
+			break
 		}
-		cmd.Args = append(cmd.Args, args...)
+		//os.Remove(path)
+		syscall.Mkfifo(path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
 	}
 	if debug {
 		fmt.Printf("argv for %s: %v\n", proc.Name, cmd.Args)
@@ -325,11 +616,46 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 		https://golang.org/pkg/os/exec/#Cmd
 		is this available in all programming languages? advantages?
 	*/
+	readyReader, readyWriter, err := readinessPipe(proc)
+	if readyWriter != nil && plan.Host != "" {
+		fmt.Printf("WARNING: %s=%s is not supported for process %s on remote host %s - ready once started\n", readyMetadata, readySignal, proc.Name, plan.Host)
+		readyReader.Close()
+		readyWriter.Close()
+		readyReader, readyWriter = nil, nil
+	}
+	if err != nil {
+		fmt.Printf("ERROR: could not allocate readiness pipe for %s: %v\n", proc.Name, err)
+		live.setProcessState(proc.Name, processFailed)
+		startup.markReady(proc.Name)
+		exitChan <- proc.Name
+		return
+	}
+	if readyWriter != nil {
+		cmd.ExtraFiles = []*os.File{readyWriter}
+	}
+	cmd.Env = componentEnv(plan.Env, readyWriter != nil)
 	// start subprocess
 	if err = cmd.Start(); err != nil {
 		fmt.Printf("ERROR: could not start %s: %v\n", proc.Name, err)
+		live.setProcessState(proc.Name, processFailed)
+		startup.markReady(proc.Name)
 		exitChan <- proc.Name
+		return
 	}
+	live.setProcessState(proc.Name, processRunning)
+	if readyWriter != nil {
+		// NOTE: only the component keeps the write end open, so that its exit gives EOF
+		readyWriter.Close()
+		go awaitReadySignal(proc.Name, readyReader)
+	} else if proc.Metadata[readyMetadata] != readyExit {
+		startup.markReady(proc.Name)
+	}
+	if stalls != nil && plan.Host == "" {
+		stalls.processStarted(proc.Name, cmd.Process.Pid)
+	}
+	instancesLock.Lock()
+	proc.Instance.Cmd = cmd
+	instancesLock.Unlock()
 
 	// display component STDOUT
 	go func() {
@@ -356,14 +682,13 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 	// deliver initial information packets/frames
 	// NOTE: opening a named pipe will block until the other side has opened it
 	// -> deliver the IIPs after the process has been started or before in Goroutines
-	for _, iip := range proc.IIPs {
-		if iip.Port != "ARGS" { //TODO optimize so that IIPs list does not have to traversed multiple times
-			// get port path
-			path := fmt.Sprintf("/dev/shm/%s.%s", proc.Name, iip.Port)
+	// NOTE: for remote processes, the IIPs are delivered on the remote host
+	for _, iip := range plan.IIPs {
+		if iip.Path != "" && plan.Host == "" {
 			// open named pipe = FIFO
-			outPipe, err := os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe)
+			outPipe, err := os.OpenFile(iip.Path, os.O_WRONLY, os.ModeNamedPipe)
 			if err != nil {
-				fmt.Printf("ERROR: opening pipe to %s.%s at path %s for IIP delivery: %s - exiting.\n", proc.Name, iip.Port, path, err)
+				fmt.Printf("ERROR: opening pipe to %s.%s at path %s for IIP delivery: %s - exiting.\n", proc.Name, iip.Port, iip.Path, err)
 				os.Exit(2)
 			}
 			// create buffered writer
@@ -371,9 +696,12 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 			// prepare frame
 			iipFrame := &flowd.Frame{
 				Type:     "data",
-				BodyType: "IIP",
+				BodyType: iipBodyType(iip.BodyType),
 				Body:     []byte(iip.Data),
 			}
+			if iip.ContentType != "" {
+				iipFrame.Extensions = map[string]string{"content-type": iip.ContentType}
+			}
 			// send it to the component
 			if err = iipFrame.Serialize(outWriter); err != nil {
 				fmt.Printf("ERROR: serializing IIP for %s.%s: %s - exiting.\n", proc.Name, iip.Port, err)
@@ -395,21 +723,39 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 			}
 		}
 	}
-	// GC IIP information
-	proc.IIPs = nil
+	// NOTE: IIP information is kept for restarts using the shell and for planning ports, see shell.go and conf.go
 
 	// wait for process to finish
 	//err = cmd.Wait()
 	// NOTE: cmd.Wait() would close the Stdout pipe (too early?), dropping unread frames
 	//TODO optimize - is this still necessary? move channel receives from STDOUT and STDERR before cmd.Wait()
 	state, err := cmd.Process.Wait()
+	instancesLock.Lock()
 	cmd.ProcessState = state
+	instancesLock.Unlock()
+	if sshStdin != nil {
+		sshStdin.Close()
+	}
+	if stalls != nil {
+		stalls.processExited(proc.Name)
+	}
+	// NOTE: processes waiting for this one can start now anyway
+	if startup.markReady(proc.Name) && readyReader != nil {
+		fmt.Printf("WARNING: process %s exited without signaling readiness\n", proc.Name)
+	}
 	if err != nil {
 		fmt.Printf("ERROR waiting for exit of component %s: %v\n", proc.Name, err)
 	}
 	// check exit status
 	// TODO in Go 1.12 there is now ProcessState.ExitCode() -- useful?
-	if !cmd.ProcessState.Success() {
+	if cmd.ProcessState.Success() {
+		live.setProcessState(proc.Name, processExited)
+	} else {
+		live.setProcessState(proc.Name, processFailed)
+	}
+	if !cmd.ProcessState.Success() && plan.Host != "" && cmd.ProcessState.ExitCode() == sshFailed {
+		fmt.Printf("ERROR: Process %s could not be run on host %s (ssh failed).\n", proc.Name, plan.Host)
+	} else if !cmd.ProcessState.Success() {
 		//TODO warning or error?
 		fmt.Println("ERROR: Processs", proc.Name, "exited unsuccessfully.")
 		//TODO how to react properly? shut down network?
@@ -419,13 +765,22 @@ func startInstance(proc *Process, procs Network, nw *fbp.Fbp, exitChan chan stri
 	// wait that all output from the sub-process has been read
 	<-proc.Instance.AllOutputtedSTDOUT
 	<-proc.Instance.AllOutputtedSTDERR
+	// start again if requested using the shell
+	if restartPending(proc) {
+		go startInstance(proc, procs, nw, exitChan)
+		return
+	}
 	// notify main thread
 	exitChan <- proc.Name
 }
 
 func printUsage() {
-	//TODOfmt.Println("Usage:", os.Args[0], "-in [inport-endpoint(s)]", "-out [outport-endpoint(s)]", "[network-def-file]")
-	fmt.Println("Usage:", os.Args[0], "[network-def-file]")
+	fmt.Println("Usage:", os.Args[0], "-in [inport-endpoint(s)]", "-out [outport-endpoint(s)]", "[network-def-file]")
+	fmt.Println("      ", os.Args[0], "-diff [-format text|json] [old-network-def-file] [new-network-def-file]")
+	fmt.Println("      ", os.Args[0], "-fmt [network-def-file(s)]")
+	fmt.Println("      ", os.Args[0], "test [-format tap|junit] [-timeout duration] [test-spec-file(s)|dir(s)]")
+	fmt.Println("      ", os.Args[0], "daemon [-dir state-dir] [-socket path]")
+	fmt.Println("      ", os.Args[0], "shell [-socket path | -dir state-dir network]")
 	flag.PrintDefaults()
 	os.Exit(1)
 }
@@ -435,6 +790,9 @@ func printUsage() {
 //TODO use ^ for procs map (type Network)
 //type ComponentInstances map[string]*ComponentInstance
 
+// instancesLock protects the Instance of each process and its Cmd
+var instancesLock sync.Mutex
+
 // ComponentInstance contains state about a running network process
 type ComponentInstance struct {
 	//TODO only keep sendable chans here, return receiving channels from newComponentInstance()
@@ -447,6 +805,17 @@ func newComponentInstance() *ComponentInstance {
 	return &ComponentInstance{AllOutputtedSTDOUT: make(chan struct{}), AllOutputtedSTDERR: make(chan struct{})}
 }
 
+// signalInstances sends the signal to all running processes
+func signalInstances(procs Network, sig syscall.Signal) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	for _, proc := range procs {
+		if proc.Instance != nil && proc.Instance.Cmd != nil && proc.Instance.Cmd.Process != nil && proc.Instance.Cmd.ProcessState == nil {
+			proc.Instance.Cmd.Process.Signal(sig)
+		}
+	}
+}
+
 /*TODO
 func handleSignals() {
 	signalChannel := make(chan os.Signal, 1) // subscribe to notification on signal
@@ -1,7 +1,1124 @@
 package main
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/oleksandr/fbp"
+	"github.com/stretchr/testify/assert"
+)
 
 func TestItWorks(t *testing.T) {
 	return
 }
+
+// frameSource returns a closed channel containing the given frames, like an upstream after EOF
+func frameSource(frames ...*flowd.Frame) chan *flowd.Frame {
+	source := make(chan *flowd.Frame, len(frames))
+	for _, frame := range frames {
+		source <- frame
+	}
+	close(source)
+	return source
+}
+
+func dataFrame(body string) *flowd.Frame {
+	return &flowd.Frame{Type: "data", BodyType: "Test", Body: []byte(body)}
+}
+
+func mergedBodies(t *testing.T, merged *bytes.Buffer) (bodies []string, last *flowd.Frame) {
+	reader := bufio.NewReader(merged)
+	for merged.Len() > 0 || reader.Buffered() > 0 {
+		frame, err := flowd.Deserialize(reader)
+		assert.NoError(t, err, "cannot read merged frame")
+		if frame.Type == "data" {
+			bodies = append(bodies, string(frame.Body))
+		}
+		last = frame
+	}
+	return
+}
+
+func TestMergeFramesRoundRobin(t *testing.T) {
+	var merged bytes.Buffer
+	out := bufio.NewWriter(&merged)
+	sources := []chan *flowd.Frame{
+		frameSource(dataFrame("a1"), dataFrame("a2"), dataFrame("a3")),
+		frameSource(dataFrame("b1")),
+		frameSource(dataFrame("c1"), dataFrame("c2")),
+	}
+	err := mergeFrames(sources, out, "IN", mergeRoundRobin, nil, nil)
+	assert.NoError(t, err, "merging returned error")
+	bodies, _ := mergedBodies(t, &merged)
+	assert.Equal(t, []string{"a1", "b1", "c1", "a2", "c2", "a3"}, bodies, "frames not merged in turn")
+}
+
+func TestMergeFramesArrivalKeepsUpstreamOrder(t *testing.T) {
+	var merged bytes.Buffer
+	out := bufio.NewWriter(&merged)
+	sources := []chan *flowd.Frame{
+		frameSource(dataFrame("a1"), dataFrame("a2")),
+		frameSource(dataFrame("b1"), dataFrame("b2")),
+	}
+	err := mergeFrames(sources, out, "IN", mergeArrival, nil, nil)
+	assert.NoError(t, err, "merging returned error")
+	bodies, _ := mergedBodies(t, &merged)
+	assert.Len(t, bodies, 4, "frames lost while merging")
+	// frames of one upstream must stay in order
+	var fromA, fromB []string
+	for _, body := range bodies {
+		if body[0] == 'a' {
+			fromA = append(fromA, body)
+		} else {
+			fromB = append(fromB, body)
+		}
+	}
+	assert.Equal(t, []string{"a1", "a2"}, fromA, "upstream order not kept")
+	assert.Equal(t, []string{"b1", "b2"}, fromB, "upstream order not kept")
+}
+
+func TestMergeFramesSinglePortCloseAfterAllUpstreams(t *testing.T) {
+	var merged bytes.Buffer
+	out := bufio.NewWriter(&merged)
+	portClose := flowd.PortClose("OUT")
+	sources := []chan *flowd.Frame{
+		frameSource(dataFrame("a1"), &portClose),
+		frameSource(dataFrame("b1"), &portClose),
+	}
+	err := mergeFrames(sources, out, "IN", mergeRoundRobin, nil, nil)
+	assert.NoError(t, err, "merging returned error")
+	assert.Equal(t, 1, bytes.Count(merged.Bytes(), []byte("PortClose")), "not exactly one PortClose forwarded")
+	bodies, last := mergedBodies(t, &merged)
+	assert.Equal(t, []string{"a1", "b1"}, bodies, "data frames not forwarded")
+	assert.Equal(t, "PortClose", last.BodyType, "PortClose not forwarded last")
+	assert.Equal(t, "IN", last.Port, "PortClose not addressed to merged inport")
+}
+
+func TestMergeFramesUpstreamDoneOnPortClose(t *testing.T) {
+	var merged bytes.Buffer
+	out := bufio.NewWriter(&merged)
+	portClose := flowd.PortClose("OUT")
+	// NOTE: like a network inport, the upstream stays open after PortClose
+	stillOpen := make(chan *flowd.Frame, 2)
+	stillOpen <- dataFrame("a1")
+	stillOpen <- &portClose
+	sources := []chan *flowd.Frame{stillOpen, frameSource(dataFrame("b1"), &portClose)}
+	err := mergeFrames(sources, out, "IN", mergeArrival, nil, nil)
+	assert.NoError(t, err, "merging returned error")
+	bodies, last := mergedBodies(t, &merged)
+	assert.ElementsMatch(t, []string{"a1", "b1"}, bodies, "data frames not forwarded")
+	assert.Equal(t, "PortClose", last.BodyType, "PortClose not forwarded last")
+}
+
+func TestMergeFramesDrainsUpstreamAfterPortClose(t *testing.T) {
+	var merged bytes.Buffer
+	portClose := flowd.PortClose("OUT")
+	// NOTE: unbuffered, so the upstream blocks unless read
+	upstream := make(chan *flowd.Frame)
+	sent := make(chan struct{})
+	go func() {
+		upstream <- dataFrame("a1")
+		upstream <- &portClose
+		for n := 0; n < 100; n++ {
+			upstream <- dataFrame("late")
+		}
+		close(upstream)
+		close(sent)
+	}()
+	err := mergeFrames([]chan *flowd.Frame{upstream}, bufio.NewWriter(&merged), "IN", mergeArrival, nil, nil)
+	assert.NoError(t, err, "merging returned error")
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream blocked after PortClose")
+	}
+	bodies, last := mergedBodies(t, &merged)
+	assert.Equal(t, []string{"a1"}, bodies, "frames after PortClose forwarded")
+	assert.Equal(t, "PortClose", last.BodyType, "PortClose not forwarded last")
+}
+
+func TestDetectFanIns(t *testing.T) {
+	procs := Network{
+		"A": &Process{Name: "A", OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "C", RemotePort: "IN"}}},
+		"B": &Process{Name: "B", OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "C", RemotePort: "IN"}}},
+		"C": &Process{Name: "C", InPorts: []Port{
+			{LocalPort: "IN", RemoteProc: "A", RemotePort: "OUT"},
+			{LocalPort: "IN", RemoteProc: "B", RemotePort: "OUT"},
+			{LocalPort: "OTHER", RemoteProc: "A", RemotePort: "X"},
+		}, Metadata: map[string]string{"merge": mergeRoundRobin}},
+	}
+	fanIns, err := detectFanIns(procs, mergeArrival, nil, false)
+	assert.NoError(t, err, "detection returned error")
+	assert.Len(t, fanIns, 1, "wrong number of merged inports")
+	assert.Equal(t, mergeRoundRobin, fanIns[0].Order, "merge order from metadata not used")
+	assert.Equal(t, fanInPath("C", "IN", "A", "OUT"), procs["A"].OutPorts[0].Path, "upstream A not given own named pipe")
+	assert.Equal(t, fanInPath("C", "IN", "B", "OUT"), procs["B"].OutPorts[0].Path, "upstream B not given own named pipe")
+	assert.Contains(t, procs["C"].FanIns, "IN", "merged inport not recorded at process")
+
+	procs["C"].Metadata["merge"] = "random"
+	_, err = detectFanIns(procs, mergeArrival, nil, false)
+	assert.Error(t, err, "unknown merge order accepted")
+}
+
+func TestParseEndpoint(t *testing.T) {
+	endpoint, err := parseEndpoint("IN", "tcp://:7000")
+	assert.NoError(t, err, "TCP endpoint not accepted")
+	assert.Equal(t, &NetEndpoint{Port: "IN", Network: "tcp", Address: ":7000"}, endpoint)
+	endpoint, err = parseEndpoint("IN", "unix:///run/x.sock")
+	assert.NoError(t, err, "Unix endpoint not accepted")
+	assert.Equal(t, "/run/x.sock", endpoint.Address, "Unix socket path wrong")
+	endpoint, err = parseEndpoint("OUT", "/dev/shm/existing")
+	assert.NoError(t, err, "named pipe endpoint not accepted")
+	assert.Equal(t, "fifo", endpoint.Network, "path without scheme not taken as named pipe")
+	_, err = parseEndpoint("IN", "udp://:7000")
+	assert.Error(t, err, "unsupported scheme accepted")
+
+	endpoints := keyValueFlag{}
+	assert.NoError(t, endpoints.Set("IN=tcp://:7000"), "PORT=endpoint not accepted")
+	assert.Error(t, endpoints.Set("IN=tcp://:7001"), "duplicate port accepted")
+	assert.Error(t, endpoints.Set("tcp://:7000"), "missing port name accepted")
+}
+
+func TestSubstituteParams(t *testing.T) {
+	t.Setenv("FLOWD_TEST_PATH", "/var/log/syslog")
+	nwBytes := []byte("# ${IGNORED} in comment\n" +
+		"'${FLOWD_TEST_PATH}' -> ARGS Reader\n" +
+		"'-when \"${WHEN:-*/1 * * * * * *}\" -to ${PORT}' -> ARGS Schedule\n" +
+		"'$${LITERAL}' -> ARGS Display")
+	result, err := substituteParams(nwBytes, map[string]string{"PORT": "OUT1"}, map[string]string{"PORT": "OUT2"})
+	assert.NoError(t, err, "substitution returned error")
+	assert.Equal(t, "# ${IGNORED} in comment\n"+
+		"'/var/log/syslog' -> ARGS Reader\n"+
+		"'-when \"*/1 * * * * * *\" -to OUT1' -> ARGS Schedule\n"+
+		"'${LITERAL}' -> ARGS Display", string(result), "wrong substitution")
+
+	_, err = substituteParams([]byte("'${MISSING_B} ${MISSING_A}' -> ARGS Proc"))
+	assert.EqualError(t, err, "unresolved variables: MISSING_A, MISSING_B", "unresolved variables not reported by name")
+
+	// quotes in values
+	_, err = substituteParams([]byte("# it's\n'-msg ${MSG}' -> ARGS Proc"), map[string]string{"MSG": "it's"})
+	assert.EqualError(t, err, "line 2: value of variable MSG contains ', which would end the quoted IIP or name it is used in")
+	result, err = substituteParams([]byte("'-msg \"${MSG}\"' -> ARGS Proc"), map[string]string{"MSG": "say \"hi\""})
+	assert.NoError(t, err, "double quotes in single-quoted IIP rejected")
+	assert.Equal(t, "'-msg \"say \"hi\"\"' -> ARGS Proc", string(result))
+
+	// trailing comments
+	result, err = substituteParams([]byte("'#${PORT} # ${PORT}' -> ARGS Proc # uses ${UNSET} and it's ${PORT}"), map[string]string{"PORT": "7000"})
+	assert.NoError(t, err, "variables in trailing comment resolved")
+	assert.Equal(t, "'#7000 # 7000' -> ARGS Proc # uses ${UNSET} and it's ${PORT}", string(result))
+}
+
+func TestInlineNetwork(t *testing.T) {
+	outer := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Reader", Component: "bin/file-read"},
+			{Name: "Sub", Component: includeComponent},
+			{Name: "Display", Component: "bin/display"},
+		},
+		Connections: []*fbp.Connection{
+			{Source: &fbp.Endpoint{Process: "Reader", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Sub", Port: "IN"}},
+			{Source: &fbp.Endpoint{Process: "Sub", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Display", Port: "IN"}},
+			{Data: "inner.fbp", Target: &fbp.Endpoint{Process: "Sub", Port: "ARGS"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{},
+		Outports: map[string]*fbp.Endpoint{},
+	}
+	inner := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Split", Component: "bin/split-lines"},
+			{Name: "Filter", Component: "bin/packet-filter-string"},
+		},
+		Connections: []*fbp.Connection{
+			{Source: &fbp.Endpoint{Process: "Split", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Filter", Port: "IN"}},
+			{Data: "-pass cron", Target: &fbp.Endpoint{Process: "Filter", Port: "ARGS"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{"IN": {Process: "Split", Port: "IN"}},
+		Outports: map[string]*fbp.Endpoint{"OUT": {Process: "Filter", Port: "OUT"}},
+	}
+	err := inlineNetwork(outer, "Sub", inner)
+	assert.NoError(t, err, "inlining returned error")
+	names := []string{}
+	for _, proc := range outer.Processes {
+		names = append(names, proc.Name)
+	}
+	assert.Equal(t, []string{"Reader", "Sub_Split", "Sub_Filter", "Display"}, names, "processes not replaced")
+	connections := []string{}
+	for _, conn := range outer.Connections {
+		if conn.Source == nil {
+			connections = append(connections, "'"+conn.Data+"' -> "+conn.Target.Process+"."+conn.Target.Port)
+		} else {
+			connections = append(connections, conn.Source.Process+"."+conn.Source.Port+" -> "+conn.Target.Process+"."+conn.Target.Port)
+		}
+	}
+	assert.Equal(t, []string{
+		"Reader.OUT -> Sub_Split.IN",
+		"Sub_Filter.OUT -> Display.IN",
+		"Sub_Split.OUT -> Sub_Filter.IN",
+		"'-pass cron' -> Sub_Filter.ARGS",
+	}, connections, "connections not mapped")
+
+	// unknown port of included network
+	outer.Processes = append(outer.Processes, &fbp.Process{Name: "Sub2", Component: includeComponent})
+	outer.Connections = append(outer.Connections, &fbp.Connection{Source: &fbp.Endpoint{Process: "Reader", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Sub2", Port: "MISSING"}})
+	assert.Error(t, inlineNetwork(outer, "Sub2", inner), "connection to unknown port of included network accepted")
+}
+
+func TestPlanInstance(t *testing.T) {
+	nw := &fbp.Fbp{Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	proc := &Process{
+		Name:     "Filter",
+		Path:     "bin/packet-filter-string",
+		InPorts:  []Port{{LocalPort: "IN", RemoteProc: "Split", RemotePort: "OUT"}},
+		OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "Display", RemotePort: "IN"}},
+		IIPs:     []IIP{{Port: "ARGS", Data: "-pass -or 'cron job' sudo"}, {Port: "CONF", Data: "x"}},
+	}
+	plan, err := planInstance(proc, nw)
+	assert.NoError(t, err, "planning returned error")
+	assert.Equal(t, []string{
+		"Filter",
+		"-inport", "IN", "-inpath", "/dev/shm/Filter.IN",
+		"-inport", "CONF", "-inpath", "/dev/shm/Filter.CONF",
+		"-outport=OUT", "-outpath=/dev/shm/Display.IN",
+		"-pass", "-or", "cron job", "sudo",
+	}, plan.Args, "wrong argv")
+	assert.Equal(t, []string{"/dev/shm/Filter.IN", "/dev/shm/Filter.CONF"}, plan.FIFOs, "wrong named pipes")
+	assert.Equal(t, []IIPPlan{
+		{Process: "Filter", Port: "ARGS", Data: "-pass -or 'cron job' sudo"},
+		{Process: "Filter", Port: "CONF", Path: "/dev/shm/Filter.CONF", Data: "x"},
+	}, plan.IIPs, "wrong IIP deliveries")
+	assert.Len(t, proc.InPorts, 1, "planning changed the process")
+}
+
+func TestExportShellScript(t *testing.T) {
+	nw := &fbp.Fbp{Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	procs := Network{
+		"tcp": &Process{Name: "tcp", Path: "bin/tcp-server", Metadata: map[string]string{"env_LANG": "C"},
+			InPorts:  []Port{{LocalPort: "IN", RemoteProc: "chat", RemotePort: "OUT"}},
+			OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "chat", RemotePort: "IN"}},
+			IIPs:     []IIP{{Port: "ARGS", Data: "tcp4://localhost:4000"}}},
+		"chat": &Process{Name: "chat", Path: "bin/chat",
+			InPorts:  []Port{{LocalPort: "IN", RemoteProc: "tcp", RemotePort: "OUT"}},
+			OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "tcp", RemotePort: "IN"}},
+			IIPs:     []IIP{{Port: "CONF", Data: "it's"}}},
+	}
+	plan, err := planNetwork(procs, nw, nil, nil, nil, nil)
+	assert.NoError(t, err, "planning returned error")
+	var script bytes.Buffer
+	assert.NoError(t, exportShellScript(plan, "chat-server.fbp", &script), "export returned error")
+	assert.Contains(t, script.String(), "[ -p /dev/shm/chat.IN ] || mkfifo -m 0770 /dev/shm/chat.IN\n")
+	assert.Contains(t, script.String(), "  trap '' INT TERM\n  cleanup\n  kill 0\n  wait\n  exit 130\n")
+	assert.Contains(t, script.String(), "run tcp env LANG=C bin/tcp-server -inport IN -inpath /dev/shm/tcp.IN -outport=OUT -outpath=/dev/shm/chat.IN tcp4://localhost:4000 &\n")
+	assert.Contains(t, script.String(), "printf '2data\\ntype:IIP\\nlength:%d\\n\\n%s\\000' 4 it\\'s > /dev/shm/chat.CONF &\n")
+
+	plan.Merges = []*FanIn{{Proc: "chat", Port: "IN"}}
+	assert.Error(t, exportShellScript(plan, "chat-server.fbp", &script), "merged inports exported")
+}
+
+func TestWriteProcessUnit(t *testing.T) {
+	proc := &Process{Name: "chat", Path: "bin/chat",
+		InPorts:  []Port{{LocalPort: "IN", RemoteProc: "tcp", RemotePort: "OUT"}},
+		OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "tcp", RemotePort: "IN"}},
+		IIPs:     []IIP{{Port: "CONF", Data: "100%"}},
+		Metadata: map[string]string{"restart": "always", "cpu": "50", "env_LANG": "C", "unknown": "x", "after": "tcp", "ready": "signal"}}
+	nw := &fbp.Fbp{Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	plan, err := planInstance(proc, nw)
+	assert.NoError(t, err, "planning returned error")
+	var unit bytes.Buffer
+	assert.NoError(t, writeProcessUnit(&unit, "chat-server", "/srv/flowd", plan, proc, []string{"/dev/shm/chat.IN"}), "writing unit returned error")
+	assert.Contains(t, unit.String(), "PartOf=chat-server.target\n")
+	assert.Contains(t, unit.String(), "ExecStartPre=/bin/sh -c \"mkdir -p '/dev/shm'; [ -p '/dev/shm/chat.IN' ] || mkfifo -m 0770 '/dev/shm/chat.IN'\"\n")
+	assert.Contains(t, unit.String(), "ExecStart=/srv/flowd/bin/chat -inport IN -inpath /dev/shm/chat.IN -inport CONF -inpath /dev/shm/chat.CONF -outport=OUT -outpath=/dev/shm/tcp.IN\n")
+	assert.Contains(t, unit.String(), "length:%%d\\\\n\\\\n%%s\\\\000' 4 '100%%' > '/dev/shm/chat.CONF'\"\n", "specifiers not escaped in IIP delivery")
+	assert.Contains(t, unit.String(), "CPUQuota=50%\n")
+	assert.Contains(t, unit.String(), "Environment=LANG=C\n")
+	assert.Contains(t, unit.String(), "Restart=always\n")
+	assert.Contains(t, unit.String(), "After=chat-server-tcp.service\nWants=chat-server-tcp.service\n")
+	assert.Contains(t, unit.String(), "[Service]\nType=notify\n")
+	assert.NotContains(t, unit.String(), "unknown")
+
+	// unit names of replicas and JPM process names
+	assert.Equal(t, `chat-server-Work\x230.service`, processUnitName("chat-server", "Work#0"))
+	assert.Equal(t, `chat-server-Work\x23lb.service`, processUnitName("chat-server", "Work#lb"))
+	assert.Equal(t, `my\x20net-line\x20filter-a.b.service`, processUnitName("my net", "line filter/a.b"))
+	assert.Equal(t, `\x2eweb-\x2eapi.service`, processUnitName(".web", ".api"))
+}
+
+func TestSystemdFlowdArgs(t *testing.T) {
+	flags := flag.NewFlagSet("flowd", flag.ContinueOnError)
+	flags.Bool("quiet", false, "")
+	flags.Bool("count-frames", false, "")
+	flags.Var(keyValueFlag{}, "set", "")
+	for _, name := range []string{"fifodir", "export-systemd", "systemd-mode", "timeout", "notation"} {
+		flags.String(name, "", "")
+	}
+	args := []string{"-quiet", "-fifodir", "/run/chat", "-export-systemd", "/etc/systemd/system", "-set", "PORT=7000", "-systemd-mode=network", "-count-frames", "-timeout", "1h", "-notation", "jpm", "chat.net"}
+	assert.NoError(t, flags.Parse(args))
+	assert.Equal(t, []string{"-fifodir", "/run/chat", "-set", "PORT=7000", "-count-frames", "-timeout", "1h", "-notation", "jpm"}, systemdFlowdArgs(flags, args))
+}
+
+func TestExportProcessPorts(t *testing.T) {
+	nw := &fbp.Fbp{
+		Processes: []*fbp.Process{{Name: "A"}, {Name: "B"}},
+		Connections: []*fbp.Connection{
+			{Source: &fbp.Endpoint{Process: "A", Port: "OUT"}, Target: &fbp.Endpoint{Process: "B", Port: "IN"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{"IN": {Process: "A", Port: "IN"}},
+		Outports: map[string]*fbp.Endpoint{},
+	}
+	err := exportProcessPorts(nw, keyValueFlag{"IN": "/tmp/x", "B.IN": "unix:///tmp/b"}, keyValueFlag{"B.OUT": "unix:///tmp/c"})
+	assert.NoError(t, err, "binding process ports returned error")
+	assert.Equal(t, &fbp.Endpoint{Process: "A", Port: "IN"}, nw.Inports["IN"], "network inport changed")
+	assert.Equal(t, &fbp.Endpoint{Process: "B", Port: "IN"}, nw.Inports["B.IN"], "process inport not bound")
+	assert.Equal(t, &fbp.Endpoint{Process: "B", Port: "OUT"}, nw.Outports["B.OUT"], "process outport not bound")
+
+	assert.Error(t, exportProcessPorts(nw, keyValueFlag{}, keyValueFlag{"A.OUT": "unix:///tmp/d"}), "connected outport bound")
+	assert.Error(t, exportProcessPorts(nw, keyValueFlag{"C.IN": "unix:///tmp/e"}, keyValueFlag{}), "port of unknown process bound")
+}
+
+func TestTestFrameMatch(t *testing.T) {
+	body := "hello cron"
+	frame := &flowd.Frame{Type: "data", BodyType: "TextLine", Extensions: map[string]string{"conn-id": "7"}, Body: []byte(body)}
+	assert.Empty(t, TestFrame{}.match(frame), "empty matcher does not match")
+	assert.Empty(t, TestFrame{Type: "data", BodyType: "TextLine", Headers: map[string]string{"conn-id": "7"}, Body: &body}.match(frame), "exact matcher does not match")
+	assert.Empty(t, TestFrame{BodyContains: "cron", BodyRegex: "^hello"}.match(frame), "body matchers do not match")
+	assert.Contains(t, TestFrame{Type: "control"}.match(frame), "type")
+	assert.Contains(t, TestFrame{Headers: map[string]string{"conn-id": "8"}}.match(frame), "header conn-id")
+	assert.Contains(t, TestFrame{BodyRegex: "^cron"}.match(frame), "body")
+}
+
+func TestFindTestSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowd-test-specs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"filter.test.yaml", "chat.test.json", "filter.yaml", "filter.fbp", "example-list.json"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644))
+	}
+	specs, err := findTestSpecs(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "chat.test.json"), filepath.Join(dir, "filter.test.yaml")}, specs, "network definitions taken as test specs")
+	specs, err = findTestSpecs(filepath.Join(dir, "filter.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "filter.yaml")}, specs, "spec given as file not taken")
+}
+
+func TestWriteTAP(t *testing.T) {
+	var report bytes.Buffer
+	err := writeTAP(&report, []*TestResult{
+		{Spec: "chat", Case: "echo"},
+		{Spec: "chat", Case: "broadcast", Failures: []string{"timeout after 5s"}, Output: "chat: starting\n"},
+	})
+	assert.NoError(t, err, "writing TAP returned error")
+	assert.Equal(t, "TAP version 13\n1..2\nok 1 - chat: echo\nnot ok 2 - chat: broadcast\n  ---\n  failures:\n    - \"timeout after 5s\"\n  output: |\n    chat: starting\n  ...\n", report.String())
+}
+
+func TestDetectFanInsRecorded(t *testing.T) {
+	procs := Network{
+		"A": &Process{Name: "A", OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "B", RemotePort: "IN"}}},
+		"B": &Process{Name: "B", InPorts: []Port{{LocalPort: "IN", RemoteProc: "A", RemotePort: "OUT"}}},
+	}
+	fanIns, err := detectFanIns(procs, mergeArrival, map[string]string{"B.IN": "b.capture"}, false)
+	assert.NoError(t, err, "detection returned error")
+	assert.Len(t, fanIns, 1, "recorded inport not passed through flowd")
+	assert.Equal(t, "b.capture", fanIns[0].Record, "capture file not set")
+	assert.Equal(t, fanInPath("B", "IN", "A", "OUT"), procs["A"].OutPorts[0].Path, "upstream not given own named pipe")
+
+	_, err = detectFanIns(procs, mergeArrival, map[string]string{"B.OTHER": "b.capture"}, false)
+	assert.Error(t, err, "recording of unconnected inport accepted")
+}
+
+func TestRecordAndReplayFrames(t *testing.T) {
+	// record
+	var captured bytes.Buffer
+	capture := &Capture{writer: bufio.NewWriter(&captured)}
+	start := time.Date(2017, 10, 19, 14, 0, 0, 0, time.UTC)
+	first := &flowd.Frame{Type: "data", BodyType: "LineData", Port: "OUT", Body: []byte("a"), Extensions: map[string]string{"conn-id": "1"}}
+	assert.NoError(t, capture.writeAt(first, start), "recording returned error")
+	assert.NoError(t, capture.writeAt(dataFrame("b"), start.Add(2*time.Second)), "recording returned error")
+	assert.NotContains(t, first.Extensions, recordedHeader, "forwarded frame modified")
+
+	// replay
+	var replayed bytes.Buffer
+	sleeps := []time.Duration{}
+	count, err := replayFrames(bufio.NewReader(&captured), bufio.NewWriter(&replayed), "IN", true, func(d time.Duration) { sleeps = append(sleeps, d) })
+	assert.NoError(t, err, "replaying returned error")
+	assert.Equal(t, 2, count, "not all frames replayed")
+	assert.Equal(t, []time.Duration{2 * time.Second}, sleeps, "original pacing not kept")
+	reader := bufio.NewReader(&replayed)
+	frame, err := flowd.Deserialize(reader)
+	assert.NoError(t, err, "replayed frame not readable")
+	assert.Equal(t, "a", string(frame.Body))
+	assert.Equal(t, "IN", frame.Port, "replayed frame not addressed to inport")
+	assert.Equal(t, map[string]string{"conn-id": "1"}, frame.Extensions, "recorded header not removed")
+}
+
+func TestStallMonitorDeadlock(t *testing.T) {
+	// A and B each open their inport first, waiting for the other to open its outport
+	plan := &NetworkPlan{Processes: []*ProcessPlan{
+		{Name: "A", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/A.IN"}, {Port: "OUT", Path: "/dev/shm/B.IN"}}},
+		{Name: "B", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/B.IN"}, {Port: "OUT", Path: "/dev/shm/A.IN"}}},
+	}}
+	m := newStallMonitor(plan, 10*time.Second)
+	m.inspect = func(pid int) (*procSnapshot, error) {
+		return &procSnapshot{open: map[string]bool{}, inOpen: true, wchans: []string{"pipe_wait"}}, nil
+	}
+	m.pipeFill = func(path string) (int, int, error) { t.Error("pipe opened although reader has not"); return 0, 0, nil }
+	now := time.Now()
+	m.processStarted("A", 1)
+	m.processStarted("B", 2)
+	assert.Empty(t, m.check(now), "stall reported before timeout")
+
+	warnings := m.check(now.Add(time.Minute))
+	assert.Len(t, warnings, 3)
+	assert.Contains(t, warnings[0], "A is blocked opening a named pipe")
+	assert.Contains(t, warnings[0], "inport IN (/dev/shm/A.IN, other side: B.OUT)")
+	assert.Contains(t, warnings[0], "wait channels: pipe_wait")
+	assert.Equal(t, "deadlock: A waits for B to open /dev/shm/B.IN, B waits for A to open /dev/shm/A.IN", warnings[2])
+	assert.Empty(t, m.check(now.Add(2*time.Minute)), "stall reported again")
+}
+
+func TestStallMonitorFullPipe(t *testing.T) {
+	plan := &NetworkPlan{Processes: []*ProcessPlan{
+		{Name: "A", Ports: []PortPlan{{Port: "OUT", Path: "/dev/shm/B.IN"}}},
+		{Name: "B", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/B.IN"}}},
+	}}
+	m := newStallMonitor(plan, 10*time.Second)
+	readBytes := uint64(100)
+	m.inspect = func(pid int) (*procSnapshot, error) {
+		return &procSnapshot{open: map[string]bool{"/dev/shm/B.IN": true}, readBytes: readBytes}, nil
+	}
+	m.pipeFill = func(path string) (int, int, error) { return 65536, 65536, nil }
+	now := time.Now()
+	m.processStarted("A", 1)
+	m.processStarted("B", 2)
+	assert.Empty(t, m.check(now))
+	// read progress resets
+	readBytes = 200
+	assert.Empty(t, m.check(now.Add(20*time.Second)), "stall reported despite read progress")
+	warnings := m.check(now.Add(35 * time.Second))
+	assert.Equal(t, []string{"possible stall: connection A.OUT -> B.IN: pipe buffer full (65536 of 65536 bytes) and B made no read progress for 15s"}, warnings)
+}
+
+func TestFindCycles(t *testing.T) {
+	waitsFor := map[string]map[string]string{
+		"C": {"A": "p1"},
+		"A": {"B": "p2"},
+		"B": {"C": "p3", "D": "p4"},
+		"D": {"D": "p5"},
+	}
+	assert.Equal(t, [][]string{{"A", "B", "C"}, {"D"}}, findCycles(waitsFor))
+}
+
+func TestStartupOrder(t *testing.T) {
+	procs := Network{
+		"db":     {Name: "db", Metadata: map[string]string{}},
+		"server": {Name: "server", Metadata: map[string]string{"after": "db/cache"}},
+		"cache":  {Name: "cache", Metadata: map[string]string{}},
+	}
+	after, err := startupOrder(procs)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"server": {"cache", "db"}}, after)
+
+	procs["db"].Metadata["after"] = "server"
+	_, err = startupOrder(procs)
+	assert.EqualError(t, err, "startup order contains a cycle: db -> server -> db")
+
+	procs["db"].Metadata["after"] = "nonexistent"
+	_, err = startupOrder(procs)
+	assert.Error(t, err, "unknown process not detected")
+
+	// waiting for a directly connected process, which opens its ports before signaling readiness
+	delete(procs["db"].Metadata, "after")
+	procs["db"].Metadata["ready"] = "signal"
+	procs["db"].OutPorts = []Port{{LocalPort: "OUT", RemoteProc: "server", RemotePort: "IN"}}
+	_, err = startupOrder(procs)
+	assert.EqualError(t, err, "process server: after=db/cache: directly connected to db, which is ready=signal and would wait for it forever")
+	procs["db"].OutPorts[0].Path = "/dev/shm/db.OUT" // merged by flowd
+	_, err = startupOrder(procs)
+	assert.NoError(t, err, "connection through flowd rejected")
+	delete(procs["db"].Metadata, "ready")
+	procs["db"].OutPorts[0].Path = ""
+	_, err = startupOrder(procs)
+	assert.NoError(t, err, "process ready once started rejected")
+}
+
+func TestStartupStateWaitFor(t *testing.T) {
+	quiet = true
+	defer func() { quiet = false }()
+	s := newStartupState(Network{"db": {Name: "db"}, "server": {Name: "server"}})
+	started := make(chan struct{})
+	go func() {
+		s.waitFor([]string{"db"})
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("started before dependency ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, s.markReady("db"))
+	assert.False(t, s.markReady("db"), "readiness counted twice")
+	<-started
+	ready, _ := s.isReady()
+	assert.False(t, ready, "network ready with process pending")
+	s.markReady("server")
+	ready, _ = s.isReady()
+	assert.True(t, ready, "network not ready with all processes ready")
+}
+
+func TestScheduleRunArgs(t *testing.T) {
+	flags := flag.NewFlagSet("flowd", flag.ContinueOnError)
+	flags.Bool("quiet", false, "")
+	flags.Var(keyValueFlag{}, "set", "")
+	for _, name := range []string{"timeout", "every", "cron", "history", "fifodir"} {
+		flags.String(name, "", "")
+	}
+	args := []string{"-every", "1h", "-quiet", "-history=runs.json", "--cron", "0 3 * * *", "-set", "A=1", "-fifodir", "/tmp", "-timeout", "5m", "batch.fbp"}
+	assert.Equal(t, []string{"-quiet", "-set", "A=1", "-timeout", "5m", "batch.fbp"}, scheduleRunArgs(flags, args))
+}
+
+func TestRunHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowd-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "runs.json")
+	history, err := loadRunHistory(path)
+	assert.NoError(t, err, "missing history file not treated as empty")
+	assert.Empty(t, history)
+	start := time.Date(2017, 10, 19, 3, 0, 0, 0, time.UTC)
+	history = append(history, RunRecord{Run: 1, Start: start, End: start.Add(time.Minute), Duration: "1m0s", ExitCode: exitTimeout, Result: runTimeout})
+	assert.NoError(t, saveRunHistory(path, history))
+	loaded, err := loadRunHistory(path)
+	assert.NoError(t, err)
+	assert.Equal(t, history, loaded)
+}
+
+func TestFailedInstance(t *testing.T) {
+	run := func(name string, command string) *Process {
+		cmd := exec.Command(command)
+		if err := cmd.Run(); err != nil {
+			if _, exited := err.(*exec.ExitError); !exited {
+				t.Skip("cannot run", command, err)
+			}
+		}
+		return &Process{Name: name, Instance: &ComponentInstance{Cmd: cmd}}
+	}
+	assert.False(t, failedInstance(run("ok", "true")))
+	assert.True(t, failedInstance(run("crashed", "false")))
+	assert.False(t, failedInstance(&Process{Name: "waiting", Instance: &ComponentInstance{}}), "process never started counted")
+	stops["stopped"] = true
+	defer delete(stops, "stopped")
+	assert.False(t, failedInstance(run("stopped", "false")), "process stopped using the shell counted")
+}
+
+func TestReplicateProcesses(t *testing.T) {
+	procs := Network{
+		"read": {Name: "read", Path: "bin/file-read", Metadata: map[string]string{},
+			OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "work", RemotePort: "IN"}}},
+		"work": {Name: "work", Path: "bin/worker", Metadata: map[string]string{"replicas": "2"},
+			InPorts:  []Port{{LocalPort: "IN", RemoteProc: "read", RemotePort: "OUT"}},
+			OutPorts: []Port{{LocalPort: "OUT", RemoteProc: "write", RemotePort: "IN"}},
+			IIPs:     []IIP{{Port: "CONF", Data: "x"}}},
+		"write": {Name: "write", Path: "bin/file-write", Metadata: map[string]string{"after": "work"},
+			InPorts: []Port{{LocalPort: "IN", RemoteProc: "work", RemotePort: "OUT"}}},
+	}
+	nw := &fbp.Fbp{Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	assert.NoError(t, replicateProcesses(procs, nw))
+	assert.NotContains(t, procs, "work")
+	assert.Equal(t, []Port{{LocalPort: "OUT", RemoteProc: "work#lb", RemotePort: "IN"}}, procs["read"].OutPorts)
+	balancer := procs["work#lb"]
+	assert.Equal(t, "bin/load-balancer", balancer.Path)
+	assert.Equal(t, []Port{{LocalPort: "IN", RemoteProc: "read", RemotePort: "OUT"}}, balancer.InPorts)
+	assert.Equal(t, []Port{{LocalPort: "OUT[0]", RemoteProc: "work#0", RemotePort: "IN"}, {LocalPort: "OUT[1]", RemoteProc: "work#1", RemotePort: "IN"}}, balancer.OutPorts)
+	for _, name := range []string{"work#0", "work#1"} {
+		assert.Equal(t, []IIP{{Port: "CONF", Data: "x"}}, procs[name].IIPs, "IIPs not given to each instance")
+		assert.NotContains(t, procs[name].Metadata, "replicas")
+	}
+	assert.Equal(t, []Port{{LocalPort: "IN", RemoteProc: "work#0", RemotePort: "OUT"}, {LocalPort: "IN", RemoteProc: "work#1", RemotePort: "OUT"}}, procs["write"].InPorts)
+	assert.Equal(t, "work#0/work#1", procs["write"].Metadata["after"])
+}
+
+func TestPlanBridges(t *testing.T) {
+	processes := []*ProcessPlan{
+		{Name: "Read", Ports: []PortPlan{{Port: "OUT", Path: "/dev/shm/Filter.IN"}}},
+		{Name: "Filter", Host: "db1", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/Filter.IN"}, {Port: "CONF", Inport: true, Path: "/dev/shm/Filter.CONF"}, {Port: "OUT", Path: "/dev/shm/Count.IN"}}},
+		{Name: "Count", Host: "db1", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/Count.IN"}, {Port: "OUT", Path: "/dev/shm/Write.IN"}}},
+		{Name: "Write", Host: "web2", Ports: []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/Write.IN"}}},
+	}
+	iips := []IIPPlan{{Process: "Filter", Port: "CONF", Path: "/dev/shm/Filter.CONF", Data: "x"}}
+	assert.Equal(t, []*Bridge{
+		{Path: "/dev/shm/Filter.IN", FromHost: "", ToHost: "db1", Writer: "Read.OUT", Reader: "Filter.IN"},
+		{Path: "/dev/shm/Write.IN", FromHost: "db1", ToHost: "web2", Writer: "Count.OUT", Reader: "Write.IN"},
+	}, planBridges(processes, iips), "wrong bridges")
+}
+
+func TestRemoteScript(t *testing.T) {
+	plan := &ProcessPlan{
+		Name:      "Filter",
+		Component: "bin/packet-filter-string",
+		Args:      []string{"Filter", "-inport", "IN", "-inpath", "/dev/shm/Filter.IN", "-pass", "cron job"},
+		Ports:     []PortPlan{{Port: "IN", Inport: true, Path: "/dev/shm/Filter.IN"}, {Port: "CONF", Inport: true, Path: "/dev/shm/Filter.CONF"}},
+		IIPs:      []IIPPlan{{Process: "Filter", Port: "CONF", Path: "/dev/shm/Filter.CONF", Data: "it's"}},
+		Env:       []string{"LANG=C", "MSG=hello world"},
+		Host:      "db1",
+	}
+	lines := strings.Split(remoteScript(plan, "/srv/my net"), "\n")
+	assert.Contains(t, lines, "cd '/srv/my net'")
+	assert.Contains(t, lines, "export LANG=C")
+	assert.Contains(t, lines, "export 'MSG=hello world'")
+	assert.Contains(t, lines, "mkdir -p /dev/shm")
+	assert.Contains(t, lines, "[ -p /dev/shm/Filter.IN ] || mkfifo -m 0770 /dev/shm/Filter.IN 2>/dev/null || [ -p /dev/shm/Filter.IN ]")
+	assert.Contains(t, lines, `printf '2data\ntype:IIP\nlength:%d\n\n%s\000' 4 it\'s > /dev/shm/Filter.CONF &`)
+	assert.Contains(t, lines, "bin/packet-filter-string -inport IN -inpath /dev/shm/Filter.IN -pass 'cron job' < /dev/null 3<&- &")
+	assert.Equal(t, "if [ $status -eq 255 ]; then status=254; fi", lines[len(lines)-2], "exit status of component not distinguished from ssh failure")
+	assert.Equal(t, "exit $status", lines[len(lines)-1])
+}
+
+func TestDaemonLifecycle(t *testing.T) {
+	truePath, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("no true executable:", err)
+	}
+	dir, err := ioutil.TempDir("", "flowd-daemon-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d, err := newDaemon(dir, truePath)
+	assert.NoError(t, err)
+
+	response := d.handle(&DaemonRequest{Command: "deploy", Network: "bad name", Definition: "x"})
+	assert.False(t, response.OK, "invalid network name accepted")
+	response = d.handle(&DaemonRequest{Command: "deploy", Network: "chat", Definition: "'x' -> IN A(bin/display)", Args: []string{"-set", "A=1"}})
+	assert.True(t, response.OK, response.Error)
+	assert.Equal(t, stateDeployed, response.Network.State)
+	assert.Equal(t, filepath.Join(dir, "chat", definitionFile), response.Network.Definition)
+
+	// flowd process is replaced by "true", exiting right away
+	response = d.handle(&DaemonRequest{Command: "start", Network: "chat"})
+	assert.True(t, response.OK, response.Error)
+	d.mutex.Lock()
+	done := d.networks["chat"].done
+	d.mutex.Unlock()
+	<-done
+	response = d.handle(&DaemonRequest{Command: "status", Network: "chat"})
+	assert.Equal(t, stateExited, response.Network.State)
+	assert.Equal(t, 0, *response.Network.ExitCode)
+	response = d.handle(&DaemonRequest{Command: "logs", Network: "chat", Lines: 1})
+	assert.Equal(t, []string{"flowd daemon: exited with code 0"}, response.Lines)
+
+	// deployment is persisted, network exited by itself and is not started again
+	reloaded, err := newDaemon(dir, truePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-set", "A=1"}, reloaded.networks["chat"].deployment.Args)
+	assert.False(t, reloaded.networks["chat"].deployment.Autostart, "exited network started again")
+
+	response = d.handle(&DaemonRequest{Command: "remove", Network: "chat"})
+	assert.True(t, response.OK, response.Error)
+	assert.Empty(t, d.list())
+	_, err = os.Stat(filepath.Join(dir, "chat"))
+	assert.True(t, os.IsNotExist(err), "network directory not removed")
+}
+
+func TestLogBuffer(t *testing.T) {
+	buffer := newLogBuffer(3)
+	for _, line := range []string{"a", "b", "c", "d"} {
+		buffer.add(line)
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, buffer.tail(0))
+	lines, follower := buffer.follow(2)
+	assert.Equal(t, []string{"c", "d"}, lines)
+	buffer.add("e")
+	assert.Equal(t, "e", <-follower)
+	buffer.unfollow(follower)
+	buffer.add("f")
+	assert.Empty(t, follower)
+}
+
+func TestGraphFormats(t *testing.T) {
+	nw := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Read", Component: "bin/file-read", Metadata: map[string]string{}},
+			{Name: "Work", Component: "bin/worker", Metadata: map[string]string{"replicas": "2"}},
+		},
+		Connections: []*fbp.Connection{
+			{Data: `x "y"`, Target: &fbp.Endpoint{Process: "Read", Port: "ARGS"}},
+			{Source: &fbp.Endpoint{Process: "Read", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Work", Port: "IN"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{},
+		Outports: map[string]*fbp.Endpoint{"OUT": {Process: "Work", Port: "OUT"}},
+	}
+	graph := buildGraph(nw)
+	assert.Len(t, graph.Nodes, 4)
+	assert.Equal(t, &GraphEdge{From: "Read", FromPort: "OUT", To: "Work", ToPort: "IN", key: "Read.OUT -> Work.IN"}, graph.Edges[1])
+
+	// live state
+	live = newLiveState(nw, Network{"Read": {}, "Work#0": {}, "Work#1": {}, "Work#lb": {}})
+	defer func() { live = nil }()
+	startup = newStartupState(Network{})
+	live.setProcessState("Read", processExited)
+	live.setProcessState("Work#1", processRunning)
+	countFrame(live.frameCounter("Read.OUT -> Work#lb.IN"))
+	counter := live.frameCounter(netPortKey("NETOUT", "OUT"))
+	countFrame(counter)
+	countFrame(counter)
+	assert.Nil(t, live.frameCounter(netPortKey("NETOUT", "OUT")), "connection counted twice")
+	graph = live.graph()
+	assert.Equal(t, processExited, graph.Nodes[1].State)
+	assert.Equal(t, processRunning, graph.Nodes[2].State)
+	assert.Equal(t, int64(1), *graph.Edges[1].Frames)
+	assert.Equal(t, int64(2), *graph.Edges[2].Frames)
+	assert.Nil(t, graph.Edges[0].Frames, "IIP connection counted")
+
+	var out bytes.Buffer
+	assert.NoError(t, writeGraph(&out, graph, graphMermaid))
+	assert.Contains(t, out.String(), "flowchart LR\n")
+	assert.Contains(t, out.String(), "\tiip0[[\"'x #quot;y#quot;'\"]]\n")
+	assert.Contains(t, out.String(), "\tWork(\"Work#0..1<br/>running\")\n")
+	assert.Contains(t, out.String(), "\tRead -->|\"OUT → IN (1 frame)\"| Work\n")
+	assert.Contains(t, out.String(), "\tclass Work running\n")
+	out.Reset()
+	assert.NoError(t, writeGraph(&out, graph, graphD2))
+	assert.Contains(t, out.String(), "\"Work\": \"Work#0..1\\nrunning\" {\n\tshape: rectangle\n\tstyle.multiple: true\n")
+	assert.Contains(t, out.String(), "\"Work\" -> \"out_OUT\": \"OUT (2 frames)\"\n")
+	out.Reset()
+	assert.NoError(t, writeGraph(&out, graph, graphDOT))
+	assert.Contains(t, out.String(), "\t\"Read\" -> \"Work\" [taillabel=\"OUT\",headlabel=\"IN\",label=\"1 frame\"];\n")
+	out.Reset()
+	assert.NoError(t, writeGraph(&out, graph, graphJSON))
+	decoded := &Graph{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), decoded))
+	assert.True(t, decoded.State.Ready)
+	assert.Error(t, writeGraph(&out, graph, "svg"))
+}
+
+func TestAnalyzeNetwork(t *testing.T) {
+	conn := func(from string, to string) *fbp.Connection {
+		return &fbp.Connection{Source: &fbp.Endpoint{Process: from, Port: "OUT"}, Target: &fbp.Endpoint{Process: to, Port: "IN"}}
+	}
+	nw := &fbp.Fbp{
+		Processes: []*fbp.Process{{Name: "Read"}, {Name: "Split"}, {Name: "TCP"}, {Name: "Chat"}, {Name: "Show"}, {Name: "Loop"}},
+		Connections: []*fbp.Connection{
+			{Data: "file.txt", Target: &fbp.Endpoint{Process: "Read", Port: "ARGS"}},
+			conn("Read", "Split"),
+			conn("Split", "TCP"),
+			conn("TCP", "Chat"),
+			conn("Chat", "TCP"),
+			conn("Chat", "Show"),
+			conn("Split", "Loop"),
+			conn("Loop", "Loop"),
+		},
+		Inports:  map[string]*fbp.Endpoint{"IN": {Process: "Split", Port: "IN"}},
+		Outports: map[string]*fbp.Endpoint{},
+	}
+	analysis := analyzeNetwork(nw)
+	assert.Equal(t, 8, analysis.Connections)
+	assert.Equal(t, 1, analysis.IIPs)
+	assert.Equal(t, []string{"Read"}, analysis.Sources)
+	assert.Equal(t, []string{"Show"}, analysis.Sinks)
+	assert.Equal(t, [][]string{{"Read"}, {"Split"}, {"TCP", "Chat", "Loop"}, {"Show"}}, analysis.Layers)
+	assert.Equal(t, [][]string{{"TCP", "Chat"}, {"Loop"}}, analysis.Cycles)
+	assert.Equal(t, [][]string{{"Read"}, {"Split"}, {"TCP", "Chat"}, {"Show"}}, analysis.LongestPath)
+	assert.Equal(t, &ProcessFan{Process: "Split", In: 2, Out: 2, NetIns: []string{"IN"}, position: 1}, analysis.Fan[1])
+	assert.Equal(t, []string{"Loop"}, analysis.Unterminated)
+}
+
+func TestDiffNetworks(t *testing.T) {
+	old := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Read", Component: "bin/file-read", Metadata: map[string]string{}},
+			{Name: "Work", Component: "bin/worker", Metadata: map[string]string{"replicas": "2", "host": "db1"}},
+			{Name: "Show", Component: "bin/display", Metadata: map[string]string{}},
+		},
+		Connections: []*fbp.Connection{
+			{Data: "a.txt", Target: &fbp.Endpoint{Process: "Read", Port: "ARGS"}},
+			{Source: &fbp.Endpoint{Process: "Read", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Work", Port: "IN"}},
+			{Source: &fbp.Endpoint{Process: "Work", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Show", Port: "IN"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{},
+		Outports: map[string]*fbp.Endpoint{"OUT": {Process: "Work", Port: "OUT"}},
+	}
+	assert.True(t, diffNetworks(old, old).Empty())
+
+	// same network in different order with changes
+	current := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Work", Component: "bin/worker2", Metadata: map[string]string{"replicas": "4", "ready": "signal"}},
+			{Name: "Read", Component: "bin/file-read", Metadata: map[string]string{}},
+			{Name: "Log", Component: "bin/file-write", Metadata: map[string]string{}},
+		},
+		Connections: []*fbp.Connection{
+			{Source: &fbp.Endpoint{Process: "Work", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Log", Port: "IN"}},
+			{Source: &fbp.Endpoint{Process: "Read", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Work", Port: "IN"}},
+			{Data: "b.txt", Target: &fbp.Endpoint{Process: "Read", Port: "ARGS"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{},
+		Outports: map[string]*fbp.Endpoint{"OUT": {Process: "Log", Port: "OUT"}},
+	}
+	diff := diffNetworks(old, current)
+	assert.Equal(t, []*DiffEntry{
+		{Change: diffAdded, Name: "Log", New: "bin/file-write"},
+		{Change: diffRemoved, Name: "Show", Old: "bin/display"},
+		{Change: diffChanged, Name: "Work", Old: "bin/worker", New: "bin/worker2", Metadata: []*DiffEntry{
+			{Change: diffRemoved, Name: "host", Old: "db1"},
+			{Change: diffAdded, Name: "ready", New: "signal"},
+			{Change: diffChanged, Name: "replicas", Old: "2", New: "4"},
+		}},
+	}, diff.Processes)
+	assert.Equal(t, []*DiffEntry{
+		{Change: diffAdded, Name: "Work.OUT -> Log.IN"},
+		{Change: diffRemoved, Name: "Work.OUT -> Show.IN"},
+	}, diff.Connections)
+	assert.Equal(t, []*DiffEntry{{Change: diffChanged, Name: "Read.ARGS", Old: "a.txt", New: "b.txt"}}, diff.IIPs)
+	assert.Equal(t, []*DiffEntry{{Change: diffChanged, Name: "OUT", Old: "Work.OUT", New: "Log.OUT"}}, diff.Outports)
+}
+
+func TestFormatNetwork(t *testing.T) {
+	source := "# header\n" +
+		"\n" +
+		"Reader(bin/file-read) OUT -> IN Filter(bin/packet-filter-string:replicas=2,host=db1)\n" +
+		"# filter for cron\n" +
+		"'-pass cron' -> ARGS Filter\n" +
+		"Filter OUT -> IN Display(bin/display)\n" +
+		"OUTPORT=Filter.OUT:NETOUT\n" +
+		"'/var/log/syslog' -> ARGS Reader\n"
+	formatted := formatNetwork([]byte(source))
+	assert.Equal(t, "# header\n"+
+		"\n"+
+		"OUTPORT=Filter.OUT:NETOUT\n"+
+		"\n"+
+		"Filter(bin/packet-filter-string:host=db1,replicas=2) OUT -> IN Display(bin/display)\n"+
+		"Reader(bin/file-read)                                OUT -> IN Filter\n"+
+		"\n"+
+		"'-pass cron'      -> ARGS Filter\n"+
+		"'/var/log/syslog' -> ARGS Reader\n"+
+		"\n"+
+		"# filter for cron\n", string(formatted))
+	assert.Equal(t, string(formatted), string(formatNetwork(formatted)), "formatting not idempotent")
+}
+
+func TestLintNetwork(t *testing.T) {
+	nw := &fbp.Fbp{
+		Processes: []*fbp.Process{
+			{Name: "Read", Component: "bin/file-read", Metadata: map[string]string{}},
+			{Name: "Filter", Component: "bin/packet-filter-string", Metadata: map[string]string{}},
+			{Name: "Own", Component: "bin/own", Metadata: map[string]string{}},
+			{Name: "Lonely", Component: "bin/display", Metadata: map[string]string{}},
+		},
+		Connections: []*fbp.Connection{
+			{Data: "x", Target: &fbp.Endpoint{Process: "Read", Port: "ARGV"}},
+			{Data: "y", Target: &fbp.Endpoint{Process: "Filter", Port: "OPTIONS"}},
+			{Source: &fbp.Endpoint{Process: "Read", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Filter", Port: "IN"}},
+			{Source: &fbp.Endpoint{Process: "Read", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Filter", Port: "IN"}},
+			{Source: &fbp.Endpoint{Process: "Filter", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Own", Port: "in"}},
+		},
+		Inports:  map[string]*fbp.Endpoint{"IN": {Process: "Gone", Port: "IN"}},
+		Outports: map[string]*fbp.Endpoint{"OUT": {Process: "Own", Port: "OUT"}},
+	}
+	assert.Equal(t, []string{
+		"IIP to Filter.OPTIONS: component bin/packet-filter-string does not declare inport OPTIONS",
+		"IIP to Read.ARGV: port ARGV is deprecated, use ARGS",
+		"INPORT IN: unused, process Gone is not in the network",
+		"connection Filter.OUT -> Own.in: port in should be in upper case",
+		"connection Read.OUT -> Filter.IN: duplicate",
+		"process Lonely: not connected to anything",
+	}, lintNetwork(nw))
+}
+
+func TestParseJPM(t *testing.T) {
+	nw, err := parseJPM([]byte("# free-form notation\n" +
+		"'data.txt' -> OPT \"Read Masters\"(\"bin/file-read\") OUT ->\n" +
+		"  (20) IN Split(bin/split-lines:ready=signal) OUT[1] -> IN Show(bin/display),\n" +
+		"Prepare(bin/cmd) * -> * \"Read Masters\"; Cleanup(bin/cmd)\n" +
+		"Show * -> * Cleanup\n" +
+		"INPORT=Split.IN:NETIN\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []*fbp.Process{
+		{Name: "Read Masters", Component: "bin/file-read", Metadata: map[string]string{"after": "Prepare"}},
+		{Name: "Split", Component: "bin/split-lines", Metadata: map[string]string{"ready": "signal"}},
+		{Name: "Show", Component: "bin/display", Metadata: map[string]string{"ready": "exit"}},
+		{Name: "Prepare", Component: "bin/cmd", Metadata: map[string]string{"ready": "exit"}},
+		{Name: "Cleanup", Component: "bin/cmd", Metadata: map[string]string{"after": "Show"}},
+	}, nw.Processes)
+	index := 1
+	assert.Equal(t, []*fbp.Connection{
+		{Target: &fbp.Endpoint{Process: "Read Masters", Port: "OPT"}, Data: "data.txt"},
+		{Source: &fbp.Endpoint{Process: "Read Masters", Port: "OUT"}, Target: &fbp.Endpoint{Process: "Split", Port: "IN"}},
+		{Source: &fbp.Endpoint{Process: "Split", Port: "OUT", Index: &index}, Target: &fbp.Endpoint{Process: "Show", Port: "IN"}},
+	}, nw.Connections)
+	assert.Equal(t, &fbp.Endpoint{Process: "Split", Port: "IN"}, nw.Inports["NETIN"])
+
+	// errors
+	_, err = parseJPM([]byte("A(bin/a) OUT -> IN"))
+	assert.EqualError(t, err, "line 1: unexpected end, expected process")
+	_, err = parseJPM([]byte("A(bin/a) * -> IN B(bin/b)"))
+	assert.EqualError(t, err, "line 1: automatic port connected to regular port in A.* -> B.IN, only supported between automatic ports")
+	_, err = parseJPM([]byte("A(bin/a) OUT -> IN B(bin/b)\nB(bin/c) OUT -> IN A"))
+	assert.EqualError(t, err, "line 2: process B: declared as both bin/b and bin/c")
+}
+
+func TestParseYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowd-yaml")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "args.txt"), []byte("-pass sudo\n"), 0644))
+	nw, err := parseYAML([]byte(`
+inports:
+  NETIN: Split.IN
+processes:
+  Split:
+    component: bin/split-lines
+    metadata:
+      replicas: 2
+    env:
+      LANG: C
+  Filter:
+    component: bin/packet-filter-string
+connections:
+  - from: Split.OUT[1]
+    to: Filter.IN
+iips:
+  - to: Filter.ARGS
+    file: args.txt
+  - to: Split.CONF
+    data: |
+      first
+      second
+`), dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []*fbp.Process{
+		{Name: "Split", Component: "bin/split-lines", Metadata: map[string]string{"replicas": "2", "env_LANG": "C"}},
+		{Name: "Filter", Component: "bin/packet-filter-string", Metadata: map[string]string{}},
+	}, nw.Processes)
+	index := 1
+	assert.Equal(t, []*fbp.Connection{
+		{Source: &fbp.Endpoint{Process: "Split", Port: "OUT", Index: &index}, Target: &fbp.Endpoint{Process: "Filter", Port: "IN"}},
+		{Target: &fbp.Endpoint{Process: "Filter", Port: "ARGS"}, Data: "-pass sudo"},
+		{Target: &fbp.Endpoint{Process: "Split", Port: "CONF"}, Data: "first\nsecond\n"},
+	}, nw.Connections)
+	assert.Equal(t, &fbp.Endpoint{Process: "Split", Port: "IN"}, nw.Inports["NETIN"])
+
+	// errors
+	_, err = parseYAML([]byte("processes:\n  A:\n    component: bin/a\nconnections:\n  - from: A.OUT\n    to: B.IN\n"), dir)
+	assert.EqualError(t, err, "connection 1 to: process B not declared in processes")
+	_, err = parseYAML([]byte("processes:\n  A:\n    component: bin/a\niips:\n  - to: A\n    data: x\n"), dir)
+	assert.EqualError(t, err, "IIP 1 to: expected PROCESS.PORT or PROCESS.PORT[INDEX], got 'A'")
+	_, err = parseYAML([]byte("processes:\n  A:\n    componnt: bin/a\n"), dir)
+	assert.NotNil(t, err)
+}
+
+func TestIIPContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowd-iip")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "routes.json"), []byte("{\"default\": \"OUT\"}\n"), 0644))
+	source, heredocs, err := extractHeredocs([]byte("# '<<NOHEREDOC' in comment\n" +
+		"<<END -> ARGS Cron(bin/cron)\n" +
+		"-when \"0 * * * *\" HOURLY\n" +
+		"  END\n" +
+		"'@type=Routes @content-type=application/json @file:routes.json' -> CONF Router(bin/packet-router-header)\n" +
+		"'@home <<X' -> IN Router\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []Heredoc{{Delimiter: "END", Content: "-when \"0 * * * *\" HOURLY"}}, heredocs)
+	assert.Equal(t, 7, len(strings.Split(string(source), "\n")), "line numbers should be kept")
+	nw := parseNetworkDefinition(source)
+	assert.Nil(t, resolveIIPs(nw, dir, heredocs))
+	iips := []IIP{}
+	for _, conn := range nw.Connections {
+		iips = append(iips, newIIP(generatePortName(conn.Target), conn.Data))
+	}
+	assert.Equal(t, []IIP{
+		{Port: "ARGS", Data: "-when \"0 * * * *\" HOURLY"},
+		{Port: "CONF", Data: "{\"default\": \"OUT\"}", BodyType: "Routes", ContentType: "application/json"},
+		{Port: "IN", Data: "@home <<X"},
+	}, iips)
+	assert.Equal(t, `printf '2data\ntype:%s\ncontent-type:%s\nlength:%d\n\n%s\000' 'Routes' 'application/json' 2 '{}'`,
+		iipPrintf(IIPPlan{Data: "{}", BodyType: "Routes", ContentType: "application/json"}, shellQuote))
+
+	// errors
+	_, _, err = extractHeredocs([]byte("<<END -> ARGS Cron(bin/cron)\n-when x\n"))
+	assert.EqualError(t, err, "heredoc <<END: missing line END at the end")
+	nw = parseNetworkDefinition([]byte("'@file:missing.txt' -> CONF Router(bin/packet-router-header)\n"))
+	assert.NotNil(t, resolveIIPs(nw, dir, nil))
+}
+
+func TestPushConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowd-conf")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(saved string) { fifoDir = saved }(fifoDir)
+	fifoDir = dir
+	nw := &fbp.Fbp{Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	procs := Network{
+		"Filter#0": {Name: "Filter#0", Path: "bin/packet-filter-string", Metadata: map[string]string{confMetadata: confRuntime}},
+		"Display":  {Name: "Display", Path: "bin/display", Metadata: map[string]string{}},
+	}
+	plan, err := planInstance(procs["Filter#0"], nw)
+	assert.Nil(t, err)
+	assert.Equal(t, []PortPlan{{Port: "CONF", Inport: true, Path: filepath.Join(dir, "Filter#0.CONF")}}, plan.Ports)
+
+	// errors
+	assert.EqualError(t, pushConf(procs, nw, "Copy", "x"), "no such process: Copy")
+	assert.EqualError(t, pushConf(procs, nw, "Filter", "x"), "process Filter#0 is not running")
+	procs["Display"].Instance = &ComponentInstance{Cmd: &exec.Cmd{}}
+	assert.EqualError(t, pushConf(procs, nw, "Display", "x"), "process Display has no CONF inport - connect it or set process metadata conf=runtime")
+
+	// delivery to all instances
+	procs["Filter#0"].Instance = &ComponentInstance{Cmd: &exec.Cmd{}}
+	assert.Nil(t, syscall.Mkfifo(plan.Ports[0].Path, 0600))
+	received := make(chan *flowd.Frame)
+	go func() {
+		confPipe, err := os.Open(plan.Ports[0].Path)
+		assert.Nil(t, err)
+		defer confPipe.Close()
+		frame, err := flowd.Deserialize(bufio.NewReader(confPipe))
+		assert.Nil(t, err)
+		received <- frame
+	}()
+	assert.Nil(t, pushConf(procs, nw, "Filter", "-drop -or cron"))
+	frame := <-received
+	assert.Equal(t, "Conf", frame.BodyType)
+	assert.Equal(t, "-drop -or cron", string(frame.Body))
+
+	// over the online configuration server
+	_, err = handleNetworkConf(&JSONNetworkConf{Process: "Filter", Conf: "x"}, false)
+	assert.EqualError(t, err, "configuration push not enabled, see flag -olc-conf")
+	live = newLiveState(nw, procs)
+	defer func() { live = nil }()
+	respBytes, err := handleNetworkConf(&JSONNetworkConf{Graph: "filter", Process: "Copy", Conf: "x"}, true)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"graph": "filter", "process": "Copy", "success": false, "error": "no such process: Copy"}`, string(respBytes))
+}
+
+func TestShellTap(t *testing.T) {
+	tap := newLiveState(&fbp.Fbp{}, Network{}).portTap("Filter", "IN")
+	frames := tap.subscribe()
+	source := make(chan *flowd.Frame, 1)
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- mergeFrames([]chan *flowd.Frame{source}, bufio.NewWriter(&out), "IN", mergeArrival, nil, tap)
+	}()
+	assert.Nil(t, tap.send(&flowd.Frame{Type: "data", BodyType: "Shell", Body: []byte("injected\n")}))
+	source <- &flowd.Frame{Type: "data", BodyType: "Line", Extensions: map[string]string{"content-type": "text/plain"}, Body: []byte("up\x00stream")}
+	close(source)
+	assert.Nil(t, <-done)
+	tap.close()
+	assert.Contains(t, out.String(), "injected")
+	assert.Equal(t, "data Shell: injected", formatFrame(<-frames))
+	assert.Equal(t, `data Line content-type=text/plain: "up\x00stream"`, formatFrame(<-frames))
+	_, open := <-frames
+	assert.False(t, open, "tap should be closed once merging is done")
+	assert.EqualError(t, tap.send(&flowd.Frame{Type: "data"}), "port already closed")
+
+	command, rest := splitWord("  inject Filter.IN  @type=Line hello  world ")
+	assert.Equal(t, []string{"inject", "Filter.IN  @type=Line hello  world"}, []string{command, rest})
+}
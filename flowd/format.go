@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Canonical formatting of .fbp network definitions.
+
+Using -fmt, the given network definition files are rewritten in canonical form, or the network definition from STDIN
+is written to STDOUT. The canonical form is:
+
+	# header comment
+
+	INPORT=Filter.IN:NETIN
+	OUTPORT=Copy.OUT2:NETOUT
+
+	Copy(bin/copy)                              OUT1 -> IN Display(bin/display)
+	Filter(bin/packet-filter-string:replicas=2) OUT  -> IN Copy
+
+	'OUT1,OUT2'      -> ARGS Copy
+	'-pass -or sudo' -> ARGS Filter
+
+The network port declarations come first, then the connections and then the IIPs, each sorted by process and port
+name, with aligned arrows. Each process is declared with its component and metadata (sorted by key) where it is
+mentioned first. IIPs are in single quotes, except heredocs, which are kept as such after the other IIPs.
+
+NOTE: variables like ${NAME} are kept, but only where the parser allows their characters, eg. in IIPs.
+NOTE: the parser does not keep comments, so the comment block at the top is kept there and all other comments are
+moved to the end of the file, which has to be checked by the user.
+*/
+
+// unescapedQuote matches a single quote in IIP data which is not yet escaped
+var unescapedQuote = regexp.MustCompile(`(^|[^\\])'`)
+
+// formatNetwork returns the network definition in canonical form
+func formatNetwork(source []byte) []byte {
+	source, heredocs, err := extractHeredocs(source)
+	if err != nil {
+		fmt.Println("ERROR: parsing network definition:", err)
+		os.Exit(1)
+	}
+	nw := parseNetworkDefinition(source)
+	var out bytes.Buffer
+
+	// comments
+	header, comments := splitComments(source)
+	for _, line := range header {
+		out.WriteString(line + "\n")
+	}
+	section := func() {
+		if out.Len() > 0 {
+			out.WriteString("\n")
+		}
+	}
+
+	// network ports
+	if len(nw.Inports) > 0 || len(nw.Outports) > 0 {
+		section()
+		for _, name := range sortedEndpoints(nw.Inports) {
+			out.WriteString(fmt.Sprintf("INPORT=%s.%s:%s\n", nw.Inports[name].Process, generatePortName(nw.Inports[name]), name))
+		}
+		for _, name := range sortedEndpoints(nw.Outports) {
+			out.WriteString(fmt.Sprintf("OUTPORT=%s.%s:%s\n", nw.Outports[name].Process, generatePortName(nw.Outports[name]), name))
+		}
+	}
+
+	// processes are declared where mentioned first
+	processes := map[string]*fbp.Process{}
+	for _, proc := range nw.Processes {
+		processes[proc.Name] = proc
+	}
+	declared := map[string]bool{}
+	declare := func(name string) string {
+		proc := processes[name]
+		if declared[name] || proc == nil || proc.Component == "" {
+			return name
+		}
+		declared[name] = true
+		keys := []string{}
+		for key := range proc.Metadata {
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return fmt.Sprintf("%s(%s)", name, proc.Component)
+		}
+		sort.Strings(keys)
+		metadata := make([]string, len(keys))
+		for index, key := range keys {
+			metadata[index] = key + "=" + proc.Metadata[key]
+		}
+		return fmt.Sprintf("%s(%s:%s)", name, proc.Component, strings.Join(metadata, ","))
+	}
+
+	// connections and IIPs
+	connections, iips := []*fbp.Connection{}, []*fbp.Connection{}
+	for _, conn := range nw.Connections {
+		if conn.Source == nil {
+			iips = append(iips, conn)
+		} else {
+			connections = append(connections, conn)
+		}
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		if result := compareEndpoints(connections[i].Source, connections[j].Source); result != 0 {
+			return result < 0
+		}
+		return compareEndpoints(connections[i].Target, connections[j].Target) < 0
+	})
+	sort.SliceStable(iips, func(i, j int) bool { return compareEndpoints(iips[i].Target, iips[j].Target) < 0 })
+	if len(connections) > 0 {
+		section()
+		rows := make([][]string, len(connections))
+		for index, conn := range connections {
+			rows[index] = []string{declare(conn.Source.Process), generatePortName(conn.Source), generatePortName(conn.Target) + " " + declare(conn.Target.Process)}
+		}
+		writeAligned(&out, rows)
+	}
+	if len(iips) > 0 {
+		section()
+		rows := [][]string{}
+		for _, iip := range iips {
+			if heredocOf(iip.Data, heredocs) == nil {
+				rows = append(rows, []string{"'" + unescapedQuote.ReplaceAllString(iip.Data, `$1\'`) + "'", generatePortName(iip.Target) + " " + declare(iip.Target.Process)})
+			}
+		}
+		writeAligned(&out, rows)
+		for _, iip := range iips {
+			if heredoc := heredocOf(iip.Data, heredocs); heredoc != nil {
+				out.WriteString(fmt.Sprintf("<<%s -> %s %s\n", heredoc.Delimiter, generatePortName(iip.Target), declare(iip.Target.Process)))
+				if heredoc.Content != "" {
+					out.WriteString(heredoc.Content + "\n")
+				}
+				out.WriteString(heredoc.Delimiter + "\n")
+			}
+		}
+	}
+
+	// other comments
+	for _, block := range comments {
+		section()
+		for _, line := range block {
+			out.WriteString(line + "\n")
+		}
+	}
+
+	return out.Bytes()
+}
+
+// splitComments returns the comment block at the top, up to the first empty line or statement, and the other blocks of
+// comment lines of the network definition
+func splitComments(source []byte) (header []string, blocks [][]string) {
+	lines := strings.Split(strings.TrimSpace(string(source)), "\n")
+	index := 0
+	for ; index < len(lines); index++ {
+		line := strings.TrimSpace(lines[index])
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		header = append(header, line)
+	}
+	// NOTE: a comment block without statements after it is no header
+	if index == len(lines) {
+		header = nil
+		index = 0
+	}
+	var block []string
+	for ; index < len(lines); index++ {
+		line := strings.TrimSpace(lines[index])
+		if strings.HasPrefix(line, "#") {
+			block = append(block, line)
+			continue
+		}
+		if block != nil {
+			blocks = append(blocks, block)
+			block = nil
+		}
+	}
+	if block != nil {
+		blocks = append(blocks, block)
+	}
+	return header, blocks
+}
+
+// compareEndpoints orders endpoints by process name, port name and array port index
+func compareEndpoints(a *fbp.Endpoint, b *fbp.Endpoint) int {
+	if a.Process != b.Process {
+		return strings.Compare(a.Process, b.Process)
+	}
+	if a.Port != b.Port {
+		return strings.Compare(a.Port, b.Port)
+	}
+	switch {
+	case a.Index == nil && b.Index == nil:
+		return 0
+	case a.Index == nil:
+		return -1
+	case b.Index == nil:
+		return 1
+	}
+	return *a.Index - *b.Index
+}
+
+// writeAligned writes the rows with all but the last column padded, so that the arrows before the last column align
+func writeAligned(out *bytes.Buffer, rows [][]string) {
+	widths := []int{}
+	for _, row := range rows {
+		for column, text := range row[:len(row)-1] {
+			if column == len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(text) > widths[column] {
+				widths[column] = len(text)
+			}
+		}
+	}
+	for _, row := range rows {
+		for column, text := range row[:len(row)-1] {
+			if column > 0 {
+				out.WriteString(" ")
+			}
+			out.WriteString(fmt.Sprintf("%-*s", widths[column], text))
+		}
+		out.WriteString(" -> " + row[len(row)-1] + "\n")
+	}
+}
+
+// formatNetworkFile rewrites the network definition file in canonical form, returning whether it was changed
+func formatNetworkFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	formatted := formatNetwork(source)
+	if bytes.Equal(source, formatted) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(path, formatted, info.Mode())
+}
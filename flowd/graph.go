@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Graph export of networks in GraphViz DOT, Mermaid, D2 and JSON formats, optionally including the live state of the
+running network.
+
+Using -graph, the network definition is exported using the format given by -graph-format. A running network exports
+its graph including live state: the state of each process (waiting, running, exited or failed, for replicated
+processes the state of their instances combined) and for connections passing through flowd, the number of frames
+passed. These are merged inports, recorded connections and network ports, or all connections using -count-frames.
+The live graph is served over HTTP at /graph?format=FORMAT by the online configuration (-olc) and on the Unix
+socket given using -status-socket, which the daemon uses.
+*/
+
+// graph formats
+const (
+	graphDOT     = "dot"
+	graphMermaid = "mermaid"
+	graphD2      = "d2"
+	graphJSON    = "json"
+)
+
+// kinds of graph nodes
+const (
+	nodeProcess = "process"
+	nodeInport  = "inport"  // network inport
+	nodeOutport = "outport" // network outport
+	nodeIIP     = "iip"
+)
+
+// states of processes in the live graph
+const (
+	processWaiting = "waiting" // not yet started, eg. waiting for processes given in after=
+	processRunning = "running"
+	processExited  = "exited" // exited successfully
+	processFailed  = "failed" // could not be started or exited unsuccessfully
+)
+
+// Graph is the network as nodes and edges for export
+type Graph struct {
+	Nodes []*GraphNode    `json:"nodes"`
+	Edges []*GraphEdge    `json:"edges"`
+	State *GraphLiveState `json:"state,omitempty"` // only for a running network
+}
+
+// GraphNode is a process, network port or IIP
+type GraphNode struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"` // one of the node* constants above
+	Label     string `json:"label"`
+	Component string `json:"component,omitempty"`
+	Replicas  int    `json:"replicas,omitempty"`
+	Host      string `json:"host,omitempty"`
+	State     string `json:"state,omitempty"` // live: one of the process* constants above
+}
+
+// GraphEdge is a connection between nodes
+type GraphEdge struct {
+	From     string `json:"from"`
+	FromPort string `json:"fromPort,omitempty"`
+	To       string `json:"to"`
+	ToPort   string `json:"toPort,omitempty"`
+	Frames   *int64 `json:"frames,omitempty"` // live: frames passed, only for connections passing through flowd
+	key      string // connection key for frame counting, see connectionKey()
+}
+
+// GraphLiveState is the state of the running network as a whole
+type GraphLiveState struct {
+	Started time.Time `json:"started"`
+	Ready   bool      `json:"ready"`
+}
+
+// buildGraph converts the network definition into nodes and edges, in definition order resp. sorted by name
+func buildGraph(nw *fbp.Fbp) *Graph {
+	graph := &Graph{Nodes: []*GraphNode{}, Edges: []*GraphEdge{}}
+	inports, outports := sortedEndpoints(nw.Inports), sortedEndpoints(nw.Outports)
+	// nodes
+	for _, name := range inports {
+		graph.Nodes = append(graph.Nodes, &GraphNode{ID: "in_" + name, Kind: nodeInport, Label: name})
+	}
+	for index, conn := range nw.Connections {
+		if conn.Source == nil {
+			graph.Nodes = append(graph.Nodes, &GraphNode{ID: fmt.Sprintf("iip%d", index), Kind: nodeIIP, Label: "'" + conn.Data + "'"})
+		}
+	}
+	for _, process := range nw.Processes {
+		node := &GraphNode{ID: process.Name, Kind: nodeProcess, Label: process.Name, Component: process.Component, Host: process.Metadata[hostMetadata]}
+		if replicas, err := strconv.Atoi(process.Metadata[replicasMetadata]); err == nil && replicas > 1 {
+			node.Replicas = replicas
+		}
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	for _, name := range outports {
+		graph.Nodes = append(graph.Nodes, &GraphNode{ID: "out_" + name, Kind: nodeOutport, Label: name})
+	}
+	// edges
+	for _, name := range inports {
+		endpoint := nw.Inports[name]
+		graph.Edges = append(graph.Edges, &GraphEdge{From: "in_" + name, To: endpoint.Process, ToPort: generatePortName(endpoint), key: netPortKey("NETIN", name)})
+	}
+	for index, conn := range nw.Connections {
+		if conn.Source == nil {
+			graph.Edges = append(graph.Edges, &GraphEdge{From: fmt.Sprintf("iip%d", index), To: conn.Target.Process, ToPort: generatePortName(conn.Target)})
+			continue
+		}
+		fromPort, toPort := generatePortName(conn.Source), generatePortName(conn.Target)
+		graph.Edges = append(graph.Edges, &GraphEdge{From: conn.Source.Process, FromPort: fromPort, To: conn.Target.Process, ToPort: toPort, key: connectionKey(conn.Source.Process, fromPort, conn.Target.Process, toPort)})
+	}
+	for _, name := range outports {
+		endpoint := nw.Outports[name]
+		graph.Edges = append(graph.Edges, &GraphEdge{From: endpoint.Process, FromPort: generatePortName(endpoint), To: "out_" + name, key: netPortKey("NETOUT", name)})
+	}
+	return graph
+}
+
+func sortedEndpoints(endpoints map[string]*fbp.Endpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// connectionKey identifies a connection between processes for frame counting
+func connectionKey(fromProc string, fromPort string, toProc string, toPort string) string {
+	return fromProc + "." + fromPort + " -> " + toProc + "." + toPort
+}
+
+// netPortKey identifies the connection of a network port for frame counting, given as NETIN resp. NETOUT
+func netPortKey(direction string, port string) string {
+	return direction + "." + port
+}
+
+// exportNetworkGraph writes the graph of the network definition in the given format to STDOUT
+func exportNetworkGraph(nw *fbp.Fbp, format string) error {
+	out := bufio.NewWriter(os.Stdout)
+	if err := writeGraph(out, buildGraph(nw), format); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writeGraph renders the graph in the given format
+func writeGraph(w io.Writer, graph *Graph, format string) error {
+	switch format {
+	case graphDOT:
+		return writeDOT(w, graph)
+	case graphMermaid:
+		return writeMermaid(w, graph)
+	case graphD2:
+		return writeD2(w, graph)
+	case graphJSON:
+		data, err := json.MarshalIndent(graph, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	default:
+		return fmt.Errorf("unknown graph format '%s' - expected %s, %s, %s or %s", format, graphDOT, graphMermaid, graphD2, graphJSON)
+	}
+}
+
+// processLabel returns the display name of a process node, including replicas and host
+func processLabel(node *GraphNode) string {
+	label := node.Label
+	if node.Replicas > 1 {
+		// launched as multiple instances, see replicate.go
+		label = fmt.Sprintf("%s%s0..%d", label, replicaSeparator, node.Replicas-1)
+	}
+	if node.Host != "" {
+		label += " @ " + node.Host
+	}
+	return label
+}
+
+// edgeLabel returns the ports and frame count of a connection for display
+func edgeLabel(edge *GraphEdge) string {
+	label := edge.FromPort
+	switch {
+	case edge.FromPort != "" && edge.ToPort != "":
+		label += " → " + edge.ToPort
+	case edge.ToPort != "":
+		label = edge.ToPort
+	}
+	if edge.Frames != nil {
+		label += " (" + framesLabel(*edge.Frames) + ")"
+	}
+	return label
+}
+
+func framesLabel(frames int64) string {
+	if frames == 1 {
+		return "1 frame"
+	}
+	return fmt.Sprintf("%d frames", frames)
+}
+
+// stateColors are the fill colors for process states
+var stateColors = map[string]string{
+	processWaiting: "#fff3b0",
+	processRunning: "#b8f0b8",
+	processExited:  "#dddddd",
+	processFailed:  "#f7b0b0",
+}
+
+var mermaidIDPattern = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// writeMermaid renders the graph as Mermaid flowchart
+func writeMermaid(w io.Writer, graph *Graph) error {
+	id := func(nodeID string) string {
+		return mermaidIDPattern.ReplaceAllString(nodeID, "_")
+	}
+	quote := func(text string) string {
+		return `"` + strings.Replace(text, `"`, "#quot;", -1) + `"`
+	}
+	var out strings.Builder
+	out.WriteString("flowchart LR\n")
+	for _, node := range graph.Nodes {
+		switch node.Kind {
+		case nodeInport:
+			fmt.Fprintf(&out, "\t%s>%s]\n", id(node.ID), quote(node.Label))
+		case nodeOutport:
+			fmt.Fprintf(&out, "\t%s[/%s/]\n", id(node.ID), quote(node.Label))
+		case nodeIIP:
+			fmt.Fprintf(&out, "\t%s[[%s]]\n", id(node.ID), quote(node.Label))
+		default:
+			label := processLabel(node)
+			if node.State != "" {
+				label += "<br/>" + node.State
+			}
+			fmt.Fprintf(&out, "\t%s(%s)\n", id(node.ID), quote(label))
+		}
+	}
+	for _, edge := range graph.Edges {
+		if label := edgeLabel(edge); label != "" {
+			fmt.Fprintf(&out, "\t%s -->|%s| %s\n", id(edge.From), quote(label), id(edge.To))
+		} else {
+			fmt.Fprintf(&out, "\t%s --> %s\n", id(edge.From), id(edge.To))
+		}
+	}
+	// live state
+	states := []string{}
+	for state := range stateColors {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		nodes := []string{}
+		for _, node := range graph.Nodes {
+			if node.State == state {
+				nodes = append(nodes, id(node.ID))
+			}
+		}
+		if len(nodes) > 0 {
+			fmt.Fprintf(&out, "\tclassDef %s fill:%s\n\tclass %s %s\n", state, stateColors[state], strings.Join(nodes, ","), state)
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// writeD2 renders the graph as D2 diagram
+func writeD2(w io.Writer, graph *Graph) error {
+	quote := func(text string) string {
+		return strconv.Quote(text)
+	}
+	shapes := map[string]string{nodeProcess: "rectangle", nodeInport: "step", nodeOutport: "step", nodeIIP: "page"}
+	var out strings.Builder
+	out.WriteString("direction: right\n")
+	for _, node := range graph.Nodes {
+		label := node.Label
+		if node.Kind == nodeProcess {
+			label = processLabel(node)
+			if node.State != "" {
+				label += "\n" + node.State
+			}
+		}
+		fmt.Fprintf(&out, "%s: %s {\n\tshape: %s\n", quote(node.ID), quote(label), shapes[node.Kind])
+		if node.Replicas > 1 {
+			out.WriteString("\tstyle.multiple: true\n")
+		}
+		if color, found := stateColors[node.State]; found {
+			fmt.Fprintf(&out, "\tstyle.fill: %s\n", quote(color))
+		}
+		out.WriteString("}\n")
+	}
+	for _, edge := range graph.Edges {
+		if label := edgeLabel(edge); label != "" {
+			fmt.Fprintf(&out, "%s -> %s: %s\n", quote(edge.From), quote(edge.To), quote(label))
+		} else {
+			fmt.Fprintf(&out, "%s -> %s\n", quote(edge.From), quote(edge.To))
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// liveState holds the state of the running network for the live graph
+type liveState struct {
+	nw        *fbp.Fbp
+	procs     Network
+	started   time.Time
+	mutex     sync.Mutex
+	processes map[string]string   // process name -> one of the process* constants
+	frames    map[string]*uint64  // connection key -> frames passed through flowd
+	taps      map[string]*portTap // PROCESS.PORT -> tap of inports passing through flowd, see shell.go
+}
+
+// live is the state of the running network, nil if not running
+var live *liveState
+
+func newLiveState(nw *fbp.Fbp, procs Network) *liveState {
+	l := &liveState{nw: nw, procs: procs, started: time.Now(), processes: map[string]string{}, frames: map[string]*uint64{}, taps: map[string]*portTap{}}
+	for name := range procs {
+		l.processes[name] = processWaiting
+	}
+	return l
+}
+
+// setProcessState records the state of a process
+func (l *liveState) setProcessState(name string, state string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.processes[name] = state
+}
+
+// frameCounter returns the counter for the frames passed on the connection, nil if counted elsewhere already
+// NOTE: eg. a network inport bound to a socket and merged with other upstreams passes flowd twice
+func (l *liveState) frameCounter(key string) *uint64 {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, found := l.frames[key]; found {
+		return nil
+	}
+	counter := new(uint64)
+	l.frames[key] = counter
+	return counter
+}
+
+// countFrame counts one frame on a connection, if counted at all
+func countFrame(counter *uint64) {
+	if counter != nil {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// graph returns the graph of the running network including the live state
+// NOTE: states of replicas PROC#N are combined into the state of PROC, frames on connections of replicas are summed up
+func (l *liveState) graph() *Graph {
+	graph := buildGraph(l.nw)
+	ready, _ := startup.isReady()
+	graph.State = &GraphLiveState{Started: l.started, Ready: ready}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// processes
+	states := map[string]map[string]int{} // process name -> state -> number of instances
+	for name, state := range l.processes {
+		name = strings.SplitN(name, replicaSeparator, 2)[0]
+		if states[name] == nil {
+			states[name] = map[string]int{}
+		}
+		states[name][state]++
+	}
+	for _, node := range graph.Nodes {
+		if node.Kind != nodeProcess || states[node.ID] == nil {
+			continue
+		}
+		// NOTE: a replicated process is running as long as any instance runs, failed if any instance failed
+		for _, state := range []string{processRunning, processWaiting, processFailed, processExited} {
+			if states[node.ID][state] > 0 {
+				node.State = state
+				break
+			}
+		}
+	}
+	// frame counts
+	counts := map[string]uint64{}
+	for key, counter := range l.frames {
+		counts[replicaConnectionKey(key)] += atomic.LoadUint64(counter)
+	}
+	for _, edge := range graph.Edges {
+		if count, found := counts[edge.key]; found && edge.key != "" {
+			frames := int64(count)
+			edge.Frames = &frames
+		}
+	}
+	return graph
+}
+
+var replicaPattern = regexp.MustCompile(replicaSeparator + `[0-9a-z]+\.`)
+
+// replicaConnectionKey returns the connection key as in the network definition, without replica suffixes
+func replicaConnectionKey(key string) string {
+	return replicaPattern.ReplaceAllString(key, ".")
+}
+
+// serveGraph responds with the live graph in the format given as query parameter, default DOT
+func serveGraph(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = graphDOT
+	}
+	if live == nil || live.nw == nil || len(live.nw.Processes) == 0 {
+		http.Error(w, "graph unavailable: network not running or not in .fbp format", http.StatusServiceUnavailable)
+		return
+	}
+	var out strings.Builder
+	if err := writeGraph(&out, live.graph(), format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == graphJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	io.WriteString(w, out.String())
+}
+
+// serveStatusSocket serves the live graph, configuration of processes and the shell API over HTTP on a Unix socket
+func serveStatusSocket(path string) error {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// NOTE: the shell API can stop processes and inject frames, so only for the user running flowd
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graph", serveGraph)
+	mux.HandleFunc("/conf", serveConf)
+	mux.HandleFunc("/processes", serveProcesses)
+	mux.HandleFunc("/inject", serveInject)
+	mux.HandleFunc("/tap", serveTap)
+	mux.HandleFunc("/process", serveProcess)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Println("ERROR: serving status socket:", err)
+		}
+	}()
+	return nil
+}
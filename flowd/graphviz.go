@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
+	"io"
 	"strings"
-
-	"github.com/oleksandr/fbp"
 )
 
-func exportNetworkGraph(nw *fbp.Fbp) error {
-	out := bufio.NewWriter(os.Stdout)
+// writeDOT renders the graph in GraphViz format
+func writeDOT(w io.Writer, graph *Graph) error {
+	var out strings.Builder
+	// NOTE: Replace() is a simple one-level escape of " with literial \"
+	quote := func(text string) string {
+		return "\"" + strings.Replace(text, "\"", "\\\"", -1) + "\""
+	}
 
 	out.WriteString("digraph {\n" +
 		"\tnodesep=1.2;\n" +
@@ -23,65 +25,63 @@ func exportNetworkGraph(nw *fbp.Fbp) error {
 		"\tsubgraph cluster_netin {\n" +
 		"\t\tlabel=\"Imported Ports\";\n")
 	// network in ports
-	for netinPort := range nw.Inports {
-		out.WriteString(fmt.Sprintf("\t\t%s [shape=rarrow];\n", netinPort))
+	for _, node := range graph.Nodes {
+		if node.Kind == nodeInport {
+			out.WriteString(fmt.Sprintf("\t\t%s [shape=rarrow,label=%s];\n", quote(node.ID), quote(node.Label)))
+		}
 	}
 	out.WriteString("\t}\n" +
 		"\n" +
 		"\tsubgraph cluster_netout {\n" +
 		"\t\tlabel=\"Exported Ports\";\n")
 	// network out ports
-	for netoutPort := range nw.Outports {
-		out.WriteString(fmt.Sprintf("\t\t%s [shape=larrow];\n", netoutPort))
+	for _, node := range graph.Nodes {
+		if node.Kind == nodeOutport {
+			out.WriteString(fmt.Sprintf("\t\t%s [shape=larrow,label=%s];\n", quote(node.ID), quote(node.Label)))
+		}
 	}
 	out.WriteString("\t}\n" +
 		"\n" +
 		"\tsubgraph cluster_netmain {\n" +
 		"\t\tlabel=\"Network\";" +
 		"\t\tmargin=25;\n")
-	// all nodes/vertices = processes, netin ports, netout ports and IIPs  //TODO
-	for netinPort := range nw.Inports {
-		out.WriteString(fmt.Sprintf("\t\t%s;\n", netinPort))
-	}
-	for index, conn := range nw.Connections {
-		if conn.Source == nil {
-			// is an IIP, use index as name
-			//TODO maybe start own IIP index number
-			// NOTE: Replace() is a simple one-level escape of " with literial \"
-			out.WriteString(fmt.Sprintf("\t\tIIP%d [label=\"'%s'\",shape=note];\n", index, strings.Replace(conn.Data, "\"", "\\\"", -1)))
+	// all nodes/vertices = processes and IIPs
+	for _, node := range graph.Nodes {
+		switch node.Kind {
+		case nodeIIP:
+			out.WriteString(fmt.Sprintf("\t\t%s [label=%s,shape=note];\n", quote(node.ID), quote(node.Label)))
+		case nodeProcess:
+			attributes := "shape=component,style=rounded"
+			if node.Replicas > 1 {
+				attributes += ",peripheries=2"
+			}
+			label := processLabel(node)
+			if node.State != "" {
+				// live state of the running network
+				label += "\n" + node.State
+				attributes = strings.Replace(attributes, "style=rounded", "style=\"rounded,filled\"", 1) + ",fillcolor=" + quote(stateColors[node.State])
+			}
+			out.WriteString(fmt.Sprintf("\t\t%s [%s,label=%s];\n", quote(node.ID), attributes, quote(label)))
 		}
 	}
-	for _, process := range nw.Processes {
-		out.WriteString(fmt.Sprintf("\t\t%s [shape=component,style=rounded];\n", process.Name))
-	}
-	for netoutPort := range nw.Outports {
-		out.WriteString(fmt.Sprintf("\t\t%s;\n", netoutPort))
-	}
 	out.WriteString("\t}\n" +
 		"\n")
-	// all edges = connections from netin ports, to netout ports, between processen and from IIPs
-	for netinPort, conn := range nw.Inports {
-		out.WriteString(fmt.Sprintf("\t%s -> %s [headlabel=\"%s\"];\n", netinPort, conn.Process, conn.Port))
-	}
-	for index, conn := range nw.Connections {
-		toProcess := conn.Target.Process
-		toPort := conn.Target.Port
-		if conn.Source == nil {
-			// connection from IIP to process
-			fromProcess := fmt.Sprintf("IIP%d", index)
-			out.WriteString(fmt.Sprintf("\t%s -> %s [shape=rect,headlabel=\"%s\"];\n", fromProcess, toProcess, toPort))
-		} else {
-			// regular connection between processes
-			fromProcess := conn.Source.Process
-			fromPort := conn.Source.Port
-			out.WriteString(fmt.Sprintf("\t%s -> %s [taillabel=\"%s\",headlabel=\"%s\"];\n", fromProcess, toProcess, fromPort, toPort))
+	// all edges = connections from netin ports, to netout ports, between processes and from IIPs
+	for _, edge := range graph.Edges {
+		attributes := []string{}
+		if edge.FromPort != "" {
+			attributes = append(attributes, "taillabel="+quote(edge.FromPort))
 		}
+		if edge.ToPort != "" {
+			attributes = append(attributes, "headlabel="+quote(edge.ToPort))
+		}
+		if edge.Frames != nil {
+			attributes = append(attributes, "label="+quote(framesLabel(*edge.Frames)))
+		}
+		out.WriteString(fmt.Sprintf("\t%s -> %s [%s];\n", quote(edge.From), quote(edge.To), strings.Join(attributes, ",")))
 	}
-	for netoutPort, conn := range nw.Outports {
-		out.WriteString(fmt.Sprintf("\t%s -> %s [taillabel=\"%s\"];\n", conn.Process, netoutPort, conn.Port))
-	}
-	out.WriteString("}")
+	out.WriteString("}\n")
 
-	_ = out.Flush()
-	return nil
+	_, err := io.WriteString(w, out.String())
+	return err
 }
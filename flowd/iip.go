@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+IIP content from files and heredocs, and typed IIPs.
+
+Instead of in single quotes, the IIP data can be read from a file, relative to the network definition and without
+its final line break:
+
+	'@file:routes.json' -> CONF Router(bin/packet-router-header)
+
+In .fbp and free-form network definitions, multi-line IIP data can be given heredoc-style, up to the line consisting
+only of the delimiter:
+
+	<<END -> ARGS Cron(bin/cron)
+	-when "0 * * * *" HOURLY
+	-when "@daily" DAILY
+	END
+
+IIPs are delivered as frames of body type IIP. Options at the start of the IIP data, separated by a blank or line
+break, set the body type and a content-type header, so that components can tell formats apart and decode them
+using flowd.DecodeIIP:
+
+	'@type=RoutingTable @content-type=application/json @file:routes.json' -> CONF Router
+
+IIP data starting with @@ is taken literally without the first @. Options for IIPs to ARGS are ignored, since these
+become program arguments.
+
+NOTE: variables like ${NAME} are substituted in heredocs, but not in IIP files.
+*/
+
+const (
+	iipFilePrefix = "@file:"
+	heredocMarker = "\x00heredoc:" // replaces a heredoc in the network definition until resolveIIPs()
+)
+
+// iipOptions are the options which can be given at the start of the IIP data
+var iipOptions = map[string]bool{"type": true, "content-type": true}
+
+// heredocPattern matches the start of a heredoc like <<END
+var heredocPattern = regexp.MustCompile(`^<<([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Heredoc is multi-line IIP data given in the network definition
+type Heredoc struct {
+	Delimiter string
+	Content   string
+}
+
+// extractHeredocs replaces the heredocs in the network definition by markers, keeping the line numbers intact
+func extractHeredocs(source []byte) ([]byte, []Heredoc, error) {
+	lines := strings.Split(string(source), "\n")
+	heredocs := []Heredoc{}
+	for index := 0; index < len(lines); index++ {
+		// find heredocs outside IIPs and comments
+		line := lines[index]
+		started := []int{}
+		inIIP := false
+	scan:
+		for position := 0; position < len(line); position++ {
+			switch {
+			case inIIP && line[position] == '\\':
+				position++
+			case line[position] == '\'':
+				inIIP = !inIIP
+			case inIIP:
+			case line[position] == '#':
+				break scan
+			case heredocPattern.MatchString(line[position:]):
+				match := heredocPattern.FindStringSubmatch(line[position:])
+				marker := fmt.Sprintf("'%s%d'", heredocMarker, len(heredocs))
+				line = line[:position] + marker + line[position+len(match[0]):]
+				position += len(marker) - 1
+				started = append(started, len(heredocs))
+				heredocs = append(heredocs, Heredoc{Delimiter: match[1]})
+			}
+		}
+		lines[index] = line
+		// their content follows in order
+		for _, heredoc := range started {
+			content := []string{}
+			for {
+				index++
+				if index == len(lines) {
+					return nil, nil, fmt.Errorf("heredoc <<%s: missing line %s at the end", heredocs[heredoc].Delimiter, heredocs[heredoc].Delimiter)
+				}
+				if strings.TrimSpace(lines[index]) == heredocs[heredoc].Delimiter {
+					lines[index] = ""
+					break
+				}
+				content = append(content, lines[index])
+				lines[index] = ""
+			}
+			heredocs[heredoc].Content = strings.Join(content, "\n")
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), heredocs, nil
+}
+
+// heredocOf returns the heredoc replaced by the marker in the IIP data, nil if none
+func heredocOf(data string, heredocs []Heredoc) *Heredoc {
+	if !strings.HasPrefix(data, heredocMarker) {
+		return nil
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(data, heredocMarker))
+	if err != nil || index < 0 || index >= len(heredocs) {
+		return nil
+	}
+	return &heredocs[index]
+}
+
+// resolveIIPs puts the IIP data given as heredoc or file into the IIPs of the network; files are relative to baseDir
+func resolveIIPs(nw *fbp.Fbp, baseDir string, heredocs []Heredoc) error {
+	for _, conn := range nw.Connections {
+		if conn.Source != nil {
+			continue
+		}
+		data, resolved := conn.Data, false
+		if heredoc := heredocOf(data, heredocs); heredoc != nil {
+			data, resolved = heredoc.Content, true
+		}
+		options, body := splitIIPOptions(data)
+		if strings.HasPrefix(body, iipFilePrefix) {
+			path := strings.TrimPrefix(body, iipFilePrefix)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("IIP to %s.%s: %s", conn.Target.Process, generatePortName(conn.Target), err)
+			}
+			body, resolved = escapeIIPData(strings.TrimSuffix(string(content), "\n")), true
+		}
+		if resolved {
+			conn.Data = joinIIPOptions(options, body)
+		}
+	}
+	return nil
+}
+
+// splitIIPOptions returns the options at the start of the IIP data and the rest, which is still escaped
+func splitIIPOptions(data string) (options map[string]string, body string) {
+	options = map[string]string{}
+	for strings.HasPrefix(data, "@") && !strings.HasPrefix(data, "@@") {
+		token, rest := data, ""
+		if end := strings.IndexAny(data, " \t\n"); end != -1 {
+			token, rest = data[:end], data[end+1:]
+		}
+		parts := strings.SplitN(token[1:], "=", 2)
+		if len(parts) != 2 || !iipOptions[parts[0]] {
+			break
+		}
+		options[parts[0]] = parts[1]
+		data = rest
+	}
+	return options, data
+}
+
+// joinIIPOptions returns the IIP data with the given options at the start
+func joinIIPOptions(options map[string]string, body string) string {
+	keys := []string{}
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	prefix := ""
+	for _, key := range keys {
+		prefix += "@" + key + "=" + options[key] + " "
+	}
+	return prefix + body
+}
+
+// escapeIIPData escapes IIP data starting with @, so that it is not taken as option or file
+func escapeIIPData(data string) string {
+	if strings.HasPrefix(data, "@") {
+		return "@" + data
+	}
+	return data
+}
+
+// newIIP returns the IIP for the given port with options and escaping of the IIP data applied
+func newIIP(port string, data string) IIP {
+	options, body := splitIIPOptions(data)
+	if strings.HasPrefix(body, "@@") {
+		body = body[1:]
+	}
+	return IIP{Port: port, Data: body, BodyType: options["type"], ContentType: options["content-type"]}
+}
+
+// iipPrintf returns the shell command writing the IIP as frame like flowd sends it, see framing format
+func iipPrintf(iip IIPPlan, quote func(word string) string) string {
+	if iip.BodyType == "" && iip.ContentType == "" {
+		return fmt.Sprintf("printf '2data\\ntype:IIP\\nlength:%%d\\n\\n%%s\\000' %d %s", len(iip.Data), quote(iip.Data))
+	}
+	format, args := "2data\\ntype:%s\\n", []string{quote(iipBodyType(iip.BodyType))}
+	if iip.ContentType != "" {
+		format += "content-type:%s\\n"
+		args = append(args, quote(iip.ContentType))
+	}
+	args = append(args, strconv.Itoa(len(iip.Data)), quote(iip.Data))
+	return fmt.Sprintf("printf '%slength:%%d\\n\\n%%s\\000' %s", format, strings.Join(args, " "))
+}
+
+// iipBodyType returns the body type of the IIP frame, IIP by default
+func iipBodyType(bodyType string) string {
+	if bodyType == "" {
+		return "IIP"
+	}
+	return bodyType
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Includes resp. compile-time sub-networks.
+
+A process with the pseudo-component "include" is replaced by the network definition given in its ARGS IIP:
+
+	Reader(bin/file-read) OUT -> IN Filter(include) OUT -> IN Display(bin/display)
+	'subnet_inner.fbp' -> ARGS Filter
+
+The processes of the included network are renamed to Filter_<process>, connections to the ports of the include process are
+connected to the processes behind the INPORT and OUTPORT declarations of the included network. Unlike a sub-network running
+in its own bin/flowd process, this results in one flat network. Paths are relative to the including network definition file.
+*/
+
+const includeComponent = "include"
+
+// inlineIncludes replaces all include processes in the network by the included network definitions, recursively
+func inlineIncludes(nw *fbp.Fbp, baseDir string, paramSets []map[string]string, including []string) error {
+	for _, proc := range nw.Processes {
+		if proc.Component != includeComponent {
+			continue
+		}
+		// find path of included network definition
+		path := ""
+		for _, conn := range nw.Connections {
+			if conn.Source == nil && conn.Target != nil && conn.Target.Process == proc.Name && conn.Target.Port == "ARGS" {
+				path = conn.Data
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("include %s: missing IIP with network definition path to ARGS", proc.Name)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		for _, includingPath := range including {
+			if includingPath == path {
+				return fmt.Errorf("include %s: %s includes itself", proc.Name, path)
+			}
+		}
+		if debug {
+			fmt.Println("including network definition", path, "as", proc.Name)
+		}
+		// load, parse and resolve nested includes
+		nwBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("include %s: %s", proc.Name, err)
+		}
+		if nwBytes, err = substituteParams(nwBytes, paramSets...); err != nil {
+			return fmt.Errorf("include %s: %s", proc.Name, err)
+		}
+		inner := parseNetwork(nwBytes, path)
+		if err = inlineIncludes(inner, filepath.Dir(path), paramSets, append(including, path)); err != nil {
+			return fmt.Errorf("include %s: %s", proc.Name, err)
+		}
+		if err = inlineNetwork(nw, proc.Name, inner); err != nil {
+			return err
+		}
+		// NOTE: list of processes was changed, start over
+		return inlineIncludes(nw, baseDir, paramSets, including)
+	}
+	return nil
+}
+
+// inlineNetwork replaces the process of the given name by the processes and connections of the inner network
+func inlineNetwork(nw *fbp.Fbp, procName string, inner *fbp.Fbp) error {
+	prefix := procName + "_"
+	// replace process by inner processes
+	processes := []*fbp.Process{}
+	for _, proc := range nw.Processes {
+		if proc.Name != procName {
+			processes = append(processes, proc)
+			continue
+		}
+		for _, innerProc := range inner.Processes {
+			processes = append(processes, &fbp.Process{
+				Name:      prefix + innerProc.Name,
+				Component: innerProc.Component,
+				Metadata:  innerProc.Metadata,
+			})
+		}
+	}
+	nw.Processes = processes
+
+	// map connections to and from the include process to the inner network ports
+	connections := []*fbp.Connection{}
+	for _, conn := range nw.Connections {
+		if conn.Source == nil && conn.Target != nil && conn.Target.Process == procName && conn.Target.Port == "ARGS" {
+			// path of included network definition
+			continue
+		}
+		if conn.Target != nil && conn.Target.Process == procName {
+			target, err := mapIncludePort(conn.Target, inner.Inports, prefix)
+			if err != nil {
+				return fmt.Errorf("include %s: connection %s: %s", procName, conn.String(), err)
+			}
+			conn.Target = target
+		}
+		if conn.Source != nil && conn.Source.Process == procName {
+			source, err := mapIncludePort(conn.Source, inner.Outports, prefix)
+			if err != nil {
+				return fmt.Errorf("include %s: connection %s: %s", procName, conn.String(), err)
+			}
+			conn.Source = source
+		}
+		connections = append(connections, conn)
+	}
+	// add inner connections
+	for _, conn := range inner.Connections {
+		innerConn := &fbp.Connection{Data: conn.Data}
+		if conn.Source != nil {
+			innerConn.Source = &fbp.Endpoint{Process: prefix + conn.Source.Process, Port: conn.Source.Port, Index: conn.Source.Index}
+		}
+		if conn.Target != nil {
+			innerConn.Target = &fbp.Endpoint{Process: prefix + conn.Target.Process, Port: conn.Target.Port, Index: conn.Target.Index}
+		}
+		connections = append(connections, innerConn)
+	}
+	nw.Connections = connections
+
+	// map network ports of the outer network
+	for name, endpoint := range nw.Inports {
+		if endpoint.Process == procName {
+			mapped, err := mapIncludePort(endpoint, inner.Inports, prefix)
+			if err != nil {
+				return fmt.Errorf("include %s: network inport %s: %s", procName, name, err)
+			}
+			nw.Inports[name] = mapped
+		}
+	}
+	for name, endpoint := range nw.Outports {
+		if endpoint.Process == procName {
+			mapped, err := mapIncludePort(endpoint, inner.Outports, prefix)
+			if err != nil {
+				return fmt.Errorf("include %s: network outport %s: %s", procName, name, err)
+			}
+			nw.Outports[name] = mapped
+		}
+	}
+	return nil
+}
+
+// mapIncludePort returns the inner endpoint behind the network port of an included network
+func mapIncludePort(endpoint *fbp.Endpoint, netPorts map[string]*fbp.Endpoint, prefix string) (*fbp.Endpoint, error) {
+	innerEndpoint, exists := netPorts[endpoint.Port]
+	if !exists {
+		return nil, fmt.Errorf("included network has no network port %s", endpoint.Port)
+	}
+	mapped := &fbp.Endpoint{Process: prefix + innerEndpoint.Process, Port: innerEndpoint.Port, Index: innerEndpoint.Index}
+	if mapped.Index == nil {
+		mapped.Index = endpoint.Index
+	}
+	return mapped, nil
+}
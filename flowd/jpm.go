@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Parser for J. Paul Morrison's free-form network notation, as used by JavaFBP, JSFBP and parsefbp.
+
+The notation is selected using -notation jpm or by the file extension .jpm, otherwise the NoFlo-style .fbp notation
+is used. It differs from the NoFlo-style notation in that:
+
+* connections are separated by "," or ";" and may span multiple lines, eg. breaking after an arrow
+* a line break ends a connection only if it is complete, ie. after a process
+* process names and component names can be given in double quotes, allowing blanks, dots and other characters:
+  "Read Masters"("com.jpaulmorrison.fbp.core.components.io.ReadFile")
+* a capacity given after the arrow like OUT -> (20) IN is accepted and ignored, since named pipes have a fixed capacity
+* "*" is the automatic port: A * -> * B starts process B once process A has exited
+
+Like in .fbp network definitions, "#" starts a comment, IIPs are given in single quotes, component metadata can be
+given after the component as in Read(bin/file-read:ready=signal) and network ports are declared using
+INPORT=PROCESS.PORT:NAME and OUTPORT=PROCESS.PORT:NAME.
+
+NOTE: automatic ports are supported only between each other, which becomes after=A on B and ready=exit on A.
+*/
+
+const (
+	jpmExtension  = ".jpm"
+	automaticPort = "*"
+)
+
+// token types of the free-form notation
+const (
+	jpmName      = iota // process name, port name or network port declaration
+	jpmQuoted           // process name in double quotes
+	jpmIIP              // IIP data in single quotes
+	jpmComponent        // component and metadata in parentheses, or connection capacity
+	jpmArrow
+	jpmSeparator // "," or ";"
+	jpmNewline
+)
+
+type jpmToken struct {
+	kind int
+	text string
+	line int
+}
+
+var (
+	jpmPortPattern    = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_\-]*)(\[([0-9]+)\])?$`)
+	jpmNetPortPattern = regexp.MustCompile(`^(INPORT|OUTPORT)=(.+)\.([A-Za-z_][A-Za-z0-9_\-]*(\[[0-9]+\])?):([A-Za-z0-9_]+)$`)
+)
+
+// tokenizeJPM splits the network definition into tokens
+func tokenizeJPM(source string) ([]jpmToken, error) {
+	tokens := []jpmToken{}
+	line := 1
+	for index := 0; index < len(source); {
+		char := source[index]
+		switch {
+		case char == '\n':
+			tokens = append(tokens, jpmToken{jpmNewline, "", line})
+			line++
+			index++
+		case char == ' ' || char == '\t' || char == '\r':
+			index++
+		case char == '#':
+			for index < len(source) && source[index] != '\n' {
+				index++
+			}
+		case char == ',' || char == ';':
+			tokens = append(tokens, jpmToken{jpmSeparator, string(char), line})
+			index++
+		case strings.HasPrefix(source[index:], "->"):
+			tokens = append(tokens, jpmToken{jpmArrow, "->", line})
+			index += 2
+		case char == '\'' || char == '"':
+			// quoted, with backslash escaping the quote character
+			var text strings.Builder
+			start := line
+			index++
+			for ; index < len(source) && source[index] != char; index++ {
+				if source[index] == '\\' && index+1 < len(source) && source[index+1] == char {
+					index++
+				} else if source[index] == '\n' {
+					line++
+				}
+				text.WriteByte(source[index])
+			}
+			if index == len(source) {
+				return nil, fmt.Errorf("line %d: unterminated quote %c", start, char)
+			}
+			index++
+			kind := jpmQuoted
+			if char == '\'' {
+				kind = jpmIIP
+			}
+			tokens = append(tokens, jpmToken{kind, text.String(), start})
+		case char == '(':
+			// NOTE: may contain a quoted component name with parentheses
+			end, quoted := index+1, false
+			for ; end < len(source) && (quoted || source[end] != ')'); end++ {
+				if source[end] == '"' && source[end-1] != '\\' {
+					quoted = !quoted
+				} else if source[end] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated parenthesis", line)
+				}
+			}
+			if end == len(source) {
+				return nil, fmt.Errorf("line %d: unterminated parenthesis", line)
+			}
+			tokens = append(tokens, jpmToken{jpmComponent, strings.TrimSpace(source[index+1 : end]), line})
+			index = end + 1
+		case char == ')':
+			return nil, fmt.Errorf("line %d: unexpected )", line)
+		default:
+			end := index
+			for end < len(source) && !strings.ContainsRune(" \t\r\n#,;()'\"", rune(source[end])) && !strings.HasPrefix(source[end:], "->") {
+				end++
+			}
+			tokens = append(tokens, jpmToken{jpmName, source[index:end], line})
+			index = end
+		}
+	}
+	return tokens, nil
+}
+
+// parseJPM parses a network definition in free-form notation
+func parseJPM(source []byte) (*fbp.Fbp, error) {
+	tokens, err := tokenizeJPM(string(source))
+	if err != nil {
+		return nil, err
+	}
+	nw := &fbp.Fbp{Processes: []*fbp.Process{}, Connections: []*fbp.Connection{}, Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+	processes := map[string]*fbp.Process{}
+	after := map[string][]string{} // startup order from automatic ports
+	position := 0
+	peek := func() *jpmToken {
+		if position < len(tokens) {
+			return &tokens[position]
+		}
+		return nil
+	}
+	lastLine := func() int {
+		if len(tokens) == 0 {
+			return 1
+		}
+		return tokens[len(tokens)-1].line
+	}
+	// next returns the next token, skipping line breaks, since the connection is incomplete
+	next := func(expected string) (*jpmToken, error) {
+		for token := peek(); token != nil && token.kind == jpmNewline; token = peek() {
+			position++
+		}
+		token := peek()
+		if token == nil {
+			return nil, fmt.Errorf("line %d: unexpected end, expected %s", lastLine(), expected)
+		}
+		position++
+		return token, nil
+	}
+	process := func() (string, error) {
+		token, err := next("process")
+		if err != nil {
+			return "", err
+		}
+		if token.kind != jpmName && token.kind != jpmQuoted {
+			return "", fmt.Errorf("line %d: expected process, got %s", token.line, describeJPMToken(token))
+		}
+		name := token.text
+		proc := processes[name]
+		if proc == nil {
+			proc = &fbp.Process{Name: name, Metadata: map[string]string{}}
+			processes[name] = proc
+			nw.Processes = append(nw.Processes, proc)
+		}
+		if component := peek(); component != nil && component.kind == jpmComponent {
+			position++
+			if err := declareJPMProcess(proc, component.text); err != nil {
+				return "", fmt.Errorf("line %d: process %s: %s", component.line, name, err)
+			}
+		}
+		return name, nil
+	}
+	port := func(expected string) (*fbp.Endpoint, error) {
+		token, err := next(expected)
+		if err != nil {
+			return nil, err
+		}
+		if token.kind == jpmName && token.text == automaticPort {
+			return &fbp.Endpoint{Port: automaticPort}, nil
+		}
+		match := jpmPortPattern.FindStringSubmatch(token.text)
+		if token.kind != jpmName || match == nil {
+			return nil, fmt.Errorf("line %d: expected %s, got %s", token.line, expected, describeJPMToken(token))
+		}
+		endpoint := &fbp.Endpoint{Port: match[1]}
+		if match[3] != "" {
+			index, _ := strconv.Atoi(match[3])
+			endpoint.Index = &index
+		}
+		return endpoint, nil
+	}
+	arrow := func() error {
+		token, err := next("->")
+		if err != nil {
+			return err
+		}
+		if token.kind != jpmArrow {
+			return fmt.Errorf("line %d: expected ->, got %s", token.line, describeJPMToken(token))
+		}
+		// capacity of the connection
+		for token := peek(); token != nil && token.kind == jpmNewline; token = peek() {
+			position++
+		}
+		if capacity := peek(); capacity != nil && capacity.kind == jpmComponent {
+			if _, err := strconv.Atoi(capacity.text); err != nil {
+				return fmt.Errorf("line %d: expected connection capacity, got (%s)", capacity.line, capacity.text)
+			}
+			position++
+		}
+		return nil
+	}
+	// inport and process, eg. IN Proc
+	target := func() (*fbp.Endpoint, error) {
+		endpoint, err := port("inport")
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Process, err = process(); err != nil {
+			return nil, err
+		}
+		return endpoint, nil
+	}
+
+	for {
+		// skip empty statements
+		token := peek()
+		for token != nil && (token.kind == jpmNewline || token.kind == jpmSeparator) {
+			position++
+			token = peek()
+		}
+		if token == nil {
+			break
+		}
+
+		// network port declaration
+		if match := jpmNetPortPattern.FindStringSubmatch(token.text); token.kind == jpmName && match != nil {
+			position++
+			portMatch := jpmPortPattern.FindStringSubmatch(match[3])
+			endpoint := &fbp.Endpoint{Process: match[2], Port: portMatch[1]}
+			if portMatch[3] != "" {
+				index, _ := strconv.Atoi(portMatch[3])
+				endpoint.Index = &index
+			}
+			if match[1] == "INPORT" {
+				nw.Inports[match[5]] = endpoint
+			} else {
+				nw.Outports[match[5]] = endpoint
+			}
+			continue
+		}
+
+		// start of connection: IIP or process
+		var source string
+		if token.kind == jpmIIP {
+			position++
+			if err := arrow(); err != nil {
+				return nil, err
+			}
+			endpoint, err := target()
+			if err != nil {
+				return nil, err
+			}
+			if endpoint.Port == automaticPort {
+				return nil, fmt.Errorf("line %d: IIP to automatic port of %s", token.line, endpoint.Process)
+			}
+			nw.Connections = append(nw.Connections, &fbp.Connection{Target: endpoint, Data: token.text})
+			source = endpoint.Process
+		} else if source, err = process(); err != nil {
+			return nil, err
+		}
+
+		// further connections until the end of the statement
+		for {
+			token := peek()
+			if token == nil || token.kind == jpmSeparator || token.kind == jpmNewline {
+				break
+			}
+			from, err := port("outport")
+			if err != nil {
+				return nil, err
+			}
+			from.Process = source
+			if err = arrow(); err != nil {
+				return nil, err
+			}
+			to, err := target()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case from.Port == automaticPort && to.Port == automaticPort:
+				after[to.Process] = append(after[to.Process], from.Process)
+				processes[from.Process].Metadata[readyMetadata] = readyExit
+			case from.Port == automaticPort || to.Port == automaticPort:
+				return nil, fmt.Errorf("line %d: automatic port connected to regular port in %s.%s -> %s.%s, only supported between automatic ports", token.line, from.Process, from.Port, to.Process, to.Port)
+			default:
+				nw.Connections = append(nw.Connections, &fbp.Connection{Source: from, Target: to})
+			}
+			source = to.Process
+		}
+	}
+
+	// startup order from automatic ports
+	for name, others := range after {
+		if value := processes[name].Metadata[afterMetadata]; value != "" {
+			others = append(strings.Split(value, afterSeparator), others...)
+		}
+		processes[name].Metadata[afterMetadata] = strings.Join(others, afterSeparator)
+	}
+	for _, proc := range nw.Processes {
+		if proc.Component == "" {
+			return nil, fmt.Errorf("process %s: no component given", proc.Name)
+		}
+	}
+	return nw, nil
+}
+
+// declareJPMProcess sets component and metadata of a process from the text in parentheses
+func declareJPMProcess(proc *fbp.Process, text string) error {
+	if text == "" {
+		return nil
+	}
+	component, metadata := text, ""
+	if strings.HasPrefix(text, "\"") {
+		end := strings.Index(text[1:], "\"") + 1
+		component, metadata = text[1:end], strings.TrimPrefix(strings.TrimSpace(text[end+1:]), ":")
+	} else if separator := strings.Index(text, ":"); separator != -1 {
+		component, metadata = strings.TrimSpace(text[:separator]), text[separator+1:]
+	}
+	if proc.Component != "" && proc.Component != component {
+		return fmt.Errorf("declared as both %s and %s", proc.Component, component)
+	}
+	proc.Component = component
+	for _, entry := range strings.Split(metadata, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected metadata as key=value, got %s", entry)
+		}
+		proc.Metadata[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return nil
+}
+
+func describeJPMToken(token *jpmToken) string {
+	switch token.kind {
+	case jpmQuoted:
+		return "\"" + token.text + "\""
+	case jpmIIP:
+		return "'" + token.text + "'"
+	case jpmComponent:
+		return "(" + token.text + ")"
+	case jpmNewline:
+		return "end of line"
+	}
+	return token.text
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Linting of network definitions for style issues and likely mistakes.
+
+Using -lint, the network definition is checked before includes are inlined and reported are:
+
+* processes without component
+* processes not connected to anything
+* duplicate connections
+* port names not in upper case, which is the convention of the bundled components
+* deprecated port names
+* network inports and outports bound to processes not in the network
+* IIPs, connections and network ports to ports which the component does not declare
+
+The ports of the bundled components are known from componentPorts below, other components are not checked for this.
+IIPs to ARGS are always fine, since flowd delivers them as program arguments.
+*/
+
+// ComponentPorts are the ports opened by a component; "*" means any port name
+type ComponentPorts struct {
+	In  []string
+	Out []string
+}
+
+// componentPorts holds the ports of the bundled components by executable name
+var componentPorts = map[string]ComponentPorts{
+	"brotli-read":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"brotli-write":         {In: []string{"IN"}, Out: []string{"OUT"}},
+	"close":                {Out: []string{"OUT"}},
+	"cmd":                  {In: []string{"IN"}, Out: []string{"OUT"}},
+	"concatenate":          {In: []string{"*"}, Out: []string{"OUT"}},
+	"copy":                 {In: []string{"IN"}, Out: []string{"*"}},
+	"counter":              {In: []string{"IN"}, Out: []string{"OUT"}},
+	"cron":                 {In: []string{"CONF"}, Out: []string{"*"}},
+	"discard":              {In: []string{"IN"}},
+	"display":              {In: []string{"IN"}},
+	"file-read":            {Out: []string{"OUT"}},
+	"file-tail":            {Out: []string{"OUT"}},
+	"file-write":           {In: []string{"IN"}},
+	"header-modify":        {In: []string{"IN"}, Out: []string{"OUT"}},
+	"header-set-regex":     {In: []string{"IN"}, Out: []string{"OUT"}},
+	"http-client":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"http-server":          {In: []string{"IN", "RESP"}, Out: []string{"OUT", "RESP"}},
+	"load-balancer":        {In: []string{"IN", "SWITCH"}, Out: []string{"*"}},
+	"lzma-read":            {In: []string{"IN"}, Out: []string{"OUT"}},
+	"lzma-write":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"mdns-browse":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"mdns-publish":         {In: []string{"IN"}},
+	"packet-filter-string": {In: []string{"IN", "CONF"}, Out: []string{"OUT"}},
+	"packet-router-header": {In: []string{"IN", "CONF"}, Out: []string{"OUT"}},
+	"sleep":                {In: []string{"IN"}, Out: []string{"OUT"}},
+	"sort":                 {In: []string{"IN"}, Out: []string{"OUT"}},
+	"split-lines":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"ssh-client":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"tcp-client":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"tcp-server":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"tls-client":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"tls-server":           {In: []string{"IN"}, Out: []string{"OUT"}},
+	"unix-client":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"unix-server":          {In: []string{"IN"}, Out: []string{"OUT"}},
+	"ws-client":            {In: []string{"IN"}, Out: []string{"OUT"}},
+	"ws-server":            {In: []string{"IN"}, Out: []string{"OUT"}},
+}
+
+// deprecatedPorts maps deprecated port names to their replacement
+var deprecatedPorts = map[string]string{
+	"ARGV": "ARGS", // IIPs into the former ARGV port of the launch program, see doc/design_history.md
+}
+
+// lintNetwork returns the style issues and likely mistakes found in the network definition
+func lintNetwork(nw *fbp.Fbp) []string {
+	findings := []string{}
+	report := func(format string, args ...interface{}) {
+		findings = append(findings, fmt.Sprintf(format, args...))
+	}
+	processes := map[string]*fbp.Process{}
+	for _, proc := range nw.Processes {
+		processes[proc.Name] = proc
+	}
+	// checks the port name of a process and whether the component declares it
+	checkPort := func(what string, process string, endpoint *fbp.Endpoint, inport bool) {
+		port := endpoint.Port
+		if replacement, found := deprecatedPorts[port]; found {
+			report("%s: port %s is deprecated, use %s", what, port, replacement)
+			return
+		}
+		if port != strings.ToUpper(port) {
+			report("%s: port %s should be in upper case", what, port)
+		}
+		proc := processes[process]
+		if proc == nil {
+			return
+		}
+		ports, known := componentPorts[filepath.Base(proc.Component)]
+		if !known {
+			return
+		}
+		declared, direction := ports.Out, "outport"
+		if inport {
+			declared, direction = ports.In, "inport"
+		}
+		for _, name := range declared {
+			if name == "*" || name == port {
+				return
+			}
+		}
+		report("%s: component %s does not declare %s %s", what, proc.Component, direction, port)
+	}
+
+	// processes
+	connected := map[string]bool{}
+	for _, conn := range nw.Connections {
+		connected[conn.Target.Process] = true
+		if conn.Source != nil {
+			connected[conn.Source.Process] = true
+		}
+	}
+	for _, endpoint := range nw.Inports {
+		connected[endpoint.Process] = true
+	}
+	for _, endpoint := range nw.Outports {
+		connected[endpoint.Process] = true
+	}
+	for _, proc := range nw.Processes {
+		if proc.Component == "" {
+			report("process %s: no component given", proc.Name)
+		}
+		if !connected[proc.Name] {
+			report("process %s: not connected to anything", proc.Name)
+		}
+	}
+
+	// connections and IIPs
+	seen := map[string]bool{}
+	for _, conn := range nw.Connections {
+		target := conn.Target.Process + "." + generatePortName(conn.Target)
+		if conn.Source == nil {
+			if conn.Target.Port != "ARGS" {
+				checkPort("IIP to "+target, conn.Target.Process, conn.Target, true)
+			} else if conn.Target.Index != nil {
+				report("IIP to %s: ARGS is no array port", target)
+			}
+			continue
+		}
+		key := connectionKey(conn.Source.Process, generatePortName(conn.Source), conn.Target.Process, generatePortName(conn.Target))
+		if seen[key] {
+			report("connection %s: duplicate", key)
+			continue
+		}
+		seen[key] = true
+		checkPort("connection "+key, conn.Source.Process, conn.Source, false)
+		checkPort("connection "+key, conn.Target.Process, conn.Target, true)
+	}
+
+	// network ports
+	for _, name := range sortedEndpoints(nw.Inports) {
+		endpoint := nw.Inports[name]
+		what := fmt.Sprintf("INPORT %s", name)
+		if processes[endpoint.Process] == nil {
+			report("%s: unused, process %s is not in the network", what, endpoint.Process)
+			continue
+		}
+		checkPort(what, endpoint.Process, endpoint, true)
+	}
+	for _, name := range sortedEndpoints(nw.Outports) {
+		endpoint := nw.Outports[name]
+		what := fmt.Sprintf("OUTPORT %s", name)
+		if processes[endpoint.Process] == nil {
+			report("%s: unused, process %s is not in the network", what, endpoint.Process)
+			continue
+		}
+		checkPort(what, endpoint.Process, endpoint, false)
+	}
+
+	sort.Strings(findings)
+	return findings
+}
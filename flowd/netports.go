@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/ERnsTL/flowd/libunixfbp"
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Network inports and outports (INPORT=, OUTPORT= in .fbp) resp. NETIN and NETOUT.
+
+If flowd runs as a subnet, the outer flowd gives the named pipes for these using -inport/-inpath and -outport/-outpath.
+If flowd runs standalone, they can be bound using -in and -out to either existing named pipes or to
+a listening socket. Using PROCESS.PORT instead of a network port name, any process port can be bound the same way. Frames are accepted from socket clients and forwarded into the network resp. frames coming out
+of the network are forwarded to all connected socket clients.
+
+When the network shuts down, the listening sockets are closed, Unix socket files removed and clients disconnected.
+Processes bound to a network inport then get EOF, those bound to a network outport can write on without clients.
+*/
+
+// NetEndpoint is an external endpoint for a network inport or outport
+type NetEndpoint struct {
+	Port    string `json:"port"`    // name of the network port
+	Network string `json:"network"` // unix, tcp, tcp4, tcp6 or fifo
+	Address string `json:"address"` // socket address or named pipe path
+}
+
+// parseEndpoint splits an endpoint URL like tcp://:7000 or unix:///run/x.sock; paths without scheme are named pipes
+func parseEndpoint(port string, endpoint string) (*NetEndpoint, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("port %s: endpoint missing", port)
+	}
+	parts := strings.SplitN(endpoint, "://", 2)
+	if len(parts) != 2 {
+		// existing named pipe
+		return &NetEndpoint{Port: port, Network: "fifo", Address: endpoint}, nil
+	}
+	scheme, address := parts[0], parts[1]
+	switch scheme {
+	case "unix", "tcp", "tcp4", "tcp6", "fifo":
+	default:
+		return nil, fmt.Errorf("port %s: unsupported endpoint scheme '%s' - expected unix, tcp, tcp4, tcp6 or fifo", port, scheme)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("port %s: endpoint address missing in %s", port, endpoint)
+	}
+	return &NetEndpoint{Port: port, Network: scheme, Address: address}, nil
+}
+
+// exportProcessPorts adds network ports for process ports given as PROCESS.PORT in -in and -out, eg. for testing
+// NOTE: an already connected inport gets merged with the network inport, an already connected outport cannot be bound
+func exportProcessPorts(nw *fbp.Fbp, inEndpoints keyValueFlag, outEndpoints keyValueFlag) error {
+	if nw.Inports == nil {
+		nw.Inports = map[string]*fbp.Endpoint{}
+	}
+	if nw.Outports == nil {
+		nw.Outports = map[string]*fbp.Endpoint{}
+	}
+	for _, ports := range []struct {
+		endpoints keyValueFlag
+		netPorts  map[string]*fbp.Endpoint
+		inport    bool
+	}{{inEndpoints, nw.Inports, true}, {outEndpoints, nw.Outports, false}} {
+		for name := range ports.endpoints {
+			if _, exists := ports.netPorts[name]; exists {
+				continue
+			}
+			parts := strings.SplitN(name, ".", 2)
+			if len(parts) != 2 {
+				// unknown network port, reported by bindNetPorts()
+				continue
+			}
+			procName, port := parts[0], parts[1]
+			found := false
+			for _, proc := range nw.Processes {
+				if proc.Name == procName {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("process port %s: no such process %s", name, procName)
+			}
+			if !ports.inport {
+				for _, conn := range nw.Connections {
+					if conn.Source != nil && conn.Source.Process == procName && conn.Source.Port == port {
+						return fmt.Errorf("process outport %s is already connected", name)
+					}
+				}
+			}
+			ports.netPorts[name] = &fbp.Endpoint{Process: procName, Port: port}
+		}
+	}
+	return nil
+}
+
+// bindNetPorts checks that all network inports and outports have an endpoint and registers their named pipes for startInstance()
+// NOTE: ports given by an outer flowd using -inport/-inpath and -outport/-outpath are already registered
+func bindNetPorts(nw *fbp.Fbp, inEndpoints keyValueFlag, outEndpoints keyValueFlag) (netins []*NetEndpoint, netouts []*NetEndpoint, err error) {
+	for port, endpoint := range inEndpoints {
+		if _, exists := nw.Inports[port]; !exists {
+			return nil, nil, fmt.Errorf("endpoint given for unknown network inport %s", port)
+		}
+		netin, err := parseEndpoint(port, endpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		if netin.Network == "fifo" {
+			unixfbp.InPorts[port] = unixfbp.InPort{Path: netin.Address}
+			continue
+		}
+		unixfbp.InPorts[port] = unixfbp.InPort{Path: fifoPath("NETIN", port)}
+		netins = append(netins, netin)
+	}
+	for port, endpoint := range outEndpoints {
+		if _, exists := nw.Outports[port]; !exists {
+			return nil, nil, fmt.Errorf("endpoint given for unknown network outport %s", port)
+		}
+		netout, err := parseEndpoint(port, endpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		if netout.Network == "fifo" {
+			unixfbp.OutPorts[port] = unixfbp.OutPort{Path: netout.Address}
+			continue
+		}
+		unixfbp.OutPorts[port] = unixfbp.OutPort{Path: fifoPath("NETOUT", port)}
+		netouts = append(netouts, netout)
+	}
+	// check that all network ports are bound
+	for port := range nw.Inports {
+		if unixfbp.InPorts[port].Path == "" {
+			return nil, nil, fmt.Errorf("no endpoint for network inport %s - give -in %s=endpoint or run as subnet", port, port)
+		}
+	}
+	for port := range nw.Outports {
+		if unixfbp.OutPorts[port].Path == "" {
+			return nil, nil, fmt.Errorf("no endpoint for network outport %s - give -out %s=endpoint or run as subnet", port, port)
+		}
+	}
+	return
+}
+
+// listenEndpoint opens the listening socket of an endpoint
+func listenEndpoint(endpoint *NetEndpoint) (net.Listener, error) {
+	if endpoint.Network == "unix" && !strings.HasPrefix(endpoint.Address, "@") {
+		// clean up any leftover socket file
+		os.Remove(endpoint.Address)
+	}
+	return net.Listen(endpoint.Network, endpoint.Address)
+}
+
+// closeNetPorts stops accepting clients on the listening sockets of the endpoints, see handleNetIn() and handleNetOut()
+func closeNetPorts(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+		// NOTE: abstract Unix sockets have no file
+		if addr, ok := listener.Addr().(*net.UnixAddr); ok && !strings.HasPrefix(addr.Name, "@") {
+			os.Remove(addr.Name)
+		}
+	}
+}
+
+// handleNetIn accepts frames from clients connecting to the endpoint and forwards them into the network inport
+// NOTE: named pipe and listening socket are set up before returning, the rest happens in Goroutines
+// NOTE: once the returned listener is closed, clients are disconnected and the named pipe is closed
+func handleNetIn(netin *NetEndpoint) net.Listener {
+	// create named pipe
+	path := unixfbp.InPorts[netin.Port].Path
+	syscall.Mkfifo(path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+	listener, err := listenEndpoint(netin)
+	if err != nil {
+		fmt.Printf("ERROR: listening for network inport %s on %s %s: %s\n", netin.Port, netin.Network, netin.Address, err)
+		os.Exit(2)
+	}
+	if !quiet {
+		fmt.Printf("network inport %s listening on %s %s\n", netin.Port, netin.Network, netin.Address)
+	}
+	// NOTE: one writer for all clients, so that frames do not get interleaved; opening blocks until the process has opened its inport
+	frames := make(chan *flowd.Frame, fanInBuffer)
+	counter := live.frameCounter(netPortKey("NETIN", netin.Port))
+	go func() {
+		outPipe, err := os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe)
+		if err != nil {
+			fmt.Printf("ERROR: opening pipe for network inport %s at path %s: %s\n", netin.Port, path, err)
+			os.Exit(2)
+		}
+		defer outPipe.Close()
+		netout := bufio.NewWriter(outPipe)
+		for frame := range frames {
+			if err = frame.Serialize(netout); err != nil {
+				fmt.Printf("ERROR: serializing frame into network inport %s: %s\n", netin.Port, err)
+				continue
+			}
+			// flush if no frames waiting
+			if len(frames) == 0 {
+				if err = netout.Flush(); err != nil {
+					fmt.Printf("ERROR: flushing network inport %s: %s\n", netin.Port, err)
+				}
+			}
+		}
+		// listener closed and all clients disconnected - closing the named pipe gives the process EOF
+		if debug {
+			fmt.Println("DEBUG: closing network inport", netin.Port)
+		}
+	}()
+	// accept clients
+	go func() {
+		var clients sync.WaitGroup
+		var connsLock sync.Mutex
+		conns := map[net.Conn]bool{}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					break
+				}
+				fmt.Printf("ERROR: accepting client on network inport %s: %s\n", netin.Port, err)
+				// NOTE: eg. too many open files - do not spin
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if !quiet {
+				fmt.Printf("network inport %s: client %s connected\n", netin.Port, conn.RemoteAddr())
+			}
+			connsLock.Lock()
+			conns[conn] = true
+			connsLock.Unlock()
+			clients.Add(1)
+			go func(conn net.Conn) {
+				defer clients.Done()
+				// NOTE: client EOF does not close the inport; other clients may connect later
+				if err := readFrames(bufio.NewReader(conn), frames, counter); err != nil && !errors.Is(err, net.ErrClosed) {
+					fmt.Printf("ERROR: reading frame from client %s on network inport %s: %s\n", conn.RemoteAddr(), netin.Port, err)
+				}
+				connsLock.Lock()
+				delete(conns, conn)
+				connsLock.Unlock()
+				conn.Close()
+				if !quiet {
+					fmt.Printf("network inport %s: client %s disconnected\n", netin.Port, conn.RemoteAddr())
+				}
+			}(conn)
+		}
+		// network shutting down - disconnect clients, then close the inport
+		connsLock.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsLock.Unlock()
+		clients.Wait()
+		close(frames)
+	}()
+	return listener
+}
+
+// netOutClients holds the clients connected to a network outport endpoint
+type netOutClients struct {
+	sync.Mutex
+	present *sync.Cond // signaled when a client connects
+	writers map[net.Conn]*bufio.Writer
+	closed  bool // listener closed, no more clients to wait for
+}
+
+// handleNetOut forwards the frames coming out of the network outport to all clients connected to the endpoint
+// NOTE: named pipe and listening socket are set up before returning, the rest happens in Goroutines
+// NOTE: once the returned listener is closed, clients are disconnected and further frames are dropped
+func handleNetOut(netout *NetEndpoint) net.Listener {
+	// create named pipe
+	path := unixfbp.OutPorts[netout.Port].Path
+	syscall.Mkfifo(path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+	listener, err := listenEndpoint(netout)
+	if err != nil {
+		fmt.Printf("ERROR: listening for network outport %s on %s %s: %s\n", netout.Port, netout.Network, netout.Address, err)
+		os.Exit(2)
+	}
+	if !quiet {
+		fmt.Printf("network outport %s listening on %s %s\n", netout.Port, netout.Network, netout.Address)
+	}
+	// accept clients
+	clients := &netOutClients{writers: map[net.Conn]*bufio.Writer{}}
+	clients.present = sync.NewCond(clients)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					// network shutting down - disconnect clients
+					clients.Lock()
+					clients.closed = true
+					for conn, writer := range clients.writers {
+						writer.Flush()
+						conn.Close()
+						delete(clients.writers, conn)
+					}
+					clients.present.Broadcast()
+					clients.Unlock()
+					return
+				}
+				fmt.Printf("ERROR: accepting client on network outport %s: %s\n", netout.Port, err)
+				// NOTE: eg. too many open files - do not spin
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if !quiet {
+				fmt.Printf("network outport %s: client %s connected\n", netout.Port, conn.RemoteAddr())
+			}
+			clients.Lock()
+			clients.writers[conn] = bufio.NewWriter(conn)
+			clients.present.Broadcast()
+			clients.Unlock()
+		}
+	}()
+	// forward frames
+	go forwardNetOut(netout, path, clients)
+	return listener
+}
+
+// forwardNetOut reads the frames from the network outport and sends them to all connected clients
+func forwardNetOut(netout *NetEndpoint, path string, clients *netOutClients) {
+	// open named pipe; blocks until the process has opened its outport
+	inPipe, err := os.OpenFile(path, os.O_RDONLY, os.ModeNamedPipe)
+	if err != nil {
+		fmt.Printf("ERROR: opening pipe for network outport %s at path %s: %s\n", netout.Port, path, err)
+		os.Exit(2)
+	}
+	defer inPipe.Close()
+	netin := bufio.NewReader(inPipe)
+	counter := live.frameCounter(netPortKey("NETOUT", netout.Port))
+	for {
+		frame, err := flowd.Deserialize(netin)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("ERROR: reading frame from network outport %s: %s\n", netout.Port, err)
+			} else if debug {
+				fmt.Println("DEBUG: EOF on network outport", netout.Port)
+			}
+			break
+		}
+		countFrame(counter)
+		// send to all clients; wait until there is at least one, so that no frames get lost
+		// NOTE: after the listener is closed, the frames are dropped, so that the process does not block writing
+		clients.Lock()
+		for len(clients.writers) == 0 && !clients.closed {
+			clients.present.Wait()
+		}
+		for conn, writer := range clients.writers {
+			if err = frame.Serialize(writer); err == nil && netin.Buffered() == 0 {
+				err = writer.Flush()
+			}
+			if err != nil {
+				fmt.Printf("network outport %s: client %s disconnected: %s\n", netout.Port, conn.RemoteAddr(), err)
+				conn.Close()
+				delete(clients.writers, conn)
+			}
+		}
+		clients.Unlock()
+	}
+	// outport closed, disconnect clients
+	clients.Lock()
+	for conn, writer := range clients.writers {
+		writer.Flush()
+		conn.Close()
+	}
+	clients.Unlock()
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/ERnsTL/flowd/flowd/drawfbp"
@@ -26,21 +28,26 @@ type Process struct {
 	InPorts  []Port
 	OutPorts []Port
 	IIPs     []IIP
+	Metadata map[string]string
+	FanIns   map[string]*FanIn // inports with multiple upstreams, merged by flowd; key is the port name
 	Instance *ComponentInstance
 }
 
 // IIP holds information about an IIP to be delivered
 type IIP struct {
-	Port string
-	Data string
+	Port        string
+	Data        string
+	BodyType    string // of the IIP frame, empty = IIP
+	ContentType string // content-type header of the IIP frame, if any
 }
 
 // Port holds connection information about a process port (connection), whether input or output
 //TODO optimize: convert network information to <E,V> = edges and vertices = nodes and connections structure
 type Port struct {
-	LocalPort  string
-	RemotePort string
-	RemoteProc string
+	LocalPort  string `json:"localPort"`
+	RemotePort string `json:"remotePort"`
+	RemoteProc string `json:"remoteProcess"`
+	Path       string `json:"path,omitempty"` // named pipe path, if it differs from the usual one - currently for fan-in upstreams
 }
 
 func getNetworkDefinition() []byte {
@@ -80,6 +87,64 @@ func getNetworkDefinition() []byte {
 	return nwBytes
 }
 
+// notations of network definitions
+const (
+	notationNoFlo = "noflo"
+	notationJPM   = "jpm"
+	notationYAML  = "yaml"
+)
+
+// notation is the notation of network definitions given using -notation, empty = by file extension
+var notation string
+
+// networkNotation returns the notation of the network definition file, see notation
+func networkNotation(path string) string {
+	if notation != "" {
+		return notation
+	}
+	switch filepath.Ext(path) {
+	case jpmExtension:
+		return notationJPM
+	case ".yaml", ".yml":
+		return notationYAML
+	}
+	return notationNoFlo
+}
+
+// parseNetwork parses the network definition read from the given path (empty = STDIN) in its notation
+// NOTE: IIP files are relative to the path, see iip.go
+func parseNetwork(nwBytes []byte, path string) *fbp.Fbp {
+	var nw *fbp.Fbp
+	heredocs := []Heredoc{}
+	var err error
+	nwNotation := networkNotation(path)
+	if nwNotation != notationYAML {
+		if nwBytes, heredocs, err = extractHeredocs(nwBytes); err != nil {
+			fmt.Println("ERROR: parsing network definition:", err)
+			os.Exit(1)
+		}
+	}
+	switch nwNotation {
+	case notationJPM:
+		nw, err = parseJPM(nwBytes)
+	case notationYAML:
+		nw, err = parseYAML(nwBytes, filepath.Dir(path))
+	default:
+		nw = parseNetworkDefinition(nwBytes)
+	}
+	if err == nil {
+		err = resolveIIPs(nw, filepath.Dir(path), heredocs)
+	}
+	if err != nil {
+		fmt.Println("ERROR: parsing network definition:", err)
+		os.Exit(1)
+	}
+	if debug && nwNotation != notationNoFlo {
+		fmt.Println("network definition OK")
+	}
+	return nw
+}
+
 func parseNetworkDefinition(nwBytes []byte) *fbp.Fbp {
 	//TODO set Subgraph attribute to nwName if flowd is running as a network component -> process names get that as prefix -> solves name clashes
 	nw := &fbp.Fbp{Buffer: (string)(nwBytes)}
@@ -111,6 +176,22 @@ func parseNetworkDefinition(nwBytes []byte) *fbp.Fbp {
 	return nw
 }
 
+// loadNetworkFile reads, parses and substitutes the variables of the network definition file including its includes
+func loadNetworkFile(path string, paramSets []map[string]string) (*fbp.Fbp, error) {
+	nwBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if nwBytes, err = substituteParams(nwBytes, paramSets...); err != nil {
+		return nil, err
+	}
+	nw := parseNetwork(nwBytes, path)
+	if err = inlineIncludes(nw, filepath.Dir(path), paramSets, []string{filepath.Clean(path)}); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
 func displayNetworkDefinition(nw *fbp.Fbp) {
 	fmt.Println("subgraph name:", nw.Subgraph)
 	fmt.Println("processes:")
@@ -243,7 +324,7 @@ func networkDefinition2Processes(nw *fbp.Fbp) Network {
 			toProc := fbpConn.Target.Process
 
 			// listen input port struct
-			procs[toProc].IIPs = append(procs[toProc].IIPs, IIP{toPort, fbpConn.Data})
+			procs[toProc].IIPs = append(procs[toProc].IIPs, newIIP(toPort, fbpConn.Data))
 
 			if debug {
 				fmt.Printf("  connection: IIP '%s' -> %s.%s\n", fbpConn.Data, toProc, toPort)
@@ -302,7 +383,7 @@ func networkDefinition2Processes(nw *fbp.Fbp) Network {
 
 func newProcess(proc *fbp.Process) *Process {
 	// return new Process struct
-	return &Process{Path: proc.Component, Name: proc.Name, InPorts: []Port{}, OutPorts: []Port{}, IIPs: []IIP{}}
+	return &Process{Path: proc.Component, Name: proc.Name, InPorts: []Port{}, OutPorts: []Port{}, IIPs: []IIP{}, Metadata: proc.Metadata}
 }
 
 func generatePortName(endpoint *fbp.Endpoint) string {
@@ -379,6 +460,11 @@ func drw2Processes(filepath string) (netflowd Network, err error) {
 					InPorts:  []Port{},
 					OutPorts: []Port{},
 					IIPs:     []IIP{},
+					Metadata: map[string]string{},
+				}
+				// multiplexed block = replicated process
+				if block.Multiplex && block.MPXFactor > 1 {
+					netflowd[procName].Metadata[replicasMetadata] = strconv.Itoa(block.MPXFactor)
 				}
 			}
 		} else if block.Type == drawfbp.TypeIIP {
@@ -446,7 +532,7 @@ func drw2Processes(filepath string) (netflowd Network, err error) {
 			if toProcName, toProcess := id2name[connection.ToID]; toProcess {
 				// create inport at destination process
 				proc = netflowd[toProcName]
-				proc.IIPs = append(proc.IIPs, IIP{connection.DownstreamPort, iipData})
+				proc.IIPs = append(proc.IIPs, IIP{Port: connection.DownstreamPort, Data: iipData})
 				//} else if toEncl, toEnclosure := enclosures[connection.ToID]; toEnclosure {
 			} else if _, toEnclosure := enclosures[connection.ToID]; toEnclosure {
 				// NOTE: unimplemented
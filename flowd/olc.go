@@ -6,18 +6,31 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // TODO wss = ws + TLS security
-func startOLC(address string) {
+// NOTE: if allowConf, new configuration can be pushed to running processes using the network:conf command, see conf.go
+// NOTE: if allowShell, flowd shell can also tap, inject, stop and restart, otherwise only list processes, see shell.go
+func startOLC(address string, allowConf bool, allowShell bool) {
 	upgrader := websocket.Upgrader{
 		// TODO check for correct WS subprotocol
 		ReadBufferSize:    1024,
 		WriteBufferSize:   1024,
 		EnableCompression: true,
 	}
+	// graph of the running network including live state, see graph.go
+	http.HandleFunc("/graph", serveGraph)
+	// configuration of running processes, see conf.go
+	// NOTE: this is unauthenticated, so only if allowed - unlike on the status socket
+	http.HandleFunc("/conf", olcHandler(serveConf, allowConf, "olc-conf"))
+	// inspection and manipulation of the running network using flowd shell, see shell.go
+	http.HandleFunc("/processes", serveProcesses)
+	http.HandleFunc("/inject", olcHandler(serveInject, allowShell, "olc-shell"))
+	http.HandleFunc("/tap", olcHandler(serveTap, allowShell, "olc-shell"))
+	http.HandleFunc("/process", olcHandler(serveProcess, allowShell, "olc-shell"))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// upgrade to Websocket
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -68,10 +81,39 @@ func startOLC(address string) {
 					connError(conn, "Subprotocol 'runtime' got unexpected topic: "+fbpMsg.Topic)
 					return
 				}
+			case "network":
+				switch fbpMsg.Topic {
+				case "getstatus":
+					fbpPayload := new(JSONNetworkGetStatus)
+					err = json.Unmarshal(fbpMsg.Payload, &fbpPayload)
+					if err != nil {
+						connError(conn, fmt.Sprintf("Unmarshaling payload for %s:%s failed: %s", fbpMsg.Protocol, fbpMsg.Topic, err))
+						return
+					}
+					respBytes, err = handleNetworkGetStatus(fbpPayload)
+					if err != nil {
+						connError(conn, "handleNetworkGetStatus:"+err.Error())
+						return
+					}
+				case "conf":
+					fbpPayload := new(JSONNetworkConf)
+					err = json.Unmarshal(fbpMsg.Payload, &fbpPayload)
+					if err != nil {
+						connError(conn, fmt.Sprintf("Unmarshaling payload for %s:%s failed: %s", fbpMsg.Protocol, fbpMsg.Topic, err))
+						return
+					}
+					respBytes, err = handleNetworkConf(fbpPayload, allowConf)
+					if err != nil {
+						connError(conn, "handleNetworkConf:"+err.Error())
+						return
+					}
+				default:
+					connError(conn, "Subprotocol 'network' got unexpected topic: "+fbpMsg.Topic)
+					return
+				}
 				/* TODO
 				case "graph":
 				case "component":
-				case "network":
 				case "trace":
 				*/
 			default:
@@ -108,6 +150,16 @@ func startOLC(address string) {
 	log.Fatal(http.ListenAndServe(address, nil))
 }
 
+// olcHandler returns the handler if allowed using the given flag, otherwise one refusing the request
+func olcHandler(handler http.HandlerFunc, allowed bool, flagName string) http.HandlerFunc {
+	if allowed {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not enabled on the online configuration server, see flag -"+flagName, http.StatusForbidden)
+	}
+}
+
 func connError(conn *websocket.Conn, text string) {
 	conn.Close()
 	fmt.Println(text)
@@ -130,6 +182,41 @@ func handleRuntimeGetRuntime(payload *JSONRuntimeGetRuntime) ([]byte, error) {
 	return respBytes, nil
 }
 
+// NOTE: the network counts as running once all processes are ready, see ready.go
+func handleNetworkGetStatus(payload *JSONNetworkGetStatus) ([]byte, error) {
+	if !checkSecret(payload.Secret) {
+		return nil, errors.New("Unauthenticated")
+	}
+	ready, _ := startup.isReady()
+	respBytes, _ := json.Marshal(JSONNetworkStatus{
+		Graph:   payload.Graph,
+		Uptime:  int(time.Since(startup.started).Seconds()),
+		Started: true,
+		Running: ready,
+		Debug:   debug,
+	})
+	return respBytes, nil
+}
+
+// handleNetworkConf pushes new configuration to a running process, see conf.go
+// NOTE: failing to deliver the configuration is reported in the response, not by closing the connection
+func handleNetworkConf(payload *JSONNetworkConf, allowConf bool) ([]byte, error) {
+	if !allowConf {
+		return nil, errors.New("configuration push not enabled, see flag -olc-conf")
+	}
+	if !checkSecret(payload.Secret) {
+		return nil, errors.New("Unauthenticated")
+	}
+	result := JSONNetworkConfResult{Graph: payload.Graph, Process: payload.Process, Success: true}
+	if live == nil || live.procs == nil {
+		result.Success, result.Error = false, "network not running"
+	} else if err := pushConf(live.procs, live.nw, payload.Process, payload.Conf); err != nil {
+		result.Success, result.Error = false, err.Error()
+	}
+	respBytes, _ := json.Marshal(result)
+	return respBytes, nil
+}
+
 func checkSecret(secret string) bool {
 	// TODO implement
 	return true
@@ -189,6 +276,40 @@ type JSONRuntimeRuntime struct {
 	Graph           string   `json:"graph"`           // currently active graph
 }
 
+// network protocol
+
+// JSONNetworkGetStatus requests the status of the running network
+type JSONNetworkGetStatus struct {
+	Graph  string `json:"graph"`
+	Secret string `json:"secret"`
+}
+
+// JSONNetworkStatus is the response to a getstatus request
+type JSONNetworkStatus struct {
+	Graph   string `json:"graph"`
+	Uptime  int    `json:"uptime"`  // seconds since the network was started
+	Started bool   `json:"started"` // whether the network has been started
+	Running bool   `json:"running"` // whether all processes are ready and the network is running
+	Debug   bool   `json:"debug"`
+}
+
+// JSONNetworkConf pushes new configuration to the CONF inport of a running process, all instances if replicated
+// NOTE: flowd-specific extension of the network sub-protocol
+type JSONNetworkConf struct {
+	Graph   string `json:"graph"`
+	Process string `json:"process"`
+	Conf    string `json:"conf"` // complete new configuration, same format as the IIP to ARGS
+	Secret  string `json:"secret"`
+}
+
+// JSONNetworkConfResult is the response to a conf request
+type JSONNetworkConfResult struct {
+	Graph   string `json:"graph"`
+	Process string `json:"process"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
 /*
 // graph protocol
 
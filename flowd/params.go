@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Parameters resp. variables in network definitions.
+
+${NAME} and ${NAME:-default} are replaced in the network definition text before it is parsed, so they can be used
+in IIPs and metadata. Values are looked up in this order: -set NAME=value flags, parameters file given by -params,
+environment variables. $${NAME} gives a literal ${NAME}. Comments are left untouched, also at the end of a line. Values containing the
+quote character of the IIP or name they are used in are rejected, eg. it's in '${MSG}'.
+*/
+
+// keyValueFlag holds NAME=value pairs given in multiple flags of the same name, implements flag.Value
+type keyValueFlag map[string]string
+
+func (kv keyValueFlag) String() string {
+	pairs := []string{}
+	for key, value := range kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValueFlag) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected NAME=value, got: %s", pair)
+	}
+	if _, exists := kv[parts[0]]; exists {
+		return fmt.Errorf("value for %s already given", parts[0])
+	}
+	kv[parts[0]] = parts[1]
+	return nil
+}
+
+var paramPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// loadParamsFile reads NAME=value lines from a parameters file; empty lines and lines starting with # are ignored
+func loadParamsFile(path string) (params map[string]string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	params = map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected NAME=value", lineNumber)
+		}
+		params[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// substituteParams replaces all ${NAME} and ${NAME:-default} in the network definition, looking up values in the given parameter sets and then the environment
+func substituteParams(nwBytes []byte, paramSets ...map[string]string) ([]byte, error) {
+	unresolved := map[string]bool{}
+	lines := strings.Split(string(nwBytes), "\n")
+	for index, line := range lines {
+		// NOTE: only up to the comment, if any
+		end := commentStart(line)
+		var substituted strings.Builder
+		last := 0
+		for _, position := range paramPattern.FindAllStringIndex(line[:end], -1) {
+			substituted.WriteString(line[last:position[0]])
+			last = position[1]
+			match := line[position[0]:position[1]]
+			if strings.HasPrefix(match, "$$") {
+				// escaped
+				substituted.WriteString(match[1:])
+				continue
+			}
+			groups := paramPattern.FindStringSubmatch(match)
+			value, found := lookupParam(groups[1], paramSets)
+			if !found && groups[2] != "" {
+				// default value
+				value, found = groups[3], true
+			}
+			if !found {
+				unresolved[groups[1]] = true
+				substituted.WriteString(match)
+				continue
+			}
+			// NOTE: the parsers do not unescape quotes in IIPs, so the value cannot be escaped
+			if quote := quoteAt(line, position[0]); quote != 0 && strings.IndexByte(value, quote) != -1 {
+				return nil, fmt.Errorf("line %d: value of variable %s contains %c, which would end the quoted IIP or name it is used in", index+1, groups[1], quote)
+			}
+			substituted.WriteString(value)
+		}
+		substituted.WriteString(line[last:])
+		lines[index] = substituted.String()
+	}
+	if len(unresolved) > 0 {
+		names := make([]string, 0, len(unresolved))
+		for name := range unresolved {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unresolved variables: %s", strings.Join(names, ", "))
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// quoteAt returns the quote character of the quoted IIP or name the position in the line is in, 0 if none
+func quoteAt(line string, position int) byte {
+	var quote byte
+	for index := 0; index < position; index++ {
+		switch {
+		case quote != 0 && line[index] == '\\':
+			index++
+		case quote != 0 && line[index] == quote:
+			quote = 0
+		case quote == 0 && (line[index] == '\'' || line[index] == '"'):
+			quote = line[index]
+		}
+	}
+	return quote
+}
+
+// commentStart returns the position of the # starting a comment in the line, outside of quotes, or the line length if none
+func commentStart(line string) int {
+	var quote byte
+	for index := 0; index < len(line); index++ {
+		switch {
+		case quote != 0 && line[index] == '\\':
+			index++
+		case quote != 0 && line[index] == quote:
+			quote = 0
+		case quote == 0 && (line[index] == '\'' || line[index] == '"'):
+			quote = line[index]
+		case quote == 0 && line[index] == '#':
+			return index
+		}
+	}
+	return len(line)
+}
+
+// lookupParam returns the value of the first parameter set containing that name, otherwise from the environment
+func lookupParam(name string, paramSets []map[string]string) (string, bool) {
+	for _, params := range paramSets {
+		if value, found := params[name]; found {
+			return value, true
+		}
+	}
+	return os.LookupEnv(name)
+}
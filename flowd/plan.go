@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/ERnsTL/flowd/libunixfbp"
+	"github.com/kballard/go-shellquote"
+	"github.com/oleksandr/fbp"
+)
+
+// ProcessPlan holds everything needed to start a process instance
+type ProcessPlan struct {
+	Name       string     `json:"name"`
+	Component  string     `json:"component"`      // component path as given in network definition
+	Executable string     `json:"executable"`     // resolved path of the component, empty if not found
+	Host       string     `json:"host,omitempty"` // remote host to run on, see remote.go
+	Args       []string   `json:"argv"`           // full argv including argv[0]
+	Env        []string   `json:"env,omitempty"`  // additional environment variables NAME=value from metadata env_NAME
+	FIFOs      []string   `json:"fifos"`          // named pipes to be created for the inports of this process
+	Ports      []PortPlan `json:"ports"`          // named pipe of each inport and outport
+	IIPs       []IIPPlan  `json:"iips"`
+}
+
+// PortPlan holds the named pipe of a process port
+type PortPlan struct {
+	Port   string `json:"port"`
+	Inport bool   `json:"inport"` // otherwise outport
+	Path   string `json:"path"`
+}
+
+// IIPPlan holds information about the delivery of an IIP
+type IIPPlan struct {
+	Process string `json:"process"`
+	Port    string `json:"port"`
+	Path    string `json:"path,omitempty"` // named pipe to deliver the IIP frame into; empty for ARGS = delivered as program arguments
+	Data    string `json:"data"`
+	// body type and content-type header of the IIP frame, see iip.go
+	BodyType    string `json:"bodyType,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// NetworkPlan is the launch plan for a whole network, as printed by -plan
+type NetworkPlan struct {
+	Processes []*ProcessPlan `json:"processes"`
+	Merges    []*FanIn       `json:"merges"`  // inports with multiple upstreams merged by flowd
+	NetIns    []*NetEndpoint `json:"netins"`  // network inports handled by flowd
+	NetOuts   []*NetEndpoint `json:"netouts"` // network outports handled by flowd
+	Replays   []*Replay      `json:"replays"` // capture files fed into inports by flowd
+	Bridges   []*Bridge      `json:"bridges"` // connections crossing hosts, copied by flowd
+	FIFOs     []string       `json:"fifos"`   // all named pipes to be created
+	IIPs      []IIPPlan      `json:"iips"`
+}
+
+// planInstance generates the argv, named pipes and IIP deliveries for a process, without changing anything
+func planInstance(proc *Process, nw *fbp.Fbp) (*ProcessPlan, error) {
+	plan := &ProcessPlan{
+		Name:      proc.Name,
+		Component: proc.Path,
+		Args:      []string{proc.Name},
+		FIFOs:     []string{},
+		Ports:     []PortPlan{},
+		IIPs:      []IIPPlan{},
+	}
+	if host := proc.Metadata[hostMetadata]; host != "" {
+		// NOTE: component path is resolved on the remote host
+		plan.Host = host
+	} else if executable, err := exec.LookPath(proc.Path); err == nil {
+		plan.Executable = executable
+	}
+	for key, value := range proc.Metadata {
+		if strings.HasPrefix(key, envMetadataPrefix) {
+			plan.Env = append(plan.Env, strings.TrimPrefix(key, envMetadataPrefix)+"="+value)
+		}
+	}
+	sort.Strings(plan.Env)
+	// add ports for IIPs
+	inports := append([]Port{}, proc.InPorts...)
+	for _, iip := range proc.IIPs {
+		if iip.Port != "ARGS" {
+			// regular IIP - make port for that and create named pipe and deliver IIP
+			inports = append(inports, Port{
+				LocalPort: iip.Port,
+				// leave RemotePort and RemotePort unset
+			})
+		}
+	}
+	// add port for runtime configuration, see conf.go
+	if needsConfPort(proc) {
+		inports = append(inports, Port{LocalPort: confPort})
+	}
+	/// add arguments for libunixfbp
+	var path string
+	inportsDone := map[string]bool{} // NOTE: inports with multiple upstreams are listed multiple times
+	for _, inport := range inports {
+		if inportsDone[inport.LocalPort] {
+			continue
+		}
+		inportsDone[inport.LocalPort] = true
+		path = ""
+		// check if this port is target of a network INPORT
+		// NOTE: if merged, the network INPORT is one of the upstreams and the port gets the merged named pipe
+		if _, merged := proc.FanIns[inport.LocalPort]; len(nw.Inports) > 0 && !merged {
+			for inPortName, inPort := range nw.Inports {
+				if inPort.Process == proc.Name && inPort.Port == inport.LocalPort {
+					// this component is target of a network INPORT
+					///TODO see what makes more sense -- the unixfbp parameters would be consistent and are given automatically by flowd (could make exception for subnets), but nwName and using that as prefix is simpler and less parsing
+					//path = fmt.Sprintf("/dev/shm/%s.%s", nwName, inPortName)
+					path = unixfbp.InPorts[inPortName].Path
+					if debug {
+						fmt.Println("yes, INPORT-connected: INPORT", inPortName, "goes into component", proc.Name, "port", inport.LocalPort)
+					}
+					break
+				}
+			}
+		}
+		if path == "" {
+			// make that named pipe (FIFO)
+			path = fifoPath(proc.Name, inport.LocalPort)
+			plan.FIFOs = append(plan.FIFOs, path)
+		}
+		// append to arguments
+		plan.Args = append(plan.Args, "-inport", inport.LocalPort, "-inpath", path) //TODO optimize string concatenation
+		plan.Ports = append(plan.Ports, PortPlan{Port: inport.LocalPort, Inport: true, Path: path})
+	}
+	for _, outport := range proc.OutPorts {
+		path = ""
+		// check if this port is source of a network OUTPORT
+		if len(nw.Outports) > 0 {
+			for outPortName, outPort := range nw.Outports {
+				if outPort.Process == proc.Name && outPort.Port == outport.LocalPort {
+					// this component is source of a network OUTPORT
+					//path = fmt.Sprintf("/dev/shm/%s.%s", nwName, outPortName)
+					path = unixfbp.OutPorts[outPortName].Path
+					if debug {
+						fmt.Println("yes, OUTPORT-connected: component", proc.Name, "port", outport.LocalPort, "goes into OUTPORT", outPortName)
+					}
+					break
+				}
+			}
+		}
+		if path == "" && outport.Path != "" {
+			// separate named pipe, eg. for merging by flowd
+			path = outport.Path
+		} else if path == "" {
+			// named pipe of the downstream inport
+			// NOTE: create it only once - otherwise both ends would create their own version, creating weird timing-based hangs
+			path = fifoPath(outport.RemoteProc, outport.RemotePort)
+		}
+		// append to arguments
+		plan.Args = append(plan.Args, "-outport="+outport.LocalPort, "-outpath="+path) //TODO optimize string concatenation
+		plan.Ports = append(plan.Ports, PortPlan{Port: outport.LocalPort, Path: path})
+	}
+	// IIPs: ARGS go into component argv, others need named pipes
+	for _, iip := range proc.IIPs {
+		if iip.Port == "ARGS" {
+			// add free arguments
+			args, err := shellquote.Split(iip.Data)
+			if err != nil {
+				return nil, fmt.Errorf("could not split arguments in IIP to ARGS for component %s: %s", proc.Name, err)
+			}
+			plan.Args = append(plan.Args, args...)
+			plan.IIPs = append(plan.IIPs, IIPPlan{Process: proc.Name, Port: iip.Port, Data: iip.Data})
+		} else {
+			plan.IIPs = append(plan.IIPs, IIPPlan{Process: proc.Name, Port: iip.Port, Path: fifoPath(proc.Name, iip.Port), Data: iip.Data, BodyType: iip.BodyType, ContentType: iip.ContentType})
+		}
+	}
+	return plan, nil
+}
+
+// planNetwork generates the launch plans for all processes of the network
+func planNetwork(procs Network, nw *fbp.Fbp, fanIns []*FanIn, netins []*NetEndpoint, netouts []*NetEndpoint, replays []*Replay) (*NetworkPlan, error) {
+	plan := &NetworkPlan{Processes: []*ProcessPlan{}, Merges: []*FanIn{}, NetIns: []*NetEndpoint{}, NetOuts: []*NetEndpoint{}, Replays: []*Replay{}, FIFOs: []string{}, IIPs: []IIPPlan{}}
+	plan.Merges = append(plan.Merges, fanIns...)
+	plan.NetIns = append(plan.NetIns, netins...)
+	plan.NetOuts = append(plan.NetOuts, netouts...)
+	plan.Replays = append(plan.Replays, replays...)
+	fifos := map[string]bool{}
+	for _, proc := range procs {
+		procPlan, err := planInstance(proc, nw)
+		if err != nil {
+			return nil, err
+		}
+		plan.Processes = append(plan.Processes, procPlan)
+		for _, path := range procPlan.FIFOs {
+			fifos[path] = true
+		}
+		plan.IIPs = append(plan.IIPs, procPlan.IIPs...)
+	}
+	sort.Slice(plan.Processes, func(i, j int) bool { return plan.Processes[i].Name < plan.Processes[j].Name })
+	sort.Slice(plan.IIPs, func(i, j int) bool {
+		return plan.IIPs[i].Process+"."+plan.IIPs[i].Port < plan.IIPs[j].Process+"."+plan.IIPs[j].Port
+	})
+	// named pipes created by flowd itself
+	for _, fanIn := range fanIns {
+		fifos[fanIn.Path] = true
+		for _, upstream := range fanIn.Upstreams {
+			if upstream.RemoteProc != "NETIN" {
+				fifos[upstream.Path] = true
+			}
+		}
+	}
+	for _, netin := range netins {
+		fifos[unixfbp.InPorts[netin.Port].Path] = true
+	}
+	for _, netout := range netouts {
+		fifos[unixfbp.OutPorts[netout.Port].Path] = true
+	}
+	for _, replay := range replays {
+		fifos[replay.Path] = true
+	}
+	for path := range fifos {
+		plan.FIFOs = append(plan.FIFOs, path)
+	}
+	sort.Strings(plan.FIFOs)
+	plan.Bridges = planBridges(plan.Processes, plan.IIPs)
+	return plan, nil
+}
+
+// printPlan outputs the launch plan in human-readable form or as JSON
+func printPlan(plan *NetworkPlan, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	case "text":
+	default:
+		return fmt.Errorf("unknown output format '%s' - expected text or json", format)
+	}
+	fmt.Println("processes:")
+	for _, proc := range plan.Processes {
+		executable := proc.Executable
+		if proc.Host != "" {
+			executable = "on host " + proc.Host + " via " + sshDestination(proc.Host)
+		} else if executable == "" {
+			executable = "NOT FOUND"
+		}
+		fmt.Printf("  %s (component: %s, executable: %s)\n", proc.Name, proc.Component, executable)
+		fmt.Printf("    argv: %s\n", shellquote.Join(proc.Args...))
+		if len(proc.Env) > 0 {
+			fmt.Printf("    env: %s\n", shellquote.Join(proc.Env...))
+		}
+	}
+	if len(plan.Merges) > 0 {
+		fmt.Println("merged inports:")
+		for _, fanIn := range plan.Merges {
+			upstreams := []string{}
+			for _, upstream := range fanIn.Upstreams {
+				upstreams = append(upstreams, fmt.Sprintf("%s.%s via %s", upstream.RemoteProc, upstream.RemotePort, upstream.Path))
+			}
+			record := ""
+			if fanIn.Record != "" {
+				record = ", recorded into " + fanIn.Record
+			}
+			fmt.Printf("  %s.%s (order: %s%s) <- %s\n", fanIn.Proc, fanIn.Port, fanIn.Order, record, strings.Join(upstreams, ", "))
+		}
+	}
+	if len(plan.Replays) > 0 {
+		fmt.Println("replays:")
+		for _, replay := range plan.Replays {
+			fmt.Printf("  %s -> %s.%s (pace: %s) via %s\n", replay.File, replay.Proc, replay.Port, replay.Pace, replay.Path)
+		}
+	}
+	if len(plan.NetIns) > 0 || len(plan.NetOuts) > 0 {
+		fmt.Println("network port endpoints:")
+		for _, netin := range plan.NetIns {
+			fmt.Printf("  inport %s on %s %s via %s\n", netin.Port, netin.Network, netin.Address, unixfbp.InPorts[netin.Port].Path)
+		}
+		for _, netout := range plan.NetOuts {
+			fmt.Printf("  outport %s on %s %s via %s\n", netout.Port, netout.Network, netout.Address, unixfbp.OutPorts[netout.Port].Path)
+		}
+	}
+	if len(plan.Bridges) > 0 {
+		fmt.Println("bridges between hosts:")
+		for _, bridge := range plan.Bridges {
+			fmt.Printf("  %s -> %s via %s\n", bridgeEnd(bridge.Writer, bridge.FromHost), bridgeEnd(bridge.Reader, bridge.ToHost), bridge.Path)
+		}
+	}
+	fmt.Println("named pipes:")
+	for _, path := range plan.FIFOs {
+		fmt.Printf("  %s\n", path)
+	}
+	fmt.Println("IIPs:")
+	for _, iip := range plan.IIPs {
+		delivery := "as program arguments"
+		if iip.Path != "" {
+			delivery = "via " + iip.Path
+		}
+		if iip.BodyType != "" {
+			delivery += ", type " + iip.BodyType
+		}
+		if iip.ContentType != "" {
+			delivery += ", content-type " + iip.ContentType
+		}
+		fmt.Printf("  '%s' -> %s %s (%s)\n", iip.Data, iip.Port, iip.Process, delivery)
+	}
+	return nil
+}
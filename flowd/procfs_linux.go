@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// fGetPipeSz is F_GETPIPE_SZ, not available in package syscall
+const fGetPipeSz = 1032
+
+// inspectProcess reads the state of a process from /proc
+func inspectProcess(pid int) (*procSnapshot, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	snapshot := &procSnapshot{open: map[string]bool{}}
+	// opened files
+	fds, err := readDirNames(dir + "/fd")
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		if target, err := os.Readlink(dir + "/fd/" + fd); err == nil {
+			snapshot.open[target] = true
+		}
+	}
+	// state of threads
+	tasks, err := readDirNames(dir + "/task")
+	if err != nil {
+		return nil, err
+	}
+	wchans := map[string]bool{}
+	for _, task := range tasks {
+		// NOTE: first field is the number of the system call the thread is blocked in
+		if syscallBytes, err := ioutil.ReadFile(dir + "/task/" + task + "/syscall"); err == nil {
+			fields := strings.Fields(string(syscallBytes))
+			if len(fields) > 0 && fields[0] == strconv.Itoa(syscall.SYS_OPENAT) {
+				snapshot.inOpen = true
+			}
+		}
+		if wchanBytes, err := ioutil.ReadFile(dir + "/task/" + task + "/wchan"); err == nil {
+			wchan := strings.TrimSpace(string(wchanBytes))
+			if wchan != "" && wchan != "0" && !wchans[wchan] {
+				wchans[wchan] = true
+				snapshot.wchans = append(snapshot.wchans, wchan)
+			}
+		}
+	}
+	// read progress
+	ioFile, err := os.Open(dir + "/io")
+	if err != nil {
+		return nil, err
+	}
+	defer ioFile.Close()
+	scanner := bufio.NewScanner(ioFile)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "rchar:") {
+			snapshot.readBytes, _ = strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "rchar:")), 10, 64)
+		}
+	}
+	return snapshot, scanner.Err()
+}
+
+// readDirNames returns the names of the entries in a directory
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+// pipeFill returns the number of bytes in the buffer of a named pipe and its capacity
+// NOTE: opens the named pipe for reading without reading anything - only use if the reader already has opened it,
+// otherwise a writer blocked in opening it would continue
+func pipeFill(path string) (queued int, capacity int, err error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer syscall.Close(fd)
+	var count int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCINQ, uintptr(unsafe.Pointer(&count))); errno != 0 {
+		return 0, 0, errno
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fGetPipeSz, 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(count), int(size), nil
+}
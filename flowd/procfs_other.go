@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errNoProcfs = errors.New("process inspection is only available on Linux")
+
+// inspectProcess reads the state of a process from /proc
+func inspectProcess(pid int) (*procSnapshot, error) {
+	return nil, errNoProcfs
+}
+
+// pipeFill returns the number of bytes in the buffer of a named pipe and its capacity
+func pipeFill(path string) (queued int, capacity int, err error) {
+	return 0, 0, errNoProcfs
+}
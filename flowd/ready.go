@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ERnsTL/flowd/libunixfbp"
+)
+
+/*
+Readiness signaling and dependency-ordered startup.
+
+By default, a process counts as ready once it has been started. Using process metadata ready=signal, a process counts
+as ready only once it has signaled readiness: flowd passes it the write end of a pipe as file descriptor 3 and sets
+the environment variable FLOWD_READY_FD=3, the component writes the line READY into it, see libunixfbp.Ready().
+Using ready=exit, a process counts as ready only once it has exited, eg. a batch step preparing data for others.
+
+Using process metadata after=A/B, a process is only started once the processes A and B are ready or have exited.
+NOTE: the separator is "/", because "," separates the metadata entries in .fbp network definitions.
+
+Once all processes are ready, flowd reports "network ready" and itself signals readiness the same way, so that an
+outer flowd or systemd with a unit of Type=notify knows it.
+*/
+
+const (
+	readyMetadata  = "ready"  // readiness mode of a process
+	readySignal    = "signal" // ready once the process has signaled readiness
+	readyExit      = "exit"   // ready once the process has exited, eg. for batch steps
+	afterMetadata  = "after"  // processes to wait for before starting a process
+	afterSeparator = "/"      // separator of process names in after=
+	readyFDEnv     = "FLOWD_READY_FD"
+	readyLine      = "READY"
+
+	envMetadataPrefix = "env_" // environment variables of a process are given as metadata env_NAME=value
+)
+
+// startupState holds the readiness of all processes of the network
+type startupState struct {
+	mutex    sync.Mutex
+	ready    map[string]chan struct{} // closed once the process is ready or has exited
+	pending  int                      // processes not yet ready
+	started  time.Time
+	complete time.Time     // zero until all processes are ready
+	canceled chan struct{} // closed once the network is shutting down
+}
+
+// startup is the readiness state of the running network
+var startup *startupState
+
+// newStartupState prepares readiness tracking for the given processes
+func newStartupState(procs Network) *startupState {
+	s := &startupState{ready: map[string]chan struct{}{}, pending: len(procs), started: time.Now(), canceled: make(chan struct{})}
+	for name := range procs {
+		s.ready[name] = make(chan struct{})
+	}
+	// NOTE: the readiness pipe of an outer flowd must not be inherited by the components, otherwise it would not get EOF on exit
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	return s
+}
+
+// markReady records that a process is ready, returns whether this was news
+// NOTE: once all processes are ready, the network is reported ready
+func (s *startupState) markReady(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ready, found := s.ready[name]
+	if !found {
+		return false
+	}
+	select {
+	case <-ready:
+		return false
+	default:
+	}
+	close(ready)
+	s.pending--
+	if s.pending == 0 {
+		s.complete = time.Now()
+		if !quiet {
+			fmt.Printf("INFO: network ready after %s\n", s.complete.Sub(s.started))
+		}
+		// NOTE: for an outer flowd or systemd
+		if err := unixfbp.Ready(); err != nil {
+			fmt.Println("WARNING: signaling readiness:", err)
+		}
+	}
+	return true
+}
+
+// waitFor blocks until the given processes are ready, returns false if the network is shutting down
+func (s *startupState) waitFor(names []string) bool {
+	for _, name := range names {
+		select {
+		case <-s.ready[name]:
+		case <-s.canceled:
+			return false
+		}
+	}
+	select {
+	case <-s.canceled:
+		return false
+	default:
+		return true
+	}
+}
+
+// cancel lets processes still waiting to be started give up
+func (s *startupState) cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.canceled:
+	default:
+		close(s.canceled)
+	}
+}
+
+// isReady returns whether all processes have become ready, and when
+func (s *startupState) isReady() (bool, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pending == 0, s.complete
+}
+
+// startupOrder returns the processes each process has to wait for, checking that they exist and contain no cycle
+// NOTE: call after detectFanIns, which passes some connections through flowd
+func startupOrder(procs Network) (map[string][]string, error) {
+	after := map[string][]string{}
+	waitsFor := map[string]map[string]string{}
+	for name, proc := range procs {
+		value := proc.Metadata[afterMetadata]
+		if value == "" {
+			continue
+		}
+		for _, other := range strings.Split(value, afterSeparator) {
+			if _, found := procs[other]; !found {
+				return nil, fmt.Errorf("process %s: %s=%s: no such process %s", name, afterMetadata, value, other)
+			}
+			if mode := procs[other].Metadata[readyMetadata]; (mode == readySignal || mode == readyExit) && directlyConnected(proc, procs[other]) {
+				// NOTE: the other process would block in opening the named pipe to this one, never becoming ready
+				return nil, fmt.Errorf("process %s: %s=%s: directly connected to %s, which is %s=%s and would wait for it forever", name, afterMetadata, value, other, readyMetadata, mode)
+			}
+			after[name] = append(after[name], other)
+			if waitsFor[name] == nil {
+				waitsFor[name] = map[string]string{}
+			}
+			waitsFor[name][other] = ""
+		}
+		sort.Strings(after[name])
+	}
+	if cycles := findCycles(waitsFor); len(cycles) > 0 {
+		return nil, fmt.Errorf("startup order contains a cycle: %s -> %s", strings.Join(cycles[0], " -> "), cycles[0][0])
+	}
+	return after, nil
+}
+
+// directlyConnected returns whether the processes are connected by named pipes, not passing through flowd
+func directlyConnected(a *Process, b *Process) bool {
+	for _, pair := range [][2]*Process{{a, b}, {b, a}} {
+		for _, outport := range pair[0].OutPorts {
+			if outport.RemoteProc == pair[1].Name && outport.Path == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readinessPipe returns the pipe through which the process signals readiness, or nil if it is ready once started
+// NOTE: the write end is passed to the component as file descriptor 3 = first of ExtraFiles
+func readinessPipe(proc *Process) (reader *os.File, writer *os.File, err error) {
+	if proc.Metadata[readyMetadata] != readySignal {
+		return nil, nil, nil
+	}
+	return os.Pipe()
+}
+
+// componentEnv returns the environment for a component, with the given additional variables from its metadata
+// NOTE: without the readiness settings of flowd itself, which are meant for an outer flowd or systemd
+func componentEnv(extra []string, signal bool) (env []string) {
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, readyFDEnv+"=") && !strings.HasPrefix(entry, "NOTIFY_SOCKET=") {
+			env = append(env, entry)
+		}
+	}
+	// NOTE: later entries take precedence
+	env = append(env, extra...)
+	if signal {
+		env = append(env, readyFDEnv+"=3")
+	}
+	return env
+}
+
+// awaitReadySignal marks the process ready once it has written the ready line
+func awaitReadySignal(name string, reader *os.File) {
+	defer reader.Close()
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == readyLine {
+			if startup.markReady(name) && !quiet {
+				fmt.Printf("INFO: process %s ready\n", name)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/ERnsTL/flowd/libunixfbp"
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Recording and replaying of frames on connections.
+
+Using -record PROCESS.PORT=file, all frames going into that inport are appended to the capture file. The connection
+is then handled like a merged inport, see fanin.go. The capture file contains the frames in the usual framing format,
+each with an additional header field containing the time it was forwarded, so it can be read using flowd.Deserialize():
+
+	2data
+	type:LineData
+	recorded:2017-10-19T14:03:12.123456789+02:00
+	length:11
+
+	hello world\0
+
+Using -replay PROCESS.PORT=file, the frames of a capture file are fed into that inport, either at the original pacing
+or as fast as possible (-replay-pace). If that inport is already connected, the replayed frames are merged with it.
+*/
+
+// replay pacing
+const (
+	paceOriginal = "original" // keep the time between the frames as recorded
+	paceFast     = "fast"     // as fast as the receiving process reads
+)
+
+// recordedHeader is the header field in capture files holding the time a frame was recorded
+const recordedHeader = "recorded"
+
+// Capture is a capture file, into which frames are recorded
+type Capture struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// openCapture opens the capture file for appending, creating it if it does not exist
+func openCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Write appends the frame with the current time to the capture file
+// NOTE: flushed after each frame, so that the capture is complete in case flowd gets killed
+func (c *Capture) Write(frame *flowd.Frame) error {
+	return c.writeAt(frame, time.Now())
+}
+
+func (c *Capture) writeAt(frame *flowd.Frame, at time.Time) error {
+	// NOTE: copy of the frame, which is forwarded and may be in use elsewhere
+	recorded := *frame
+	recorded.Extensions = map[string]string{}
+	for key, value := range frame.Extensions {
+		recorded.Extensions[key] = value
+	}
+	recorded.Extensions[recordedHeader] = at.Format(time.RFC3339Nano)
+	if err := recorded.Serialize(c.writer); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Close flushes and closes the capture file
+func (c *Capture) Close() error {
+	if err := c.writer.Flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+// Replay holds information about a capture file to be fed into a process inport
+type Replay struct {
+	Proc string `json:"process"` // name of the receiving process
+	Port string `json:"port"`    // name of the receiving inport
+	Path string `json:"path"`    // named pipe the frames are written into
+	File string `json:"file"`    // capture file
+	Pace string `json:"pace"`    // one of the pace* constants above
+}
+
+// bindReplays adds network inports for the process inports to be replayed into and registers their named pipes for startInstance()
+// NOTE: like network inports, they are merged if the inport is already connected
+func bindReplays(nw *fbp.Fbp, replayFiles keyValueFlag, pace string) (replays []*Replay, err error) {
+	if pace != paceOriginal && pace != paceFast {
+		return nil, fmt.Errorf("unknown replay pace '%s' - expected %s or %s", pace, paceOriginal, paceFast)
+	}
+	if nw.Inports == nil {
+		nw.Inports = map[string]*fbp.Endpoint{}
+	}
+	for name, file := range replayFiles {
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("replay %s: expected PROCESS.PORT", name)
+		}
+		found := false
+		for _, proc := range nw.Processes {
+			if proc.Name == parts[0] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("replay %s: no such process %s", name, parts[0])
+		}
+		if _, exists := nw.Inports[name]; exists {
+			return nil, fmt.Errorf("replay %s: inport is already bound", name)
+		}
+		if _, err = os.Stat(file); err != nil {
+			return nil, fmt.Errorf("replay %s: %s", name, err)
+		}
+		replay := &Replay{Proc: parts[0], Port: parts[1], Path: fifoPath("REPLAY", name), File: file, Pace: pace}
+		nw.Inports[name] = &fbp.Endpoint{Process: replay.Proc, Port: replay.Port}
+		unixfbp.InPorts[name] = unixfbp.InPort{Path: replay.Path}
+		replays = append(replays, replay)
+	}
+	return replays, nil
+}
+
+// startReplay creates the named pipe for the replay and feeds the capture file into it
+// NOTE: opening the named pipe blocks until the receiving process has opened it, so this happens in a Goroutine
+func startReplay(replay *Replay) {
+	syscall.Mkfifo(replay.Path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+	go func() {
+		file, err := os.Open(replay.File)
+		if err != nil {
+			fmt.Printf("ERROR: opening capture file for replay into %s.%s: %s\n", replay.Proc, replay.Port, err)
+			return
+		}
+		defer file.Close()
+		outPipe, err := os.OpenFile(replay.Path, os.O_WRONLY, os.ModeNamedPipe)
+		if err != nil {
+			fmt.Printf("ERROR: opening pipe to %s.%s at path %s for replay: %s\n", replay.Proc, replay.Port, replay.Path, err)
+			return
+		}
+		// NOTE: closing gives EOF to the receiving process
+		defer outPipe.Close()
+		count, err := replayFrames(bufio.NewReader(file), bufio.NewWriter(outPipe), replay.Port, replay.Pace == paceOriginal, time.Sleep)
+		if err != nil {
+			fmt.Printf("ERROR: replaying %s into %s.%s after %d frames: %s\n", replay.File, replay.Proc, replay.Port, count, err)
+			return
+		}
+		if !quiet {
+			fmt.Printf("replayed %d frames from %s into %s.%s\n", count, replay.File, replay.Proc, replay.Port)
+		}
+	}()
+}
+
+// replayFrames copies the frames from the capture into the writer without the recorded header field, returns the number of frames replayed
+// NOTE: if paced, sleep is called with the time between the recorded frames
+func replayFrames(capture *bufio.Reader, out *bufio.Writer, port string, paced bool, sleep func(time.Duration)) (count int, err error) {
+	var last time.Time
+	for {
+		frame, err := flowd.Deserialize(capture)
+		if err != nil {
+			if err == io.EOF {
+				return count, out.Flush()
+			}
+			return count, err
+		}
+		if value, found := frame.Extensions[recordedHeader]; found {
+			delete(frame.Extensions, recordedHeader)
+			if paced {
+				at, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					return count, fmt.Errorf("frame %d: %s header: %s", count+1, recordedHeader, err)
+				}
+				if !last.IsZero() && at.After(last) {
+					// send out what is buffered before waiting
+					if err = out.Flush(); err != nil {
+						return count, err
+					}
+					sleep(at.Sub(last))
+				}
+				last = at
+			}
+		}
+		frame.Port = port
+		if err = frame.Serialize(out); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
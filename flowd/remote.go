@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kballard/go-shellquote"
+)
+
+/*
+Distributed placement of processes on remote hosts.
+
+Using process metadata host=NAME, the process is launched on that host using ssh, so keys, ssh-agent and
+~/.ssh/config apply. NAME can be mapped to an ssh destination like user@db1.example.com using -host NAME=destination,
+since .fbp metadata values cannot contain "." or "@". On the remote host, the named pipes have the same paths as
+locally, the component is run in the same working directory (or the one given using -remote-dir) and IIPs are
+delivered there. The output of the component and its exit status come back through ssh, exit status 255 as 254,
+since ssh exits with 255 if the connection failed.
+
+Each connection crossing hosts is bridged through flowd: the frames are copied from the named pipe on the writing
+host into the named pipe of the same path on the reading host, using "cat" over ssh for remote ends.
+
+NOTE: remote processes are ready once started, ready=signal is not supported for them.
+NOTE: if ssh exits, eg. because flowd is terminated, the remote component is killed.
+*/
+
+const (
+	hostMetadata = "host"
+	sshFailed    = 255 // exit code of ssh if the connection failed; of the component mapped to 254, see remoteScript()
+)
+
+var (
+	// sshHosts maps host names to ssh destinations
+	sshHosts = keyValueFlag{}
+	// remoteDir is the working directory on remote hosts, empty = same as local
+	remoteDir string
+)
+
+// Bridge copies the frames of a connection crossing hosts through flowd
+type Bridge struct {
+	Path     string `json:"path"`     // named pipe path on both hosts
+	FromHost string `json:"fromHost"` // host of the writing side, empty = local
+	ToHost   string `json:"toHost"`   // host of the reading side, empty = local
+	Writer   string `json:"writer"`   // writing process.port, empty if flowd itself
+	Reader   string `json:"reader"`   // reading process.port, empty if flowd itself
+}
+
+// sshDestination returns the ssh destination for the host name
+func sshDestination(host string) string {
+	if destination, found := sshHosts[host]; found {
+		return destination
+	}
+	return host
+}
+
+// planBridges returns the bridges required for connections between processes on different hosts
+// NOTE: named pipes not written or read by a process are handled by flowd locally, except IIPs which are delivered on the host of the process
+func planBridges(processes []*ProcessPlan, iips []IIPPlan) []*Bridge {
+	hosts := map[string]string{}
+	for _, proc := range processes {
+		hosts[proc.Name] = proc.Host
+	}
+	bridges := map[string]*Bridge{}
+	bridgeFor := func(path string) *Bridge {
+		if bridges[path] == nil {
+			bridges[path] = &Bridge{Path: path}
+		}
+		return bridges[path]
+	}
+	for _, iip := range iips {
+		if iip.Path != "" {
+			bridgeFor(iip.Path).FromHost = hosts[iip.Process]
+		}
+	}
+	for _, proc := range processes {
+		for _, port := range proc.Ports {
+			bridge := bridgeFor(port.Path)
+			if port.Inport {
+				bridge.ToHost, bridge.Reader = proc.Host, proc.Name+"."+port.Port
+			} else {
+				bridge.FromHost, bridge.Writer = proc.Host, proc.Name+"."+port.Port
+			}
+		}
+	}
+	crossing := []*Bridge{}
+	for _, bridge := range bridges {
+		if bridge.FromHost != bridge.ToHost {
+			crossing = append(crossing, bridge)
+		}
+	}
+	sort.Slice(crossing, func(i, j int) bool { return crossing[i].Path < crossing[j].Path })
+	return crossing
+}
+
+// remoteScript returns the shell script launching the process on its remote host
+func remoteScript(plan *ProcessPlan, workDir string) string {
+	lines := []string{"set -e", "cd " + shellquote.Join(workDir)}
+	for _, variable := range plan.Env {
+		lines = append(lines, "export "+shellquote.Join(variable))
+	}
+	// named pipes of the ports, which may also be created by other processes on the same host
+	dirs := map[string]bool{}
+	for _, port := range plan.Ports {
+		dirs[filepath.Dir(port.Path)] = true
+	}
+	for dir := range dirs {
+		lines = append(lines, "mkdir -p "+shellquote.Join(dir))
+	}
+	for _, port := range plan.Ports {
+		quoted := shellquote.Join(port.Path)
+		lines = append(lines, fmt.Sprintf("[ -p %s ] || mkfifo -m 0770 %s 2>/dev/null || [ -p %s ]", quoted, quoted, quoted))
+	}
+	// NOTE: opening a named pipe blocks until the component has opened it, thus in background
+	for _, iip := range plan.IIPs {
+		if iip.Path != "" {
+			// NOTE: same frame as flowd sends, see framing format
+			lines = append(lines, iipPrintf(iip, shellquoteWord)+" > "+shellquote.Join(iip.Path)+" &")
+		}
+	}
+	// NOTE: once ssh exits, its STDIN gets EOF, then the component is killed
+	// NOTE: background commands get /dev/null as STDIN, thus the watchdog reads it as file descriptor 3
+	lines = append(lines,
+		"set +e",
+		"exec 3<&0",
+		shellquote.Join(append([]string{plan.Component}, plan.Args[1:]...)...)+" < /dev/null 3<&- &",
+		"pid=$!",
+		"(cat <&3 > /dev/null; kill $pid 2>/dev/null) &",
+		"watchdog=$!",
+		"exec 3<&-",
+		"wait $pid",
+		"status=$?",
+		"kill $watchdog 2>/dev/null",
+		// NOTE: 255 is taken by ssh for connection failures
+		"if [ $status -eq 255 ]; then status=254; fi",
+		"exit $status",
+	)
+	return strings.Join(lines, "\n")
+}
+
+// remoteCommand returns the command launching the process on its remote host using ssh
+func remoteCommand(plan *ProcessPlan) (*exec.Cmd, error) {
+	workDir := remoteDir
+	if workDir == "" {
+		var err error
+		if workDir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	return exec.Command("ssh", "-T", "-o", "BatchMode=yes", sshDestination(plan.Host), remoteScript(plan, workDir)), nil
+}
+
+// startBridge copies the frames from the writing host to the reading host
+// NOTE: opening the named pipes blocks until the other side has opened them, so this happens in a Goroutine
+func startBridge(bridge *Bridge) {
+	name := fmt.Sprintf("bridge %s -> %s", bridgeEnd(bridge.Writer, bridge.FromHost), bridgeEnd(bridge.Reader, bridge.ToHost))
+	// NOTE: the local named pipe must exist before the local process opens it
+	if bridge.FromHost == "" || bridge.ToHost == "" {
+		syscall.Mkfifo(bridge.Path, syscall.S_IFIFO|syscall.S_IRWXU|syscall.S_IRWXG)
+	}
+	go func() {
+		quoted := shellquote.Join(bridge.Path)
+		mkfifo := fmt.Sprintf("mkdir -p %s; [ -p %s ] || mkfifo -m 0770 %s 2>/dev/null; ", shellquote.Join(filepath.Dir(bridge.Path)), quoted, quoted)
+		var source io.ReadCloser
+		var sink io.WriteCloser
+		var commands []*exec.Cmd
+		// writing side
+		if bridge.FromHost != "" {
+			cmd := exec.Command("ssh", "-T", "-o", "BatchMode=yes", sshDestination(bridge.FromHost), mkfifo+"exec cat < "+quoted)
+			cmd.Stderr = os.Stderr
+			stdout, err := cmd.StdoutPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				fmt.Printf("ERROR: starting %s: %s\n", name, err)
+				return
+			}
+			source, commands = stdout, append(commands, cmd)
+		}
+		// reading side
+		if bridge.ToHost != "" {
+			cmd := exec.Command("ssh", "-T", "-o", "BatchMode=yes", sshDestination(bridge.ToHost), mkfifo+"exec cat > "+quoted)
+			cmd.Stderr = os.Stderr
+			stdin, err := cmd.StdinPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				fmt.Printf("ERROR: starting %s: %s\n", name, err)
+				return
+			}
+			sink, commands = stdin, append(commands, cmd)
+		}
+		// open local named pipes
+		var err error
+		if source == nil {
+			if source, err = os.OpenFile(bridge.Path, os.O_RDONLY, os.ModeNamedPipe); err != nil {
+				fmt.Printf("ERROR: opening pipe for %s: %s\n", name, err)
+				return
+			}
+		}
+		if sink == nil {
+			if sink, err = os.OpenFile(bridge.Path, os.O_WRONLY, os.ModeNamedPipe); err != nil {
+				fmt.Printf("ERROR: opening pipe for %s: %s\n", name, err)
+				return
+			}
+		}
+		// copy until the writing side closes, then close the reading side
+		count, err := io.Copy(sink, source)
+		if err != nil {
+			fmt.Printf("ERROR: %s after %d bytes: %s\n", name, count, err)
+		}
+		source.Close()
+		sink.Close()
+		for _, cmd := range commands {
+			cmd.Wait()
+		}
+		if debug {
+			fmt.Printf("DEBUG: %s done after %d bytes\n", name, count)
+		}
+	}()
+}
+
+// bridgeEnd returns a description of one side of a bridge for display
+func bridgeEnd(port string, host string) string {
+	if port == "" {
+		port = "flowd"
+	}
+	if host == "" {
+		return port
+	}
+	return port + "@" + host
+}
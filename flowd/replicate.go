@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Process replication for data-parallel scaling.
+
+Using process metadata replicas=N (in .drw network definitions: Multiplex with MPXFactor), flowd launches N
+instances of the component, named PROC#0 to PROC#N-1, each getting the same IIPs. If the process has a connected
+inport, a load-balancer named PROC#lb is put in front of the instances, distributing the frames round-robin. The
+frames from the instances are merged into the downstream inports, see fanin.go.
+
+NOTE: the load-balancer component is expected next to the replicated component, eg. bin/load-balancer for bin/worker.
+*/
+
+const (
+	replicasMetadata = "replicas"
+	replicaSeparator = "#"
+	balancerSuffix   = "lb"
+	balancerInport   = "IN"
+	balancerOutport  = "OUT"
+)
+
+// replicateProcesses replaces the processes with replicas metadata by their instances plus a load-balancer
+func replicateProcesses(procs Network, nw *fbp.Fbp) error {
+	names := []string{}
+	for name, proc := range procs {
+		if _, found := proc.Metadata[replicasMetadata]; found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		proc := procs[name]
+		count, err := strconv.Atoi(proc.Metadata[replicasMetadata])
+		if err != nil || count < 1 {
+			return fmt.Errorf("process %s: %s=%s: expected number of instances", name, replicasMetadata, proc.Metadata[replicasMetadata])
+		}
+		if err = replicateProcess(procs, nw, proc, count); err != nil {
+			return fmt.Errorf("process %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func replicateProcess(procs Network, nw *fbp.Fbp, proc *Process, count int) error {
+	// checks
+	for _, outport := range proc.OutPorts {
+		if outport.RemoteProc == "NETOUT" {
+			return fmt.Errorf("outport %s is bound to network outport %s, which cannot merge the frames of multiple instances", outport.LocalPort, outport.RemotePort)
+		}
+	}
+	inport := ""
+	for _, port := range proc.InPorts {
+		if inport != "" && port.LocalPort != inport {
+			return fmt.Errorf("only one connected inport can be load-balanced, but got %s and %s", inport, port.LocalPort)
+		}
+		inport = port.LocalPort
+	}
+
+	// instances
+	instances := make([]string, count)
+	metadata := map[string]string{}
+	for key, value := range proc.Metadata {
+		if key != replicasMetadata {
+			metadata[key] = value
+		}
+	}
+	delete(procs, proc.Name)
+	for index := range instances {
+		instances[index] = fmt.Sprintf("%s%s%d", proc.Name, replicaSeparator, index)
+		instance := &Process{Path: proc.Path, Name: instances[index], InPorts: []Port{}, OutPorts: []Port{}, IIPs: append([]IIP{}, proc.IIPs...), Metadata: metadata}
+		if inport != "" {
+			instance.InPorts = append(instance.InPorts, Port{LocalPort: inport, RemotePort: fmt.Sprintf("%s[%d]", balancerOutport, index), RemoteProc: proc.Name + replicaSeparator + balancerSuffix})
+		}
+		instance.OutPorts = append(instance.OutPorts, proc.OutPorts...)
+		procs[instance.Name] = instance
+	}
+
+	// load-balancer in front
+	if inport != "" {
+		balancer := &Process{
+			Path:     filepath.Join(filepath.Dir(proc.Path), "load-balancer"),
+			Name:     proc.Name + replicaSeparator + balancerSuffix,
+			InPorts:  []Port{},
+			OutPorts: []Port{},
+			IIPs:     []IIP{},
+			Metadata: map[string]string{},
+		}
+		for _, port := range proc.InPorts {
+			balancer.InPorts = append(balancer.InPorts, Port{LocalPort: balancerInport, RemotePort: port.RemotePort, RemoteProc: port.RemoteProc})
+		}
+		for index, instance := range instances {
+			balancer.OutPorts = append(balancer.OutPorts, Port{LocalPort: fmt.Sprintf("%s[%d]", balancerOutport, index), RemotePort: inport, RemoteProc: instance})
+		}
+		procs[balancer.Name] = balancer
+		for _, endpoint := range nw.Inports {
+			if endpoint.Process == proc.Name {
+				endpoint.Process, endpoint.Port = balancer.Name, balancerInport
+			}
+		}
+	}
+
+	// reconnect the neighbors
+	for _, other := range procs {
+		for index, outport := range other.OutPorts {
+			if outport.RemoteProc == proc.Name {
+				other.OutPorts[index].RemoteProc, other.OutPorts[index].RemotePort = proc.Name+replicaSeparator+balancerSuffix, balancerInport
+			}
+		}
+		inports := []Port{}
+		for _, port := range other.InPorts {
+			if port.RemoteProc != proc.Name {
+				inports = append(inports, port)
+				continue
+			}
+			// NOTE: multiple upstreams into the same inport are merged by flowd
+			for _, instance := range instances {
+				inports = append(inports, Port{LocalPort: port.LocalPort, RemotePort: port.RemotePort, RemoteProc: instance})
+			}
+		}
+		other.InPorts = inports
+		// processes waiting for the replicated process wait for all instances
+		if value, found := other.Metadata[afterMetadata]; found {
+			after := []string{}
+			for _, name := range strings.Split(value, afterSeparator) {
+				if name == proc.Name {
+					after = append(after, instances...)
+				} else {
+					after = append(after, name)
+				}
+			}
+			other.Metadata[afterMetadata] = strings.Join(after, afterSeparator)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+)
+
+/*
+Runtime limit and scheduled runs of batch networks.
+
+Using -timeout, the network is shut down if it runs longer than the given time: all processes get SIGTERM, those
+still running after shutdownGrace get SIGKILL, and flowd exits with exitTimeout.
+
+Using -every or -cron, flowd runs the network repeatedly, each run as a separate flowd process with a fresh
+directory for the named pipes. Runs do not overlap; if a run takes longer than the interval, the next one starts
+right after it. Using -history, start, end and result of each run are recorded into a JSON file, including the number
+of processes exited unsuccessfully, which each run writes into its exit summary given using -summary.
+*/
+
+const (
+	exitTimeout   = 124 // exit code if the network exceeded -timeout, like timeout(1)
+	shutdownGrace = 10 * time.Second
+
+	// results of runs
+	runOK      = "ok"      // all processes exited successfully
+	runFailed  = "failed"  // some processes exited unsuccessfully, see RunSummary
+	runTimeout = "timeout" // network exceeded -timeout
+	runError   = "error"   // flowd could not be started or failed itself
+)
+
+// flags handled by the scheduler, not passed on to the runs; all take a value
+var scheduleFlags = map[string]bool{"every": true, "cron": true, "history": true, "fifodir": true, "summary": true}
+
+// runSummaryFile is the file for the exit summary of each run, in its directory for the named pipes
+const runSummaryFile = "summary.json"
+
+// RunRecord is the history entry of a scheduled run
+type RunRecord struct {
+	Run      int       `json:"run"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	ExitCode int       `json:"exitCode"`
+	Result   string    `json:"result"` // one of the run* constants above
+	// exit summary, if written by the run
+	Processes       int `json:"processes,omitempty"`
+	FailedProcesses int `json:"failedProcesses"`
+}
+
+// RunSummary is the exit summary of a network written using -summary
+// NOTE: flowd exits successfully even if processes exited unsuccessfully, so this is how scheduled runs know
+type RunSummary struct {
+	Processes       int `json:"processes"`
+	FailedProcesses int `json:"failedProcesses"` // exited unsuccessfully, not counting those stopped using the shell
+}
+
+// failedInstance returns whether the process instance exited unsuccessfully
+// NOTE: instancesLock must be held
+func failedInstance(proc *Process) bool {
+	instance := proc.Instance
+	if instance == nil || instance.Cmd == nil || instance.Cmd.ProcessState == nil || stops[proc.Name] {
+		// never started, eg. waiting for other processes during shutdown, or stopped on purpose
+		return false
+	}
+	return !instance.Cmd.ProcessState.Success()
+}
+
+// writeRunSummary writes the exit summary into the file given using -summary, if any
+func writeRunSummary(path string, summary RunSummary) {
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(summary)
+	if err == nil {
+		err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Println("ERROR: writing exit summary:", err)
+	}
+}
+
+// runScheduled runs the network periodically until interrupted, returns the exit code for flowd
+func runScheduled(flags *flag.FlagSet, args []string, every time.Duration, cronSchedule string, historyPath string) int {
+	if every > 0 && cronSchedule != "" {
+		fmt.Println("ERROR: cannot have both -every and -cron")
+		return 1
+	}
+	var schedule *cronexpr.Expression
+	if cronSchedule != "" {
+		var err error
+		if schedule, err = cronexpr.Parse(cronSchedule); err != nil {
+			fmt.Printf("ERROR: parsing cron expression '%s': %s\n", cronSchedule, err)
+			return 1
+		}
+	}
+	flowdPath, err := os.Executable()
+	if err != nil {
+		fmt.Println("ERROR: finding flowd executable:", err)
+		return 1
+	}
+	runArgs := scheduleRunArgs(flags, args)
+	history := []RunRecord{}
+	if historyPath != "" {
+		if history, err = loadRunHistory(historyPath); err != nil {
+			fmt.Println("ERROR: loading run history:", err)
+			return 1
+		}
+	}
+
+	// NOTE: with -every, the first run is right away
+	next := time.Now()
+	if schedule != nil {
+		next = schedule.Next(next)
+	}
+	for run := len(history) + 1; ; run++ {
+		if next.IsZero() {
+			fmt.Println("INFO: cron expression has no further run times. Exiting.")
+			return 0
+		}
+		if wait := time.Until(next); wait > 0 {
+			if !quiet {
+				fmt.Printf("INFO: next run %d at %s\n", run, next.Format(time.RFC3339))
+			}
+			time.Sleep(wait)
+		}
+		record := runOnce(flowdPath, runArgs, run)
+		if !quiet {
+			fmt.Printf("INFO: run %d finished after %s: %s\n", run, record.Duration, record.Result)
+		}
+		if historyPath != "" {
+			history = append(history, record)
+			if err = saveRunHistory(historyPath, history); err != nil {
+				fmt.Println("ERROR: saving run history:", err)
+			}
+		}
+		// next run time
+		if schedule != nil {
+			next = schedule.Next(time.Now())
+		} else if next = record.Start.Add(every); next.Before(record.End) {
+			fmt.Printf("WARNING: run %d took longer than the interval of %s\n", run, every)
+		}
+	}
+}
+
+// runOnce runs the network as separate flowd process using a fresh directory for the named pipes
+func runOnce(flowdPath string, runArgs []string, run int) (record RunRecord) {
+	record = RunRecord{Run: run, Start: time.Now(), Result: runError, ExitCode: -1}
+	defer func() {
+		record.End = time.Now()
+		record.Duration = record.End.Sub(record.Start).Round(time.Millisecond).String()
+	}()
+	dir, err := ioutil.TempDir(fifoDir, fmt.Sprintf("flowd-run%d-", run))
+	if err != nil {
+		fmt.Printf("ERROR: creating directory for named pipes of run %d: %s\n", run, err)
+		return record
+	}
+	defer os.RemoveAll(dir)
+	summaryPath := filepath.Join(dir, runSummaryFile)
+	cmd := exec.Command(flowdPath, append([]string{"-fifodir", dir, "-summary", summaryPath}, runArgs...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if !quiet {
+		fmt.Printf("INFO: starting run %d\n", run)
+	}
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Printf("ERROR: running flowd for run %d: %s\n", run, err)
+		return record
+	}
+	record.ExitCode = cmd.ProcessState.ExitCode()
+	var summary RunSummary
+	if data, err := ioutil.ReadFile(summaryPath); err == nil {
+		if err = json.Unmarshal(data, &summary); err != nil {
+			fmt.Printf("WARNING: reading exit summary of run %d: %s\n", run, err)
+		}
+	}
+	record.Processes, record.FailedProcesses = summary.Processes, summary.FailedProcesses
+	switch {
+	case record.ExitCode == 0 && summary.FailedProcesses > 0:
+		record.Result = runFailed
+	case record.ExitCode == 0:
+		record.Result = runOK
+	case record.ExitCode == exitTimeout:
+		record.Result = runTimeout
+	default:
+		// including killed by a signal
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			fmt.Printf("ERROR: run %d was killed by signal %s\n", run, status.Signal())
+		}
+	}
+	return record
+}
+
+// scheduleRunArgs returns the flowd arguments for each run, without the scheduling flags
+func scheduleRunArgs(flags *flag.FlagSet, args []string) []string {
+	return filterArgs(flags, args, scheduleFlags)
+}
+
+// filterArgs returns the arguments without the given flags and their values
+// NOTE: the flag package stops at the first non-flag argument, so does this
+func filterArgs(flags *flag.FlagSet, args []string, skipFlags map[string]bool) (filtered []string) {
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return append(filtered, args[index:]...)
+		}
+		if arg == "--" {
+			return append(filtered, args[index+1:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if definition := flags.Lookup(name); definition != nil {
+			if boolFlag, ok := definition.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+				hasValue = true
+			}
+		}
+		skip := skipFlags[name]
+		if !skip {
+			filtered = append(filtered, arg)
+		}
+		if !hasValue && index+1 < len(args) {
+			// value is the next argument
+			index++
+			if !skip {
+				filtered = append(filtered, args[index])
+			}
+		}
+	}
+	return filtered
+}
+
+// loadRunHistory reads the history of runs, empty if the file does not exist yet
+func loadRunHistory(path string) ([]RunRecord, error) {
+	history := []RunRecord{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return history, nil
+}
+
+// saveRunHistory writes the history of runs, replacing the file atomically
+func saveRunHistory(path string, history []RunRecord) error {
+	data, err := json.MarshalIndent(history, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+".tmp", append(data, '\n'), 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/oleksandr/fbp"
+)
+
+/*
+Interactive shell for inspecting and poking a running network, run using "flowd shell".
+
+The shell attaches to a running network over HTTP on its status socket given using -status-socket, also of a network
+hosted by the daemon by its name, or on its online configuration server given using -olc:
+
+	flowd shell -socket /tmp/chat.sock
+	flowd shell -dir /var/lib/flowd chat
+	flowd shell -olc localhost:3569
+
+It reads one command per line, also from a pipe, then exiting unsuccessfully if a command failed:
+
+	ps                          process instances with state, PID and component
+	ports [PROCESS]             ports with their named pipes, marked if they can be tapped
+	stats                       frames passed per connection
+	inject PROCESS.PORT DATA    send a frame into an inport, taking @type=, @content-type= and @file: like IIPs
+	tap PROCESS.PORT            show the frames going into an inport until ctrl+c
+	conf PROCESS CONF           push new configuration, see conf.go
+	stop PROCESS                terminate the process
+	restart PROCESS             terminate the process and start it again
+	help
+	quit
+
+Processes are given by name for all instances if replicated, ports of replicas as PROCESS#N.PORT. Frames can be
+tapped and injected only on inports passing through flowd, which are merged and recorded inports or all framed
+connections using -count-frames; injected frames are merged frame-wise with the upstreams. Other connections cannot be
+routed through flowd on demand, since the processes have already opened their named pipes to each other.
+
+On restart, flowd holds the named pipes of the process open until the new instance has opened them, so that its
+neighbors neither get EOF nor write errors, but just have to wait. IIPs are delivered again to the new instance. The
+frames the old instance had read, but not yet processed, are lost.
+
+The commands use the HTTP API next to /graph and /conf: GET /processes, POST /inject?port=PROCESS.PORT with the frame
+as request body, GET /tap?port=PROCESS.PORT streaming the frames and POST /process?name=PROCESS&action=stop|restart.
+Since the online configuration server is unauthenticated, it serves only listing the processes and stats, unless
+allowed using -olc-shell for tap, inject, stop and restart and using -olc-conf for conf.
+
+NOTE: restarting processes on remote hosts is currently unimplemented.
+*/
+
+const (
+	shellPrompt    = "flowd> "
+	shellBodyType  = "Shell"               // of injected frames, if not given using @type=
+	restartTimeout = 10 * time.Second      // for the new instance to open its named pipes
+	restartPoll    = 50 * time.Millisecond // interval for checking the named pipes opened by the new instance
+	tapBuffer      = 100                   // frames buffered per tap client, more are dropped if it is too slow
+)
+
+// restarts holds the processes to be started again once exited, guarded by instancesLock
+var restarts = map[string]bool{}
+
+// stops holds the processes stopped using the shell, which do not count as failed, guarded by instancesLock
+var stops = map[string]bool{}
+
+// ShellProcess is a process instance of the running network as listed by the shell
+type ShellProcess struct {
+	Name      string      `json:"name"`
+	Component string      `json:"component"`
+	Host      string      `json:"host,omitempty"`
+	State     string      `json:"state"` // one of the process* constants, see graph.go
+	PID       int         `json:"pid,omitempty"`
+	Ports     []ShellPort `json:"ports"`
+}
+
+// ShellPort is a port of a process instance as listed by the shell
+type ShellPort struct {
+	Port   string `json:"port"`
+	Inport bool   `json:"inport"` // otherwise outport
+	Path   string `json:"path"`
+	Tap    bool   `json:"tap,omitempty"` // passes through flowd, so that frames can be tapped and injected
+}
+
+// portTap publishes the frames merged into a process inport to the tap clients and takes frames to be injected
+type portTap struct {
+	inject      chan *flowd.Frame
+	mutex       sync.Mutex
+	subscribers map[chan *flowd.Frame]bool
+	closed      bool // merging is done
+}
+
+// portTap returns the tap of the process inport passing through flowd, creating it; nil if not running
+func (l *liveState) portTap(proc string, port string) *portTap {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := proc + "." + port
+	if tap, found := l.taps[key]; found {
+		return tap
+	}
+	tap := &portTap{inject: make(chan *flowd.Frame), subscribers: map[chan *flowd.Frame]bool{}}
+	l.taps[key] = tap
+	return tap
+}
+
+// findTap returns the tap of the process inport given as PROCESS.PORT, nil if it does not pass through flowd
+func (l *liveState) findTap(name string) *portTap {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.taps[name]
+}
+
+// publish passes the frame to the tap clients, dropping it for clients which are too slow
+func (t *portTap) publish(frame *flowd.Frame) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for frames := range t.subscribers {
+		select {
+		case frames <- frame:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving the published frames, closed once merging is done; nil if done already
+func (t *portTap) subscribe() chan *flowd.Frame {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return nil
+	}
+	frames := make(chan *flowd.Frame, tapBuffer)
+	t.subscribers[frames] = true
+	return frames
+}
+
+// unsubscribe stops publishing frames to the channel
+func (t *portTap) unsubscribe(frames chan *flowd.Frame) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.subscribers, frames)
+}
+
+// send injects the frame, waiting for the merger to take it
+func (t *portTap) send(frame *flowd.Frame) error {
+	if t.isClosed() {
+		return errors.New("port already closed")
+	}
+	select {
+	case t.inject <- frame:
+		return nil
+	case <-time.After(confTimeout):
+		return errors.New("process is not reading the port")
+	}
+}
+
+// isClosed returns whether merging into the inport is done
+func (t *portTap) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+// close marks merging as done, closing the channels of all tap clients
+func (t *portTap) close() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	for frames := range t.subscribers {
+		close(frames)
+		delete(t.subscribers, frames)
+	}
+}
+
+// shellProcesses returns the process instances of the running network, sorted by name
+func (l *liveState) shellProcesses() ([]*ShellProcess, error) {
+	names := make([]string, 0, len(l.procs))
+	for name := range l.procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	processes := make([]*ShellProcess, 0, len(names))
+	for _, name := range names {
+		proc := l.procs[name]
+		plan, err := planInstance(proc, l.nw)
+		if err != nil {
+			return nil, err
+		}
+		l.mutex.Lock()
+		process := &ShellProcess{Name: name, Component: proc.Path, Host: plan.Host, State: l.processes[name], Ports: []ShellPort{}}
+		l.mutex.Unlock()
+		instancesLock.Lock()
+		if instanceRunning(proc) {
+			process.PID = proc.Instance.Cmd.Process.Pid
+		}
+		instancesLock.Unlock()
+		for _, port := range plan.Ports {
+			tap := l.findTap(name + "." + port.Port)
+			process.Ports = append(process.Ports, ShellPort{Port: port.Port, Inport: port.Inport, Path: port.Path, Tap: port.Inport && tap != nil && !tap.isClosed()})
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// serveProcesses lists the process instances of the running network with their ports
+func serveProcesses(w http.ResponseWriter, r *http.Request) {
+	if live == nil || live.procs == nil {
+		http.Error(w, "network not running", http.StatusServiceUnavailable)
+		return
+	}
+	processes, err := live.shellProcesses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(processes)
+}
+
+// requestTap returns the tap of the process inport given as query parameter port
+func requestTap(r *http.Request) (*portTap, error) {
+	name := r.URL.Query().Get("port")
+	if name == "" {
+		return nil, errors.New("missing query parameter port")
+	}
+	if live == nil {
+		return nil, errors.New("network not running")
+	}
+	tap := live.findTap(name)
+	if tap == nil {
+		return nil, fmt.Errorf("%s is no inport passing through flowd - only merged and recorded inports, or all framed connections using -count-frames", name)
+	}
+	return tap, nil
+}
+
+// serveInject merges the frame given as request body into the process inport given as query parameter
+func serveInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST with the frame as body", http.StatusMethodNotAllowed)
+		return
+	}
+	tap, err := requestTap(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	frame, err := flowd.Deserialize(bufio.NewReader(r.Body))
+	if err != nil {
+		http.Error(w, "invalid frame: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = tap.send(frame); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveTap streams the frames going into the process inport given as query parameter until the client disconnects
+func serveTap(w http.ResponseWriter, r *http.Request) {
+	tap, err := requestTap(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	frames := tap.subscribe()
+	if frames == nil {
+		http.Error(w, "port already closed", http.StatusBadRequest)
+		return
+	}
+	defer tap.unsubscribe(frames)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	out := bufio.NewWriter(w)
+	for {
+		select {
+		case frame, open := <-frames:
+			if !open {
+				out.Flush()
+				return
+			}
+			if err = frame.Serialize(out); err != nil {
+				return
+			}
+			if len(frames) == 0 {
+				if err = out.Flush(); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveProcess stops or restarts the process given as query parameter, all instances if replicated
+func serveProcess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if live == nil || live.procs == nil {
+		http.Error(w, "network not running", http.StatusServiceUnavailable)
+		return
+	}
+	action := r.URL.Query().Get("action")
+	instances, err := processInstances(live.procs, r.URL.Query().Get("name"))
+	for _, name := range instances {
+		if err != nil {
+			break
+		}
+		switch action {
+		case "stop":
+			err = stopInstance(live.procs[name])
+		case "restart":
+			err = restartInstance(live.procs[name], live.nw)
+		default:
+			err = fmt.Errorf("unknown action '%s' - expected stop or restart", action)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// processInstances returns the names of the instances of the process, sorted by name
+func processInstances(procs Network, name string) ([]string, error) {
+	instances := []string{}
+	for procName := range procs {
+		if procName == name || strings.HasPrefix(procName, name+replicaSeparator) {
+			instances = append(instances, procName)
+		}
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no such process: %s", name)
+	}
+	sort.Strings(instances)
+	return instances, nil
+}
+
+// instanceRunning returns whether the process instance has been started and not yet exited
+// NOTE: instancesLock has to be held
+func instanceRunning(proc *Process) bool {
+	return proc.Instance != nil && proc.Instance.Cmd != nil && proc.Instance.Cmd.Process != nil && proc.Instance.Cmd.ProcessState == nil
+}
+
+// stopInstance terminates the process instance
+func stopInstance(proc *Process) error {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	if !instanceRunning(proc) {
+		return fmt.Errorf("process %s is not running", proc.Name)
+	}
+	if !quiet {
+		fmt.Printf("stopping %s\n", proc.Name)
+	}
+	stops[proc.Name] = true
+	return proc.Instance.Cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// restartInstance terminates the process instance, which gets started again once exited, see startInstance()
+// NOTE: meanwhile its named pipes are held open, so that its neighbors neither get EOF nor write errors
+func restartInstance(proc *Process, nw *fbp.Fbp) error {
+	plan, err := planInstance(proc, nw)
+	if err != nil {
+		return err
+	}
+	if plan.Host != "" {
+		return fmt.Errorf("process %s: restarting processes on remote hosts currently unimplemented", proc.Name)
+	}
+	instancesLock.Lock()
+	instance := proc.Instance
+	switch {
+	case !instanceRunning(proc):
+		err = fmt.Errorf("process %s is not running", proc.Name)
+	case restarts[proc.Name]:
+		err = fmt.Errorf("process %s is already restarting", proc.Name)
+	default:
+		restarts[proc.Name] = true
+	}
+	instancesLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("restarting %s\n", proc.Name)
+	}
+	held := holdPipes(plan.Ports)
+	instance.Cmd.Process.Signal(syscall.SIGTERM)
+	go func() {
+		defer func() {
+			for _, pipe := range held {
+				pipe.Close()
+			}
+		}()
+		// wait for the new instance to open its named pipes, killing the old one after the shutdown grace period
+		// NOTE: without process inspection, the named pipes are held until the timeout
+		killAt := time.Now().Add(shutdownGrace)
+		deadline := killAt.Add(restartTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(restartPoll)
+			instancesLock.Lock()
+			exited := instance.Cmd.ProcessState != nil
+			pid := 0
+			if proc.Instance != instance && proc.Instance != nil && instanceRunning(proc) {
+				pid = proc.Instance.Cmd.Process.Pid
+			}
+			instancesLock.Unlock()
+			if !exited && time.Now().After(killAt) {
+				fmt.Printf("WARNING: process %s still running after shutdown grace period - killing it\n", proc.Name)
+				instance.Cmd.Process.Kill()
+				killAt = deadline
+			}
+			if pid == 0 {
+				continue
+			}
+			if snapshot, err := inspectProcess(pid); err == nil && opensAll(snapshot, plan.Ports) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// holdPipes opens the named pipes of the ports on the same side as the process, without reading or writing
+// NOTE: opening non-blocking does not wait for the other side; without reader, opening for writing fails and is skipped
+func holdPipes(ports []PortPlan) []*os.File {
+	held := []*os.File{}
+	for _, port := range ports {
+		mode := os.O_RDONLY
+		if !port.Inport {
+			mode = os.O_WRONLY
+		}
+		if pipe, err := os.OpenFile(port.Path, mode|syscall.O_NONBLOCK, os.ModeNamedPipe); err == nil {
+			held = append(held, pipe)
+		}
+	}
+	return held
+}
+
+// opensAll returns whether the process has opened the named pipes of all the ports
+func opensAll(snapshot *procSnapshot, ports []PortPlan) bool {
+	for _, port := range ports {
+		if !snapshot.open[port.Path] {
+			return false
+		}
+	}
+	return true
+}
+
+// restartPending returns whether the exited process is to be started again, preparing its new instance
+func restartPending(proc *Process) bool {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	if !restarts[proc.Name] {
+		return false
+	}
+	delete(restarts, proc.Name)
+	proc.Instance = newComponentInstance()
+	return true
+}
+
+// shellClient runs the commands of the shell against a running network
+type shellClient struct {
+	base   string       // URL of the network without path
+	client *http.Client // for requests
+	stream *http.Client // for tapping, without timeout
+	out    io.Writer
+}
+
+func runShell(args []string) int {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	socketPath := flags.String("socket", "", "status socket of the network given using -status-socket")
+	olc := flags.String("olc", "", "host:port of the online configuration server of the network given using -olc")
+	dir := flags.String("dir", "/var/lib/flowd", "state directory of the daemon hosting the network")
+	flags.Parse(args)
+	base := "http://flowd"
+	var transport http.RoundTripper
+	switch {
+	case *socketPath != "" && *olc == "" && flags.NArg() == 0:
+		transport = statusTransport(*socketPath)
+	case *olc != "" && *socketPath == "" && flags.NArg() == 0:
+		base, transport = "http://"+*olc, http.DefaultTransport
+	case *socketPath == "" && *olc == "" && flags.NArg() == 1:
+		transport = statusTransport(filepath.Join(*dir, flags.Arg(0), statusFile))
+	default:
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "shell [-socket path | -olc host:port | -dir state-dir network]")
+		flags.PrintDefaults()
+		return 2
+	}
+	shell := &shellClient{
+		base:   base,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		stream: &http.Client{Transport: transport},
+		out:    os.Stdout,
+	}
+	if _, err := shell.call(http.MethodGet, "/processes", nil); err != nil {
+		fmt.Println("ERROR: attaching to network:", err)
+		return 1
+	}
+
+	// read commands
+	// NOTE: prompt only if on a terminal, not if commands are piped in
+	info, _ := os.Stdin.Stat()
+	interactive := info != nil && info.Mode()&os.ModeCharDevice != 0
+	if interactive {
+		fmt.Println("attached to network - enter help for the commands")
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	failed := false
+	for {
+		if interactive {
+			fmt.Print(shellPrompt)
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		command, rest := splitWord(line)
+		if command == "quit" || command == "exit" {
+			break
+		}
+		if err := shell.run(command, rest); err != nil {
+			fmt.Println("ERROR:", err)
+			failed = true
+		}
+	}
+	if interactive {
+		fmt.Println()
+		return 0
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// run executes one command of the shell
+func (s *shellClient) run(command string, args string) error {
+	switch command {
+	case "help":
+		fmt.Fprint(s.out, shellHelp)
+		return nil
+	case "ps":
+		return s.ps()
+	case "ports":
+		return s.ports(args)
+	case "stats":
+		return s.stats()
+	case "inject":
+		port, data := splitWord(args)
+		return s.inject(port, data)
+	case "tap":
+		return s.tap(args)
+	case "conf":
+		process, conf := splitWord(args)
+		if process == "" {
+			return errors.New("expected process and configuration")
+		}
+		return s.print(s.call(http.MethodPost, "/conf?process="+url.QueryEscape(process), []byte(conf)))
+	case "stop", "restart":
+		if args == "" {
+			return errors.New("expected process")
+		}
+		return s.print(s.call(http.MethodPost, "/process?action="+command+"&name="+url.QueryEscape(args), nil))
+	}
+	return fmt.Errorf("unknown command: %s - enter help for the commands", command)
+}
+
+// shellHelp lists the commands of the shell
+const shellHelp = `ps                          process instances with state, PID and component
+ports [PROCESS]             ports with their named pipes, * = can be tapped
+stats                       frames passed per connection
+inject PROCESS.PORT DATA    send a frame into an inport, taking @type=, @content-type= and @file: like IIPs
+tap PROCESS.PORT            show the frames going into an inport until ctrl+c
+conf PROCESS CONF           push new configuration
+stop PROCESS                terminate the process
+restart PROCESS             terminate the process and start it again
+quit
+
+Only inports passing through flowd can be tapped and injected into, which are merged and recorded inports, or all
+framed connections if the network runs using -count-frames. Likewise, stats counts frames only on these. Other
+connections cannot be routed through flowd once the network is running.
+`
+
+// call sends a request to the network and returns the response body, or the error message of the network
+func (s *shellClient) call(method string, path string, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(method, s.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	output, err := ioutil.ReadAll(response.Body)
+	if err == nil && response.StatusCode != http.StatusOK {
+		err = errors.New(strings.TrimSpace(string(output)))
+	}
+	return output, err
+}
+
+// print outputs the response of the network, if successful
+func (s *shellClient) print(output []byte, err error) error {
+	if err == nil {
+		_, err = s.out.Write(output)
+	}
+	return err
+}
+
+// processes returns the process instances of the network
+func (s *shellClient) processes() ([]*ShellProcess, error) {
+	output, err := s.call(http.MethodGet, "/processes", nil)
+	if err != nil {
+		return nil, err
+	}
+	var processes []*ShellProcess
+	return processes, json.Unmarshal(output, &processes)
+}
+
+// ps lists the process instances
+func (s *shellClient) ps() error {
+	processes, err := s.processes()
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "PROCESS\tSTATE\tPID\tCOMPONENT")
+	for _, process := range processes {
+		pid, component := "-", process.Component
+		if process.PID != 0 {
+			pid = strconv.Itoa(process.PID)
+		}
+		if process.Host != "" {
+			component += " on " + process.Host
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", process.Name, process.State, pid, component)
+	}
+	return table.Flush()
+}
+
+// ports lists the ports of all process instances or of the given process
+func (s *shellClient) ports(name string) error {
+	processes, err := s.processes()
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "PORT\tDIRECTION\tNAMED PIPE")
+	found := false
+	for _, process := range processes {
+		if name != "" && process.Name != name && !strings.HasPrefix(process.Name, name+replicaSeparator) {
+			continue
+		}
+		found = true
+		for _, port := range process.Ports {
+			direction, tap := "out", ""
+			if port.Inport {
+				direction = "in"
+			}
+			if port.Tap {
+				tap = " *"
+			}
+			fmt.Fprintf(table, "%s.%s%s\t%s\t%s\n", process.Name, port.Port, tap, direction, port.Path)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no such process: %s", name)
+	}
+	return table.Flush()
+}
+
+// stats lists the frames passed per connection, as far as counted
+func (s *shellClient) stats() error {
+	output, err := s.call(http.MethodGet, "/graph?format="+graphJSON, nil)
+	if err != nil {
+		return err
+	}
+	var graph Graph
+	if err = json.Unmarshal(output, &graph); err != nil {
+		return err
+	}
+	if graph.State != nil {
+		fmt.Fprintf(s.out, "running since %s, ready: %t\n", graph.State.Started.Format(time.RFC3339), graph.State.Ready)
+	}
+	labels := map[string]string{}
+	for _, node := range graph.Nodes {
+		switch node.Kind {
+		case nodeInport:
+			labels[node.ID] = "INPORT " + node.Label
+		case nodeOutport:
+			labels[node.ID] = "OUTPORT " + node.Label
+		default:
+			labels[node.ID] = node.Label
+		}
+	}
+	end := func(node string, port string) string {
+		if port == "" {
+			return labels[node]
+		}
+		return labels[node] + "." + port
+	}
+	table := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	counted := 0
+	for _, edge := range graph.Edges {
+		if edge.Frames == nil {
+			continue
+		}
+		if counted == 0 {
+			fmt.Fprintln(table, "CONNECTION\tFRAMES")
+		}
+		counted++
+		fmt.Fprintf(table, "%s -> %s\t%d\n", end(edge.From, edge.FromPort), end(edge.To, edge.ToPort), *edge.Frames)
+	}
+	if counted == 0 {
+		fmt.Fprintln(s.out, "no connections passing through flowd - count frames on all connections using -count-frames")
+	}
+	return table.Flush()
+}
+
+// inject sends a frame with the given data into the process inport, see newIIP() for the options
+func (s *shellClient) inject(port string, data string) error {
+	if port == "" {
+		return errors.New("expected PROCESS.PORT and data")
+	}
+	options, body := splitIIPOptions(data)
+	if strings.HasPrefix(body, iipFilePrefix) {
+		content, err := ioutil.ReadFile(strings.TrimPrefix(body, iipFilePrefix))
+		if err != nil {
+			return err
+		}
+		data = joinIIPOptions(options, escapeIIPData(strings.TrimSuffix(string(content), "\n")))
+	}
+	iip := newIIP(port, data)
+	frame := &flowd.Frame{Type: "data", BodyType: shellBodyType, Body: []byte(iip.Data)}
+	if iip.BodyType != "" {
+		frame.BodyType = iip.BodyType
+	}
+	if iip.ContentType != "" {
+		frame.Extensions = map[string]string{"content-type": iip.ContentType}
+	}
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := frame.Serialize(writer); err != nil {
+		return err
+	}
+	writer.Flush()
+	return s.print(s.call(http.MethodPost, "/inject?port="+url.QueryEscape(port), buffer.Bytes()))
+}
+
+// tap shows the frames going into the process inport until interrupted or the port is closed
+func (s *shellClient) tap(port string) error {
+	if port == "" {
+		return errors.New("expected PROCESS.PORT")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	request, err := http.NewRequest(http.MethodGet, s.base+"/tap?port="+url.QueryEscape(port), nil)
+	if err != nil {
+		return err
+	}
+	response, err := s.stream.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		output, _ := ioutil.ReadAll(response.Body)
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	fmt.Fprintf(s.out, "tapping %s - stop using ctrl+c\n", port)
+	frames := bufio.NewReader(response.Body)
+	for {
+		frame, err := flowd.Deserialize(frames)
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				fmt.Fprintf(s.out, "stopped tapping %s\n", port)
+				return nil
+			}
+			return err
+		}
+		fmt.Fprintln(s.out, formatFrame(frame))
+	}
+}
+
+// formatFrame returns the frame on one line: type, body type, extension headers and body, quoted if not printable
+func formatFrame(frame *flowd.Frame) string {
+	parts := []string{frame.Type, frame.BodyType}
+	keys := []string{}
+	for key := range frame.Extensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, key+"="+frame.Extensions[key])
+	}
+	body := strings.TrimSuffix(string(frame.Body), "\n")
+	printable := utf8.ValidString(body)
+	for _, char := range body {
+		if char < ' ' && char != '\t' {
+			printable = false
+		}
+	}
+	if !printable {
+		body = strconv.Quote(string(frame.Body))
+	}
+	return strings.Join(parts, " ") + ": " + body
+}
+
+// splitWord returns the first word of the line and the rest
+func splitWord(line string) (word string, rest string) {
+	line = strings.TrimSpace(line)
+	if end := strings.IndexAny(line, " \t"); end != -1 {
+		return line[:end], strings.TrimSpace(line[end+1:])
+	}
+	return line, ""
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ERnsTL/flowd/libunixfbp"
+)
+
+/*
+Stall and deadlock detection.
+
+Opening a named pipe blocks until the other side has opened it too, and writing into a named pipe blocks once its
+buffer is full. So if a process never opens one of its ports or stops reading, the network just hangs. Using -stall,
+flowd periodically inspects the running processes in /proc and reports
+
+* processes blocked in opening one of their named pipes for the given time, with the named pipes not yet opened,
+* connections with a full pipe buffer whose reading process made no read progress for the given time,
+* cycles of processes blocked in opening named pipes of each other = deadlock.
+
+Each stall is reported once, including the kernel wait channels of the threads of the stalled process.
+
+NOTE: process inspection is only available on Linux.
+*/
+
+// pipeFullMargin is the free space below which a pipe buffer counts as full, = PIPE_BUF
+const pipeFullMargin = 4096
+
+// pipeEnd is the reading or writing side of a named pipe
+type pipeEnd struct {
+	proc string // empty if flowd itself
+	port string // port name or for flowd, the purpose
+}
+
+func (e pipeEnd) String() string {
+	if e.proc == "" {
+		return "flowd (" + e.port + ")"
+	}
+	return e.proc + "." + e.port
+}
+
+// procSnapshot is the state of a running process as seen in /proc
+type procSnapshot struct {
+	open      map[string]bool // named pipes = all paths opened by the process
+	inOpen    bool            // a thread of the process is blocked in the open syscall
+	readBytes uint64          // bytes read so far (rchar)
+	wchans    []string        // kernel wait channels of the process threads
+}
+
+// fullPipe holds since when a pipe buffer is full and the read progress of the reader at that time
+type fullPipe struct {
+	since     time.Time
+	readBytes uint64
+}
+
+// stallMonitor checks the running processes for stalls
+type stallMonitor struct {
+	timeout  time.Duration
+	ports    map[string][]PortPlan      // process name -> its ports with absolute named pipe paths
+	readers  map[string]pipeEnd         // named pipe path -> reading side
+	writers  map[string]pipeEnd         // named pipe path -> writing side
+	full     map[string]*fullPipe       // named pipe path -> full since
+	opened   map[string]map[string]bool // process name -> named pipes seen opened
+	reported map[string]bool            // stalls already reported
+
+	// process inspection, replaceable for testing
+	inspect  func(pid int) (*procSnapshot, error)
+	pipeFill func(path string) (queued int, capacity int, err error)
+
+	mutex   sync.Mutex
+	pids    map[string]int       // running processes
+	started map[string]time.Time // start time of running processes
+}
+
+// stalls is the stall monitor in use, nil if disabled
+var stalls *stallMonitor
+
+// newStallMonitor prepares stall detection for the given launch plan
+func newStallMonitor(plan *NetworkPlan, timeout time.Duration) *stallMonitor {
+	m := &stallMonitor{
+		timeout:  timeout,
+		ports:    map[string][]PortPlan{},
+		readers:  map[string]pipeEnd{},
+		writers:  map[string]pipeEnd{},
+		full:     map[string]*fullPipe{},
+		opened:   map[string]map[string]bool{},
+		reported: map[string]bool{},
+		inspect:  inspectProcess,
+		pipeFill: pipeFill,
+		pids:     map[string]int{},
+		started:  map[string]time.Time{},
+	}
+	// NOTE: /proc contains absolute paths
+	abs := func(path string) string {
+		if absPath, err := filepath.Abs(path); err == nil {
+			return absPath
+		}
+		return path
+	}
+	for _, proc := range plan.Processes {
+		for _, port := range proc.Ports {
+			path := abs(port.Path)
+			m.ports[proc.Name] = append(m.ports[proc.Name], PortPlan{Port: port.Port, Inport: port.Inport, Path: path})
+			if port.Inport {
+				m.readers[path] = pipeEnd{proc.Name, port.Port}
+			} else {
+				m.writers[path] = pipeEnd{proc.Name, port.Port}
+			}
+		}
+	}
+	// named pipes handled by flowd itself
+	for _, iip := range plan.IIPs {
+		if iip.Path != "" {
+			m.writers[abs(iip.Path)] = pipeEnd{port: fmt.Sprintf("IIP delivery to %s.%s", iip.Process, iip.Port)}
+		}
+	}
+	for _, fanIn := range plan.Merges {
+		m.writers[abs(fanIn.Path)] = pipeEnd{port: fmt.Sprintf("merging into %s.%s", fanIn.Proc, fanIn.Port)}
+		for _, upstream := range fanIn.Upstreams {
+			if upstream.RemoteProc != "NETIN" {
+				m.readers[abs(upstream.Path)] = pipeEnd{port: fmt.Sprintf("merging into %s.%s", fanIn.Proc, fanIn.Port)}
+			}
+		}
+	}
+	for _, netin := range plan.NetIns {
+		m.writers[abs(unixfbp.InPorts[netin.Port].Path)] = pipeEnd{port: "network inport " + netin.Port}
+	}
+	for _, netout := range plan.NetOuts {
+		m.readers[abs(unixfbp.OutPorts[netout.Port].Path)] = pipeEnd{port: "network outport " + netout.Port}
+	}
+	for _, replay := range plan.Replays {
+		m.writers[abs(replay.Path)] = pipeEnd{port: "replay of " + replay.File}
+	}
+	return m
+}
+
+// processStarted registers a running process
+func (m *stallMonitor) processStarted(name string, pid int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pids[name] = pid
+	m.started[name] = time.Now()
+}
+
+// processExited unregisters a process
+func (m *stallMonitor) processExited(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.pids, name)
+	delete(m.started, name)
+}
+
+// run checks for stalls periodically, printing a warning for each new one
+func (m *stallMonitor) run() {
+	if runtime.GOOS != "linux" {
+		fmt.Println("WARNING: stall detection is only available on Linux - disabled")
+		return
+	}
+	interval := m.timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	for now := range time.Tick(interval) {
+		for _, warning := range m.check(now) {
+			fmt.Println("WARNING:", warning)
+		}
+	}
+}
+
+// check inspects the running processes and returns descriptions of newly detected stalls
+func (m *stallMonitor) check(now time.Time) (warnings []string) {
+	// inspect running processes
+	m.mutex.Lock()
+	snapshots := map[string]*procSnapshot{}
+	running := map[string]time.Duration{}
+	for name, pid := range m.pids {
+		snapshot, err := m.inspect(pid)
+		if err != nil {
+			// probably just exited
+			continue
+		}
+		snapshots[name] = snapshot
+		running[name] = now.Sub(m.started[name])
+	}
+	m.mutex.Unlock()
+
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// remember named pipes opened, since processes may close ports they are done with
+	for name, snapshot := range snapshots {
+		if m.opened[name] == nil {
+			m.opened[name] = map[string]bool{}
+		}
+		for _, port := range m.ports[name] {
+			if snapshot.open[port.Path] {
+				m.opened[name][port.Path] = true
+			}
+		}
+	}
+
+	// processes blocked in opening named pipes
+	waitsFor := map[string]map[string]string{} // process -> process it waits for -> named pipe
+	for _, name := range names {
+		snapshot := snapshots[name]
+		if running[name] < m.timeout || !snapshot.inOpen {
+			continue
+		}
+		missing := []string{}
+		for _, port := range m.ports[name] {
+			if m.opened[name][port.Path] {
+				continue
+			}
+			peer, direction := m.writers[port.Path], "inport"
+			if !port.Inport {
+				peer, direction = m.readers[port.Path], "outport"
+			}
+			missing = append(missing, fmt.Sprintf("%s %s (%s, other side: %s)", direction, port.Port, port.Path, peer))
+			if peerSnapshot, peerRunning := snapshots[peer.proc]; peerRunning && peerSnapshot.inOpen && !m.opened[peer.proc][port.Path] {
+				// both sides not opened and blocked in opening: maybe waiting for each other
+				if waitsFor[name] == nil {
+					waitsFor[name] = map[string]string{}
+				}
+				waitsFor[name][peer.proc] = port.Path
+			}
+		}
+		if len(missing) == 0 || m.reported["open "+name] {
+			continue
+		}
+		m.reported["open "+name] = true
+		warnings = append(warnings, fmt.Sprintf("possible stall: %s is blocked opening a named pipe for more than %s, not yet opened: %s%s", name, m.timeout, strings.Join(missing, ", "), describeWchans(snapshot)))
+	}
+
+	// deadlocks = cycles of processes blocked in opening named pipes
+	for _, cycle := range findCycles(waitsFor) {
+		key := "deadlock " + strings.Join(cycle, " ")
+		if m.reported[key] {
+			continue
+		}
+		m.reported[key] = true
+		steps := []string{}
+		for index, name := range cycle {
+			next := cycle[(index+1)%len(cycle)]
+			steps = append(steps, fmt.Sprintf("%s waits for %s to open %s", name, next, waitsFor[name][next]))
+		}
+		warnings = append(warnings, "deadlock: "+strings.Join(steps, ", "))
+	}
+
+	// full pipe buffers without read progress
+	paths := make([]string, 0, len(m.readers))
+	for path := range m.readers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		reader := m.readers[path]
+		readerSnapshot, running := snapshots[reader.proc]
+		if reader.proc == "" || !running || !readerSnapshot.open[path] {
+			// NOTE: opening a named pipe not yet opened by the reader would change the behavior of the network
+			delete(m.full, path)
+			continue
+		}
+		queued, capacity, err := m.pipeFill(path)
+		if err != nil || capacity-queued >= pipeFullMargin {
+			delete(m.full, path)
+			delete(m.reported, "full "+path)
+			continue
+		}
+		state, found := m.full[path]
+		if !found || state.readBytes != readerSnapshot.readBytes {
+			m.full[path] = &fullPipe{since: now, readBytes: readerSnapshot.readBytes}
+			delete(m.reported, "full "+path)
+			continue
+		}
+		if now.Sub(state.since) < m.timeout || m.reported["full "+path] {
+			continue
+		}
+		m.reported["full "+path] = true
+		warnings = append(warnings, fmt.Sprintf("possible stall: connection %s -> %s: pipe buffer full (%d of %d bytes) and %s made no read progress for %s%s", m.writers[path], reader, queued, capacity, reader.proc, now.Sub(state.since).Round(time.Second), describeWchans(readerSnapshot)))
+	}
+	return warnings
+}
+
+// describeWchans returns the kernel wait channels of a process for display
+func describeWchans(snapshot *procSnapshot) string {
+	if len(snapshot.wchans) == 0 {
+		return ""
+	}
+	return " (wait channels: " + strings.Join(snapshot.wchans, ", ") + ")"
+}
+
+// findCycles returns the cycles in the wait-for graph, each starting with its alphabetically first process
+func findCycles(waitsFor map[string]map[string]string) (cycles [][]string) {
+	found := map[string]bool{}
+	var visit func(path []string, onPath map[string]bool)
+	visit = func(path []string, onPath map[string]bool) {
+		last := path[len(path)-1]
+		nexts := []string{}
+		for next := range waitsFor[last] {
+			nexts = append(nexts, next)
+		}
+		sort.Strings(nexts)
+		for _, next := range nexts {
+			if next == path[0] {
+				// cycle closed - only keep it in its canonical rotation
+				first := true
+				for _, name := range path[1:] {
+					if name < path[0] {
+						first = false
+						break
+					}
+				}
+				key := strings.Join(path, " ")
+				if first && !found[key] {
+					found[key] = true
+					cycles = append(cycles, append([]string{}, path...))
+				}
+				continue
+			}
+			if onPath[next] {
+				continue
+			}
+			onPath[next] = true
+			visit(append(path, next), onPath)
+			delete(onPath, next)
+		}
+	}
+	starts := []string{}
+	for name := range waitsFor {
+		starts = append(starts, name)
+	}
+	sort.Strings(starts)
+	for _, start := range starts {
+		visit([]string{start}, map[string]bool{start: true})
+	}
+	return cycles
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Generation of systemd units for a network, see also examples/flowd.service.
+
+Mode "network" generates one unit running flowd with the network definition and the flowd arguments it was exported with, except those selecting other modes like -plan.
+Mode "process" generates one unit per process plus a target grouping them, so that each component can be restarted
+and inspected using journalctl individually. The named pipes are created in ExecStartPre of each unit, including
+their directory, IIPs not going to ARGS are delivered in ExecStartPost.
+
+Process metadata used in mode "process":
+
+	restart=on-failure     Restart=
+	restartsec=5           RestartSec=
+	memory=512M            MemoryMax=
+	cpu=50                 CPUQuota= in percent
+	tasks=100              TasksMax=
+	nofile=4096            LimitNOFILE=
+	user=name              User=
+	group=name             Group=
+	env_NAME=value         Environment=NAME=value
+	ready=signal           Type=notify, see ready.go
+	after=A/B              After= and Wants= on the units of processes A and B
+
+Process names are escaped in unit names like systemd-escape does, eg. the replica Work#0 gets the unit
+<network>-Work\x230.service. Network names keep their dashes.
+*/
+
+const (
+	systemdModeNetwork = "network"
+	systemdModeProcess = "process"
+)
+
+// unit settings set from process metadata
+var systemdMetadata = map[string]string{
+	"restartsec": "RestartSec",
+	"memory":     "MemoryMax",
+	"tasks":      "TasksMax",
+	"nofile":     "LimitNOFILE",
+	"user":       "User",
+	"group":      "Group",
+}
+
+// exportSystemdUnits writes the systemd units for the network into the given directory and returns the file paths written
+func exportSystemdUnits(plan *NetworkPlan, procs Network, source string, flowdArgs []string, mode string, dir string) (written []string, err error) {
+	if source == "" {
+		return nil, errors.New("network definition must be given as file")
+	}
+	name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	units := map[string]func(w io.Writer) error{}
+	switch mode {
+	case systemdModeNetwork:
+		flowdPath, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("finding flowd executable: %s", err)
+		}
+		sourcePath, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		units[systemdEscape(name, "-")+".service"] = func(w io.Writer) error {
+			return writeNetworkUnit(w, name, workDir, flowdPath, flowdArgs, sourcePath)
+		}
+	case systemdModeProcess:
+		if len(plan.Merges) > 0 {
+			return nil, errors.New("network has inports with multiple upstreams or recorded inports, which require merging by flowd - use mode " + systemdModeNetwork)
+		}
+		if len(plan.Replays) > 0 {
+			return nil, errors.New("replays of capture files require flowd - use mode " + systemdModeNetwork)
+		}
+		for _, procPlan := range plan.Processes {
+			if procPlan.Host != "" {
+				return nil, fmt.Errorf("process %s runs on remote host %s, which requires flowd - use mode %s", procPlan.Name, procPlan.Host, systemdModeNetwork)
+			}
+		}
+		if len(plan.NetIns) > 0 || len(plan.NetOuts) > 0 {
+			return nil, errors.New("network ports bound to sockets require flowd - use mode " + systemdModeNetwork)
+		}
+		unitNames := []string{}
+		for _, procPlan := range plan.Processes {
+			procPlan := procPlan
+			unitName := processUnitName(name, procPlan.Name)
+			unitNames = append(unitNames, unitName)
+			units[unitName] = func(w io.Writer) error {
+				return writeProcessUnit(w, name, workDir, procPlan, procs[procPlan.Name], plan.FIFOs)
+			}
+		}
+		units[systemdEscape(name, "-")+".target"] = func(w io.Writer) error {
+			return writeNetworkTarget(w, name, unitNames)
+		}
+	default:
+		return nil, fmt.Errorf("unknown systemd unit mode '%s' - expected %s or %s", mode, systemdModeNetwork, systemdModeProcess)
+	}
+
+	// write unit files
+	for unitName, writeUnit := range units {
+		path := filepath.Join(dir, unitName)
+		file, err := os.Create(path)
+		if err != nil {
+			return written, err
+		}
+		w := bufio.NewWriter(file)
+		if err = writeUnit(w); err == nil {
+			err = w.Flush()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return written, fmt.Errorf("writing %s: %s", path, err)
+		}
+		written = append(written, path)
+	}
+	sort.Strings(written)
+	return written, nil
+}
+
+func writeNetworkUnit(w io.Writer, name string, workDir string, flowdPath string, flowdArgs []string, sourcePath string) error {
+	args := []string{systemdQuote(flowdPath), "-quiet"}
+	for _, arg := range flowdArgs {
+		args = append(args, systemdQuote(arg))
+	}
+	args = append(args, systemdQuote(sourcePath))
+	_, err := fmt.Fprintf(w, `[Unit]
+Description=flowd: network %s
+Documentation=https://github.com/ERnsTL/flowd
+
+[Service]
+# flowd notifies once all processes are ready
+Type=notify
+WorkingDirectory=%s
+ExecStart=%s
+# Shutdown delay in seconds, before process is tried to be killed with KILL
+TimeoutStopSec=120
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, name, systemdQuote(workDir), strings.Join(args, " "))
+	return err
+}
+
+func writeNetworkTarget(w io.Writer, name string, unitNames []string) error {
+	sort.Strings(unitNames)
+	_, err := fmt.Fprintf(w, `[Unit]
+Description=flowd: network %s
+Documentation=https://github.com/ERnsTL/flowd
+Wants=%s
+
+[Install]
+WantedBy=multi-user.target
+`, name, strings.Join(unitNames, " "))
+	return err
+}
+
+func writeProcessUnit(w io.Writer, name string, workDir string, plan *ProcessPlan, proc *Process, fifos []string) error {
+	// component path must be absolute for ExecStart
+	executable := plan.Executable
+	if executable == "" {
+		executable = plan.Component
+	}
+	if !filepath.IsAbs(executable) {
+		executable = filepath.Join(workDir, executable)
+	}
+	args := []string{systemdQuote(executable)}
+	for _, arg := range plan.Args[1:] {
+		args = append(args, systemdQuote(arg))
+	}
+	// named pipes, creating their directories first, eg. given using -fifodir
+	mkfifos := []string{}
+	dirs := map[string]bool{}
+	for _, path := range fifos {
+		if dir := filepath.Dir(path); !dirs[dir] {
+			dirs[dir] = true
+			mkfifos = append(mkfifos, "mkdir -p "+shellQuote(dir))
+		}
+		quoted := shellQuote(path)
+		mkfifos = append(mkfifos, fmt.Sprintf("[ -p %s ] || mkfifo -m 0770 %s", quoted, quoted))
+	}
+
+	lines := []string{
+		"[Unit]",
+		fmt.Sprintf("Description=flowd: process %s of network %s (component %s)", plan.Name, name, plan.Component),
+		"Documentation=https://github.com/ERnsTL/flowd",
+		fmt.Sprintf("PartOf=%s.target", systemdEscape(name, "-")),
+	}
+	if value := proc.Metadata[afterMetadata]; value != "" {
+		afterUnits := []string{}
+		for _, other := range strings.Split(value, afterSeparator) {
+			afterUnits = append(afterUnits, processUnitName(name, other))
+		}
+		lines = append(lines,
+			"After="+strings.Join(afterUnits, " "),
+			"Wants="+strings.Join(afterUnits, " "),
+		)
+	}
+	lines = append(lines,
+		"",
+		"[Service]",
+	)
+	switch proc.Metadata[readyMetadata] {
+	case readySignal:
+		// component notifies using libunixfbp.Ready()
+		lines = append(lines, "Type=notify")
+	case readyExit:
+		// units ordered after this one start once it has exited
+		lines = append(lines, "Type=oneshot")
+	}
+	lines = append(lines, "WorkingDirectory="+systemdQuote(workDir))
+	if len(mkfifos) > 0 {
+		lines = append(lines, "ExecStartPre=/bin/sh -c "+systemdQuote(strings.Join(mkfifos, "; ")))
+	}
+	lines = append(lines, "ExecStart="+strings.Join(args, " "))
+	for _, iip := range plan.IIPs {
+		if iip.Path == "" {
+			// delivered as program arguments
+			continue
+		}
+		// NOTE: same frame as flowd sends, see framing format
+		deliver := iipPrintf(iip, shellQuote) + " > " + shellQuote(iip.Path)
+		lines = append(lines, "ExecStartPost=/bin/sh -c "+systemdQuote(deliver))
+	}
+	// settings from metadata
+	restart := "on-failure"
+	keys := []string{}
+	for key := range proc.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := proc.Metadata[key]
+		if key == "restart" {
+			restart = value
+		} else if key == "cpu" {
+			lines = append(lines, "CPUQuota="+value+"%")
+		} else if setting, found := systemdMetadata[key]; found {
+			lines = append(lines, setting+"="+value)
+		} else if strings.HasPrefix(key, envMetadataPrefix) {
+			lines = append(lines, "Environment="+systemdQuote(strings.TrimPrefix(key, envMetadataPrefix)+"="+value))
+		}
+	}
+	lines = append(lines,
+		"Restart="+restart,
+		"",
+		"[Install]",
+		fmt.Sprintf("WantedBy=%s.target", systemdEscape(name, "-")),
+		"",
+	)
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// processUnitName returns the name of the unit running the process in mode process
+func processUnitName(network string, process string) string {
+	return systemdEscape(network, "-") + "-" + systemdEscape(process, "") + ".service"
+}
+
+// systemdEscape escapes a name for use in unit names like systemd-escape, except for the characters given to keep
+// NOTE: escaping dashes in process names keeps them apart from the dash following the network name
+func systemdEscape(name string, keep string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '/':
+			escaped.WriteByte('-')
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == ':', c == '_', c == '.' && i > 0, strings.IndexByte(keep, c) >= 0:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		}
+	}
+	return escaped.String()
+}
+
+// systemdQuote quotes a word for use in a unit file command line, escaping specifiers and variable expansion
+func systemdQuote(word string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(word)
+	if escaped == word && word != "" && !strings.ContainsAny(word, " \t'") {
+		return word
+	}
+	return `"` + escaped + `"`
+}
+
+// shellQuote quotes a word for POSIX sh using single quotes
+func shellQuote(word string) string {
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// flags not repeated in the unit running flowd: modes other than running the network, and -quiet given by the unit
+var systemdSkipFlags = map[string]bool{
+	"h": true, "quiet": true, "graph": true, "graph-format": true, "analyze": true, "diff": true, "fmt": true, "lint": true,
+	"deps": true, "plan": true, "format": true, "export-sh": true, "export-systemd": true, "systemd-mode": true,
+}
+
+// systemdFlowdArgs returns the flowd arguments to be repeated in the unit running flowd, without the network definition
+// NOTE: relative paths stay valid, since the unit runs flowd in the current working directory
+func systemdFlowdArgs(flags *flag.FlagSet, args []string) []string {
+	flowdArgs := filterArgs(flags, args, systemdSkipFlags)
+	return flowdArgs[:len(flowdArgs)-flags.NArg()]
+}
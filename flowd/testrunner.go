@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Declarative network tests, run using "flowd test".
+
+A test spec in YAML or JSON names a network definition and test cases. Each test case injects frames into network
+inports or into inports of single processes (PROCESS.PORT) and expects frames on network outports or unconnected
+process outports:
+
+	name: filter passes cron lines
+	network: subnet_inner.fbp   # relative to the spec file
+	set:                        # variables for the network definition
+	  LEVEL: info
+	timeout: 5s
+	cases:
+	  - name: only matching lines
+	    inject:
+	      - port: IN
+	        frames:
+	          - body: "hello cron\nother\n"
+	        close: true         # send PortClose after the frames
+	    expect:
+	      - port: OUT
+	        frames:
+	          - body: hello cron
+	          - type: control
+	            bodyType: PortClose
+
+Frame matchers check type, bodyType, header fields and the body (exact, bodyContains or bodyRegex); unset fields are not
+checked. In directories, test specs are the files named *.test.yaml, *.test.yml or *.test.json. Each test case runs in its own flowd process with its own directory for named pipes and sockets. The working
+directory is the current one unless given as workdir in the spec, relative to the spec file.
+*/
+
+const defaultTestTimeout = 10 * time.Second
+
+// TestSpec is a test specification file
+type TestSpec struct {
+	Name    string            `json:"name" yaml:"name"`
+	Network string            `json:"network" yaml:"network"`
+	WorkDir string            `json:"workdir" yaml:"workdir"`
+	Set     map[string]string `json:"set" yaml:"set"`
+	Timeout string            `json:"timeout" yaml:"timeout"`
+	Cases   []TestCase        `json:"cases" yaml:"cases"`
+	path    string
+}
+
+// TestCase is one run of the network with frames to inject and expected frames
+type TestCase struct {
+	Name    string       `json:"name" yaml:"name"`
+	Timeout string       `json:"timeout" yaml:"timeout"`
+	Inject  []TestInject `json:"inject" yaml:"inject"`
+	Expect  []TestExpect `json:"expect" yaml:"expect"`
+}
+
+// TestInject holds the frames to send into a network inport or PROCESS.PORT
+type TestInject struct {
+	Port   string      `json:"port" yaml:"port"`
+	Frames []TestFrame `json:"frames" yaml:"frames"`
+	Close  bool        `json:"close" yaml:"close"`
+}
+
+// TestExpect holds the frames expected in order from a network outport or PROCESS.PORT
+type TestExpect struct {
+	Port   string      `json:"port" yaml:"port"`
+	Frames []TestFrame `json:"frames" yaml:"frames"`
+}
+
+// TestFrame is a frame to inject or a matcher for an expected frame
+type TestFrame struct {
+	Type         string            `json:"type" yaml:"type"`
+	BodyType     string            `json:"bodyType" yaml:"bodyType"`
+	Headers      map[string]string `json:"headers" yaml:"headers"`
+	Body         *string           `json:"body" yaml:"body"`
+	BodyContains string            `json:"bodyContains" yaml:"bodyContains"`
+	BodyRegex    string            `json:"bodyRegex" yaml:"bodyRegex"`
+}
+
+// TestResult is the outcome of a test case
+type TestResult struct {
+	Spec     string
+	Case     string
+	Failures []string
+	Output   string // output of flowd and the components, only kept on failure
+	Duration time.Duration
+}
+
+// runTests is the "flowd test" command, returns the exit code
+func runTests(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	format := flags.String("format", "tap", "output format: tap or junit")
+	timeout := flags.Duration("timeout", defaultTestTimeout, "default timeout per test case")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: missing test spec file(s) or directories")
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "test [-format tap|junit] [-timeout duration] [test-spec-file(s)|dir(s)]")
+		flags.PrintDefaults()
+		return 2
+	}
+	if *format != "tap" && *format != "junit" {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown output format '%s' - expected tap or junit\n", *format)
+		return 2
+	}
+	flowdPath, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: finding flowd executable:", err)
+		return 2
+	}
+
+	// load specs
+	specs := []*TestSpec{}
+	for _, arg := range flags.Args() {
+		paths, err := findTestSpecs(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			return 2
+		}
+		for _, path := range paths {
+			spec, err := loadTestSpec(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: loading test spec %s: %s\n", path, err)
+				return 2
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	// run
+	results := []*TestResult{}
+	for _, spec := range specs {
+		for _, tc := range spec.Cases {
+			results = append(results, runTestCase(flowdPath, spec, tc, *timeout))
+		}
+	}
+
+	// report
+	if *format == "junit" {
+		err = writeJUnit(os.Stdout, results)
+	} else {
+		err = writeTAP(os.Stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: writing test results:", err)
+		return 2
+	}
+	for _, result := range results {
+		if len(result.Failures) > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// findTestSpecs returns the given file or the test specs in the given directory
+// NOTE: only files named *.test.yaml, *.test.yml or *.test.json, since network definitions may be next to them
+func findTestSpecs(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	paths := []string{}
+	for _, pattern := range []string{"*.test.yaml", "*.test.yml", "*.test.json"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadTestSpec reads a test spec in JSON or YAML format, depending on the file extension
+func loadTestSpec(path string) (*TestSpec, error) {
+	specBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &TestSpec{path: path}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(specBytes, spec)
+	} else {
+		err = yaml.Unmarshal(specBytes, spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if spec.Network == "" {
+		return nil, errors.New("missing network")
+	}
+	if spec.Name == "" {
+		spec.Name = filepath.Base(path)
+	}
+	if len(spec.Cases) == 0 {
+		return nil, errors.New("no test cases")
+	}
+	for index, tc := range spec.Cases {
+		if tc.Name == "" {
+			spec.Cases[index].Name = fmt.Sprintf("case %d", index+1)
+		}
+		for _, inject := range tc.Inject {
+			if inject.Port == "" {
+				return nil, fmt.Errorf("%s: inject without port", spec.Cases[index].Name)
+			}
+		}
+		for _, expect := range tc.Expect {
+			if expect.Port == "" {
+				return nil, fmt.Errorf("%s: expect without port", spec.Cases[index].Name)
+			}
+			for _, matcher := range expect.Frames {
+				if matcher.BodyRegex != "" {
+					if _, err := regexp.Compile(matcher.BodyRegex); err != nil {
+						return nil, fmt.Errorf("%s: port %s: %s", spec.Cases[index].Name, expect.Port, err)
+					}
+				}
+			}
+		}
+	}
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return nil, fmt.Errorf("timeout: %s", err)
+		}
+	}
+	return spec, nil
+}
+
+// runTestCase runs the network in a separate flowd process, injects the frames and checks the expected frames
+func runTestCase(flowdPath string, spec *TestSpec, tc TestCase, timeout time.Duration) (result *TestResult) {
+	result = &TestResult{Spec: spec.Name, Case: tc.Name}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+	fail := func(format string, args ...interface{}) *TestResult {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+		return result
+	}
+	for _, duration := range []string{spec.Timeout, tc.Timeout} {
+		if duration != "" {
+			var err error
+			if timeout, err = time.ParseDuration(duration); err != nil {
+				return fail("timeout: %s", err)
+			}
+		}
+	}
+	deadline := start.Add(timeout)
+
+	// isolated directory for named pipes and sockets
+	dir, err := ioutil.TempDir("", "flowd-test-")
+	if err != nil {
+		return fail("creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// arguments
+	specDir := filepath.Dir(spec.path)
+	args := []string{"-quiet", "-fifodir", dir}
+	names := []string{}
+	for name := range spec.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-set", name+"="+spec.Set[name])
+	}
+	// NOTE: all network ports need an endpoint, frames from outports not expected are discarded
+	networkPath := resolvePath(specDir, spec.Network)
+	inports, outports, err := testNetworkPorts(networkPath, spec.Set)
+	if err != nil {
+		return fail("reading network definition: %s", err)
+	}
+	for _, inject := range tc.Inject {
+		inports = append(inports, inject.Port)
+	}
+	expected := map[string]bool{}
+	for _, expect := range tc.Expect {
+		if expected[expect.Port] {
+			return fail("port %s expected multiple times", expect.Port)
+		}
+		expected[expect.Port] = true
+		outports = append(outports, expect.Port)
+	}
+	inSockets := map[string]string{}
+	for _, port := range inports {
+		if _, exists := inSockets[port]; !exists {
+			inSockets[port] = filepath.Join(dir, fmt.Sprintf("in%d.sock", len(inSockets)))
+			args = append(args, "-in", port+"=unix://"+inSockets[port])
+		}
+	}
+	outSockets := map[string]string{}
+	for _, port := range outports {
+		if _, exists := outSockets[port]; !exists {
+			outSockets[port] = filepath.Join(dir, fmt.Sprintf("out%d.sock", len(outSockets)))
+			args = append(args, "-out", port+"=unix://"+outSockets[port])
+		}
+	}
+	args = append(args, networkPath)
+
+	// start flowd in its own process group to be able to stop it including all components
+	cmd := exec.Command(flowdPath, args...)
+	if spec.WorkDir != "" {
+		cmd.Dir = resolvePath(specDir, spec.WorkDir)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return fail("starting flowd: %s", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+		if len(result.Failures) > 0 {
+			result.Output = output.String()
+		}
+	}()
+
+	// receive from outports
+	type received struct {
+		port  string
+		frame *flowd.Frame
+	}
+	receivedChan := make(chan received)
+	done := make(chan struct{})
+	defer close(done)
+	for port, path := range outSockets {
+		conn, err := dialUntil(path, deadline, exited)
+		if err != nil {
+			return fail("connecting to outport %s: %s", port, err)
+		}
+		defer conn.Close()
+		go func(port string, conn net.Conn) {
+			reader := bufio.NewReader(conn)
+			for {
+				frame, err := flowd.Deserialize(reader)
+				if err != nil {
+					return
+				}
+				select {
+				case receivedChan <- received{port, frame}:
+				case <-done:
+					return
+				}
+			}
+		}(port, conn)
+	}
+
+	// send into inports
+	for _, inject := range tc.Inject {
+		conn, err := dialUntil(inSockets[inject.Port], deadline, exited)
+		if err != nil {
+			return fail("connecting to inport %s: %s", inject.Port, err)
+		}
+		writer := bufio.NewWriter(conn)
+		for _, testFrame := range inject.Frames {
+			if err = testFrame.frame(inject.Port).Serialize(writer); err != nil {
+				break
+			}
+		}
+		if err == nil && inject.Close {
+			portClose := flowd.PortClose(inject.Port)
+			err = portClose.Serialize(writer)
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		conn.Close()
+		if err != nil {
+			return fail("sending into inport %s: %s", inject.Port, err)
+		}
+	}
+
+	// collect until all expected frames arrived
+	frames := map[string][]*flowd.Frame{}
+	missing, expectedCount := 0, map[string]int{}
+	for _, expect := range tc.Expect {
+		missing += len(expect.Frames)
+		expectedCount[expect.Port] = len(expect.Frames)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+collect:
+	for missing > 0 {
+		select {
+		case r := <-receivedChan:
+			if !expected[r.port] {
+				continue
+			}
+			frames[r.port] = append(frames[r.port], r.frame)
+			if len(frames[r.port]) <= expectedCount[r.port] {
+				missing--
+			}
+		case <-timer.C:
+			fail("timeout after %s", timeout)
+			break collect
+		case err := <-exited:
+			// NOTE: put back for deferred cleanup
+			exited <- err
+			fail("flowd exited before all expected frames arrived: %v", err)
+			break collect
+		}
+	}
+
+	// compare
+	for _, expect := range tc.Expect {
+		got := frames[expect.Port]
+		for index, matcher := range expect.Frames {
+			if index >= len(got) {
+				fail("port %s: frame %d: missing, got %d frame(s)", expect.Port, index+1, len(got))
+				break
+			}
+			if mismatch := matcher.match(got[index]); mismatch != "" {
+				fail("port %s: frame %d: %s", expect.Port, index+1, mismatch)
+			}
+		}
+	}
+	return result
+}
+
+// testNetworkPorts returns the network inports and outports declared in the network definition
+func testNetworkPorts(path string, params map[string]string) (inports []string, outports []string, err error) {
+	if strings.HasSuffix(path, ".drw") {
+		// no network ports in .drw network definitions
+		return nil, nil, nil
+	}
+	nw, err := loadNetworkFile(path, []map[string]string{params})
+	if err != nil {
+		return nil, nil, err
+	}
+	for name := range nw.Inports {
+		inports = append(inports, name)
+	}
+	for name := range nw.Outports {
+		outports = append(outports, name)
+	}
+	sort.Strings(inports)
+	sort.Strings(outports)
+	return inports, outports, nil
+}
+
+// resolvePath returns the path relative to the given directory, if not absolute
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// dialUntil connects to the Unix socket, retrying until flowd is listening on it
+func dialUntil(path string, deadline time.Time, exited chan error) (net.Conn, error) {
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case exitErr := <-exited:
+			exited <- exitErr
+			return nil, fmt.Errorf("flowd exited: %v", exitErr)
+		default:
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// frame returns the frame to be injected
+func (tf TestFrame) frame(port string) *flowd.Frame {
+	frame := &flowd.Frame{Type: tf.Type, BodyType: tf.BodyType, Port: port, Extensions: tf.Headers}
+	if frame.Type == "" {
+		frame.Type = "data"
+	}
+	if tf.Body != nil {
+		frame.Body = []byte(*tf.Body)
+	}
+	return frame
+}
+
+// match checks the frame against the matcher, returns a description of the mismatch or empty string
+func (tf TestFrame) match(frame *flowd.Frame) string {
+	if tf.Type != "" && frame.Type != tf.Type {
+		return fmt.Sprintf("type: expected '%s', got '%s'", tf.Type, frame.Type)
+	}
+	if tf.BodyType != "" && frame.BodyType != tf.BodyType {
+		return fmt.Sprintf("body type: expected '%s', got '%s'", tf.BodyType, frame.BodyType)
+	}
+	keys := []string{}
+	for key := range tf.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, found := frame.Extensions[key]; !found || value != tf.Headers[key] {
+			return fmt.Sprintf("header %s: expected '%s', got '%s'", key, tf.Headers[key], value)
+		}
+	}
+	if tf.Body != nil && string(frame.Body) != *tf.Body {
+		return fmt.Sprintf("body: expected %q, got %q", *tf.Body, frame.Body)
+	}
+	if tf.BodyContains != "" && !bytes.Contains(frame.Body, []byte(tf.BodyContains)) {
+		return fmt.Sprintf("body: expected to contain %q, got %q", tf.BodyContains, frame.Body)
+	}
+	if tf.BodyRegex != "" && !regexp.MustCompile(tf.BodyRegex).Match(frame.Body) {
+		return fmt.Sprintf("body: expected to match %q, got %q", tf.BodyRegex, frame.Body)
+	}
+	return ""
+}
+
+// writeTAP outputs the results in Test Anything Protocol format
+func writeTAP(out io.Writer, results []*TestResult) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", len(results))
+	for index, result := range results {
+		if len(result.Failures) == 0 {
+			fmt.Fprintf(w, "ok %d - %s: %s\n", index+1, result.Spec, result.Case)
+			continue
+		}
+		fmt.Fprintf(w, "not ok %d - %s: %s\n", index+1, result.Spec, result.Case)
+		fmt.Fprintln(w, "  ---")
+		fmt.Fprintln(w, "  failures:")
+		for _, failure := range result.Failures {
+			fmt.Fprintf(w, "    - %q\n", failure)
+		}
+		if result.Output != "" {
+			fmt.Fprintln(w, "  output: |")
+			for _, line := range strings.Split(strings.TrimRight(result.Output, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+		fmt.Fprintln(w, "  ...")
+	}
+	return w.Flush()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+	duration time.Duration
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit outputs the results as JUnit XML report, one test suite per spec
+func writeJUnit(out io.Writer, results []*TestResult) error {
+	report := junitTestSuites{}
+	suiteIndex := map[string]int{}
+	for _, result := range results {
+		index, exists := suiteIndex[result.Spec]
+		if !exists {
+			index = len(report.Suites)
+			suiteIndex[result.Spec] = index
+			report.Suites = append(report.Suites, junitTestSuite{Name: result.Spec})
+		}
+		suite := &report.Suites[index]
+		tc := junitTestCase{Name: result.Case, ClassName: result.Spec, Time: fmt.Sprintf("%.3f", result.Duration.Seconds())}
+		if len(result.Failures) > 0 {
+			tc.Failure = &junitFailure{Message: result.Failures[0], Text: strings.Join(result.Failures, "\n")}
+			tc.SystemOut = result.Output
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+		suite.duration += result.Duration
+		suite.Time = fmt.Sprintf("%.3f", suite.duration.Seconds())
+	}
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
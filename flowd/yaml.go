@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/oleksandr/fbp"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+YAML network definitions, for large networks with lots of metadata, where the .fbp notation gets cramped.
+
+The notation is selected by the file extension .yaml or .yml or using -notation yaml:
+
+	inports:
+	  NETIN: Filter.IN
+	outports:
+	  NETOUT: Filter.OUT
+	processes:
+	  Read:
+	    component: bin/file-read
+	  Filter:
+	    component: bin/packet-filter-string
+	    metadata:
+	      replicas: 2
+	      restart: always
+	    env:
+	      LANG: C
+	connections:
+	  - from: Read.OUT
+	    to: Filter.IN
+	iips:
+	  - to: Read.ARGS
+	    data: /var/log/syslog
+	  - to: Filter.ARGS
+	    file: filter-args.txt
+
+Ports are given as PROCESS.PORT or PROCESS.PORT[INDEX] for array ports and processes have to be declared under
+processes, which keeps the order of the definition. IIP data is given either inline, multi-line using YAML block
+scalars like |, or as a file relative to the network definition, without its final line break. The body type and
+content-type header of the IIP frame are given using type and content-type. Environment variables
+are stored as process metadata env_NAME=VALUE, which is set for the component when run, exported or put into units.
+
+The result is the same as of the equivalent .fbp network definition, so includes, -lint, -analyze, -diff etc. work
+as usual. The JSON schema in doc/network.schema.json can be used by editors for validation and completion.
+
+NOTE: variables like ${NAME} are substituted in the network definition, but not in IIP files.
+*/
+
+// YAMLNetwork is a network definition in YAML notation
+type YAMLNetwork struct {
+	Inports     map[string]string `yaml:"inports"`  // network port name -> PROCESS.PORT
+	Outports    map[string]string `yaml:"outports"` // network port name -> PROCESS.PORT
+	Processes   YAMLProcesses     `yaml:"processes"`
+	Connections []YAMLConnection  `yaml:"connections"`
+	IIPs        []YAMLIIP         `yaml:"iips"`
+}
+
+// YAMLProcess is a process of a YAML network definition
+type YAMLProcess struct {
+	Component string            `yaml:"component"`
+	Metadata  map[string]string `yaml:"metadata"`
+	Env       map[string]string `yaml:"env"`
+}
+
+// YAMLProcesses holds the processes by name in the order of the definition
+type YAMLProcesses struct {
+	Names  []string
+	ByName map[string]*YAMLProcess
+}
+
+// YAMLConnection is a connection between two process ports, each given as PROCESS.PORT
+type YAMLConnection struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// YAMLIIP is an IIP into a process port given as PROCESS.PORT, either with inline data or from a file
+type YAMLIIP struct {
+	To   string  `yaml:"to"`
+	Data *string `yaml:"data"`
+	File string  `yaml:"file"`
+	// body type and content-type header of the IIP frame, see iip.go
+	Type        string `yaml:"type"`
+	ContentType string `yaml:"content-type"`
+}
+
+// yamlEndpointPattern matches a process port like PROCESS.PORT or PROCESS.PORT[INDEX]
+var yamlEndpointPattern = regexp.MustCompile(`^(.+)\.([A-Za-z_][A-Za-z0-9_-]*)(\[([0-9]+)\])?$`)
+
+// UnmarshalYAML decodes the processes keeping their order
+func (processes *YAMLProcesses) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ordered yaml.MapSlice
+	if err := unmarshal(&ordered); err != nil {
+		return err
+	}
+	if err := unmarshal(&processes.ByName); err != nil {
+		return err
+	}
+	for _, item := range ordered {
+		processes.Names = append(processes.Names, fmt.Sprint(item.Key))
+	}
+	return nil
+}
+
+// parseYAML parses a network definition in YAML notation; IIP files are relative to baseDir
+func parseYAML(source []byte, baseDir string) (*fbp.Fbp, error) {
+	var definition YAMLNetwork
+	if err := yaml.UnmarshalStrict(source, &definition); err != nil {
+		return nil, err
+	}
+	nw := &fbp.Fbp{Processes: []*fbp.Process{}, Connections: []*fbp.Connection{}, Inports: map[string]*fbp.Endpoint{}, Outports: map[string]*fbp.Endpoint{}}
+
+	// processes
+	for _, name := range definition.Processes.Names {
+		declared := definition.Processes.ByName[name]
+		if declared == nil || declared.Component == "" {
+			return nil, fmt.Errorf("process %s: no component given", name)
+		}
+		proc := &fbp.Process{Name: name, Component: declared.Component, Metadata: map[string]string{}}
+		for key, value := range declared.Metadata {
+			proc.Metadata[key] = value
+		}
+		for key, value := range declared.Env {
+			proc.Metadata[envMetadataPrefix+key] = value
+		}
+		nw.Processes = append(nw.Processes, proc)
+	}
+	endpoint := func(what string, port string) (*fbp.Endpoint, error) {
+		result := parseYAMLEndpoint(port)
+		if result == nil {
+			return nil, fmt.Errorf("%s: expected PROCESS.PORT or PROCESS.PORT[INDEX], got '%s'", what, port)
+		}
+		if _, declared := definition.Processes.ByName[result.Process]; !declared {
+			return nil, fmt.Errorf("%s: process %s not declared in processes", what, result.Process)
+		}
+		return result, nil
+	}
+
+	// connections and IIPs
+	for index, conn := range definition.Connections {
+		what := fmt.Sprintf("connection %d", index+1)
+		source, err := endpoint(what+" from", conn.From)
+		if err != nil {
+			return nil, err
+		}
+		target, err := endpoint(what+" to", conn.To)
+		if err != nil {
+			return nil, err
+		}
+		nw.Connections = append(nw.Connections, &fbp.Connection{Source: source, Target: target})
+	}
+	for index, iip := range definition.IIPs {
+		what := fmt.Sprintf("IIP %d", index+1)
+		target, err := endpoint(what+" to", iip.To)
+		if err != nil {
+			return nil, err
+		}
+		var data string
+		switch {
+		case iip.Data != nil && iip.File != "":
+			return nil, fmt.Errorf("%s: expected either data or file, got both", what)
+		case iip.Data != nil:
+			data = *iip.Data
+		case iip.File != "":
+			path := iip.File
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", what, err)
+			}
+			data = strings.TrimSuffix(string(content), "\n")
+		default:
+			return nil, fmt.Errorf("%s: expected data or file", what)
+		}
+		options := map[string]string{}
+		if iip.Type != "" {
+			options["type"] = iip.Type
+		}
+		if iip.ContentType != "" {
+			options["content-type"] = iip.ContentType
+		}
+		nw.Connections = append(nw.Connections, &fbp.Connection{Target: target, Data: joinIIPOptions(options, escapeIIPData(data))})
+	}
+
+	// network ports
+	// NOTE: processes not in the network are allowed like in .fbp network definitions, reported by -lint
+	for name, port := range definition.Inports {
+		if nw.Inports[name] = parseYAMLEndpoint(port); nw.Inports[name] == nil {
+			return nil, fmt.Errorf("inport %s: expected PROCESS.PORT or PROCESS.PORT[INDEX], got '%s'", name, port)
+		}
+	}
+	for name, port := range definition.Outports {
+		if nw.Outports[name] = parseYAMLEndpoint(port); nw.Outports[name] == nil {
+			return nil, fmt.Errorf("outport %s: expected PROCESS.PORT or PROCESS.PORT[INDEX], got '%s'", name, port)
+		}
+	}
+
+	return nw, nil
+}
+
+// parseYAMLEndpoint returns the process port given as PROCESS.PORT or PROCESS.PORT[INDEX], nil if malformed
+func parseYAMLEndpoint(port string) *fbp.Endpoint {
+	match := yamlEndpointPattern.FindStringSubmatch(port)
+	if match == nil {
+		return nil
+	}
+	endpoint := &fbp.Endpoint{Process: match[1], Port: match[2]}
+	if match[4] != "" {
+		index, _ := strconv.Atoi(match[4])
+		endpoint.Index = &index
+	}
+	return endpoint
+}
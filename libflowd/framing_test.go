@@ -195,3 +195,40 @@ func BenchmarkParseFrameV1(b *testing.B) {
 		resultFrame = frame
 	}
 }
+
+func TestDecodeIIP(t *testing.T) {
+	type routes struct {
+		Default string            `json:"default" yaml:"default"`
+		Routes  map[string]string `json:"routes" yaml:"routes"`
+	}
+	expected := routes{Default: "OUT", Routes: map[string]string{"a": "A"}}
+
+	// by content-type
+	var decoded routes
+	iip := &flowd.Frame{Type: "data", BodyType: "Routes", Port: "CONF", Extensions: map[string]string{"content-type": "application/json; charset=utf-8"}, Body: []byte(`{"default": "OUT", "routes": {"a": "A"}}`)}
+	assert.Nil(t, flowd.DecodeIIP(iip, &decoded))
+	assert.Equal(t, expected, decoded)
+	decoded = routes{}
+	iip = &flowd.Frame{Type: "data", BodyType: "Routes", Port: "CONF", Extensions: map[string]string{"content-type": "application/yaml"}, Body: []byte("default: OUT\nroutes:\n  a: A\n")}
+	assert.Nil(t, flowd.DecodeIIP(iip, &decoded))
+	assert.Equal(t, expected, decoded)
+
+	// by content
+	decoded = routes{}
+	iip = &flowd.Frame{Type: "data", BodyType: "IIP", Port: "CONF", Body: []byte("default: OUT\nroutes: {a: A}\n")}
+	assert.Nil(t, flowd.DecodeIIP(iip, &decoded))
+	assert.Equal(t, expected, decoded)
+	iip.Extensions = map[string]string{"content-type": "text/csv"}
+	assert.EqualError(t, flowd.DecodeIIP(iip, &decoded), "decoding IIP of body type IIP: unsupported content-type text/csv")
+
+	// as received from flowd
+	buf := &bytes.Buffer{}
+	iip = &flowd.Frame{Type: "data", BodyType: "Routes", Port: "CONF", Extensions: map[string]string{"content-type": "application/json"}, Body: []byte(`{"default": "OUT"}`)}
+	assert.Nil(t, iip.Serialize(buf))
+	received, err := flowd.GetIIPFrame("CONF", bufio.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Equal(t, "Routes", received.BodyType)
+	decoded = routes{}
+	assert.Nil(t, flowd.DecodeIIP(received, &decoded))
+	assert.Equal(t, "OUT", decoded.Default)
+}
@@ -2,7 +2,12 @@ package flowd
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
 )
 
 // GetIIP receives configuration from IIP = initial information packet/frame
@@ -23,3 +28,45 @@ func GetIIP(port string, stdin *bufio.Reader) (string, error) {
 	// regular case
 	return (string)(iip.Body), nil
 }
+
+// GetIIPFrame receives the next IIP like GetIIP, but returns the whole frame, which can have a body type other than IIP
+// and a content-type header, as given in the network definition
+func GetIIPFrame(port string, stdin *bufio.Reader) (*Frame, error) {
+	iip, err := Deserialize(stdin)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR getting IIP from STDIN: %s", err)
+	}
+	if iip.Port != port {
+		return nil, fmt.Errorf("ERROR: port of IIP is not '%s' but '%s' - exiting", port, iip.Port)
+	}
+	return iip, nil
+}
+
+// DecodeIIP decodes the JSON or YAML body of the IIP into the given value, like json.Unmarshal
+// NOTE: the format is given by the content-type header, eg. application/json or application/yaml; without it, a body
+// starting with { or [ is taken as JSON, otherwise as YAML.
+// NOTE: YAML is decoded using the yaml struct tags or the lowercase field names.
+func DecodeIIP(iip *Frame, v interface{}) error {
+	contentType := strings.ToLower(iip.Extensions["content-type"])
+	if index := strings.Index(contentType, ";"); index != -1 {
+		contentType = strings.TrimSpace(contentType[:index])
+	}
+	body := bytes.TrimSpace(iip.Body)
+	var err error
+	switch {
+	case strings.HasSuffix(contentType, "json"):
+		err = json.Unmarshal(body, v)
+	case strings.HasSuffix(contentType, "yaml"):
+		err = yaml.Unmarshal(body, v)
+	case contentType != "":
+		return fmt.Errorf("decoding IIP of body type %s: unsupported content-type %s", iip.BodyType, contentType)
+	case bytes.HasPrefix(body, []byte("{")) || bytes.HasPrefix(body, []byte("[")):
+		err = json.Unmarshal(body, v)
+	default:
+		err = yaml.Unmarshal(body, v)
+	}
+	if err != nil {
+		return fmt.Errorf("decoding IIP of body type %s: %s", iip.BodyType, err)
+	}
+	return nil
+}
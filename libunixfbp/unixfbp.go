@@ -4,8 +4,14 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/ERnsTL/flowd/libflowd"
+	"github.com/kballard/go-shellquote"
 )
 
 // OpenOutPort opens an output port resp. its named pipe, returns the pipe a buffered writer on it and also stores the entry in OutPorts.
@@ -78,6 +84,88 @@ func ArrayPortMemberWriters(prefix string) (members []*bufio.Writer) {
 	return
 }
 
+// Ready signals that the component is ready, eg. listening for connections.
+// If started by flowd with process metadata ready=signal, it writes READY into the file descriptor given in FLOWD_READY_FD,
+// if started by a systemd unit with Type=notify, it notifies systemd. Otherwise it does nothing. Only the first call has an effect.
+func Ready() error {
+	if fdValue := os.Getenv("FLOWD_READY_FD"); fdValue != "" {
+		os.Unsetenv("FLOWD_READY_FD")
+		fd, err := strconv.Atoi(fdValue)
+		if err != nil {
+			return fmt.Errorf("parsing FLOWD_READY_FD: %s", err)
+		}
+		readyPipe := os.NewFile(uintptr(fd), "ready")
+		defer readyPipe.Close()
+		_, err = readyPipe.WriteString("READY\n")
+		return err
+	}
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		os.Unsetenv("NOTIFY_SOCKET")
+		if strings.HasPrefix(socket, "@") {
+			// abstract namespace
+			socket = "\x00" + socket[1:]
+		}
+		// see sd_notify(3)
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("notifying systemd: %s", err)
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("READY=1"))
+		return err
+	}
+	return nil
+}
+
+// ConfPort is the inport on which components accept new configuration at runtime, see WatchConf
+const ConfPort = "CONF"
+
+// WatchConf receives new configuration on the CONF inport, if the component has one, and calls apply for each.
+// By convention, each data frame on CONF carries a complete configuration in the same format as the IIP to ARGS, so it
+// is split into arguments the same way. If apply returns an error, it is reported and the component is expected to
+// keep its current configuration. apply is called from a separate goroutine, one configuration at a time.
+// Returns whether the component has a CONF inport.
+// NOTE: the named pipe is opened again after EOF, since flowd opens it for each configuration it delivers.
+func WatchConf(apply func(args []string) error) bool {
+	port, exists := InPorts[ConfPort]
+	if !exists {
+		return false
+	}
+	go func() {
+		for {
+			confPipe, err := os.OpenFile(port.Path, os.O_RDONLY, os.ModeNamedPipe)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: opening inport %s at path %s: %s\n", ConfPort, port.Path, err)
+				return
+			}
+			confReader := bufio.NewReader(confPipe)
+			for {
+				frame, err := flowd.Deserialize(confReader)
+				if err != nil {
+					if err != io.EOF {
+						fmt.Fprintln(os.Stderr, "ERROR: reading configuration:", err)
+					}
+					break
+				}
+				if frame.Type != "data" {
+					continue
+				}
+				args, err := shellquote.Split(string(frame.Body))
+				if err == nil {
+					err = apply(args)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: invalid configuration, keeping current one:", err)
+				} else if !Quiet {
+					fmt.Fprintln(os.Stderr, "applied new configuration")
+				}
+			}
+			confPipe.Close()
+		}
+	}()
+	return true
+}
+
 // internal state for the flag parsers for -inport and -inpath as well as -outport and -outpath
 var inPortName, outPortName string
 
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/ERnsTL/flowd/libflowd"
+)
+
+/*
+Frame toolkit for converting frames between the framing format, JSON lines and pretty text.
+
+	flowd-frame encode [-v1] [file...]           JSON lines -> frames
+	flowd-frame decode [file...]                 frames -> JSON lines
+	flowd-frame pretty [-hex] [file...]          frames -> header tables and bodies as UTF-8 text or hexdump
+	flowd-frame filter [-v] [-v1] -match EXPR... [file...]   frames -> frames matching all expressions
+
+Input is read from the given files in order, eg. named pipes or capture files of -record, otherwise from STDIN. Frames
+are read in both V1 and V2 format and written in V2 format, in V1 format using -v1. Output is flushed whenever the
+input has no more data buffered, so that this can be used on live streams.
+
+A frame as JSON line, with the body as UTF-8 string or, if binary, base64-encoded:
+
+	{"type":"data","bodyType":"Line","port":"IN","headers":{"content-type":"text/plain"},"body":"hello world"}
+	{"type":"data","bodyType":"Blob","bodyBase64":"AAEC"}
+
+Filter expressions are on the header fields as in the framing format, case-insensitive, with the frame type as frame
+and the body length as length:
+
+	type=Line             header field equals value
+	content-type!=text/plain
+	port~^OUT[0-9]+$      header field matches regular expression
+	conn-id               header field present
+*/
+
+// JSONFrame is a frame as JSON line
+type JSONFrame struct {
+	Type       string            `json:"type"` // frame type, eg. data or control
+	BodyType   string            `json:"bodyType,omitempty"`
+	Port       string            `json:"port,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`    // extension header fields
+	Body       *string           `json:"body,omitempty"`       // UTF-8 body
+	BodyBase64 *string           `json:"bodyBase64,omitempty"` // binary body
+}
+
+// match is a filter expression on a header field
+type match struct {
+	field    string
+	operator string // one of = != ~ or empty for presence
+	value    string
+	pattern  *regexp.Regexp
+}
+
+// matchPattern splits a filter expression
+var matchPattern = regexp.MustCompile(`^([A-Za-z0-9_-]+)(?:(!=|=|~)(.*))?$`)
+
+// matchFlag collects the filter expressions given using -match
+type matchFlag []*match
+
+func (m *matchFlag) String() string {
+	return fmt.Sprint(len(*m), " expressions")
+}
+
+func (m *matchFlag) Set(expression string) error {
+	parts := matchPattern.FindStringSubmatch(expression)
+	if parts == nil {
+		return errors.New("expected FIELD, FIELD=VALUE, FIELD!=VALUE or FIELD~REGEX")
+	}
+	result := &match{field: strings.ToLower(parts[1]), operator: parts[2], value: parts[3]}
+	if result.operator == "~" {
+		pattern, err := regexp.Compile(result.value)
+		if err != nil {
+			return err
+		}
+		result.pattern = pattern
+	}
+	*m = append(*m, result)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	var v1, hexdump, invert bool
+	var matches matchFlag
+	switch command {
+	case "encode":
+		flags.BoolVar(&v1, "v1", false, "write frames in V1 format")
+	case "decode":
+	case "pretty":
+		flags.BoolVar(&hexdump, "hex", false, "show all bodies as hexdump, not only binary ones")
+	case "filter":
+		flags.BoolVar(&v1, "v1", false, "write frames in V1 format")
+		flags.BoolVar(&invert, "v", false, "select frames not matching")
+		flags.Var(&matches, "match", "filter expression FIELD, FIELD=VALUE, FIELD!=VALUE or FIELD~REGEX (multiple possible)")
+	default:
+		printUsage()
+	}
+	flags.Parse(os.Args[2:])
+	if command == "filter" && len(matches) == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: no filter expression given using -match")
+		os.Exit(1)
+	}
+
+	// process inputs
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	count := 0
+	for _, path := range inputs {
+		input := os.Stdin
+		if path != "-" {
+			var err error
+			if input, err = os.Open(path); err != nil {
+				out.Flush()
+				fmt.Fprintln(os.Stderr, "ERROR:", err)
+				os.Exit(1)
+			}
+		}
+		in := bufio.NewReader(input)
+		var err error
+		switch command {
+		case "encode":
+			err = encode(in, out, v1)
+		case "decode":
+			err = eachFrame(in, out, func(frame *flowd.Frame) error { return decode(frame, out) })
+		case "pretty":
+			err = eachFrame(in, out, func(frame *flowd.Frame) error {
+				count++
+				return pretty(frame, count, hexdump, out)
+			})
+		case "filter":
+			err = eachFrame(in, out, func(frame *flowd.Frame) error {
+				if matchesAll(frame, matches) == invert {
+					return nil
+				}
+				return serialize(frame, out, v1)
+			})
+		}
+		input.Close()
+		if err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", inputName(path), err)
+			os.Exit(1)
+		}
+	}
+}
+
+// inputName returns the name of the input for error messages
+func inputName(path string) string {
+	if path == "-" {
+		return "STDIN"
+	}
+	return path
+}
+
+// eachFrame calls handle for each frame of the input until EOF, flushing the output whenever no more input is buffered
+func eachFrame(in *bufio.Reader, out *bufio.Writer, handle func(frame *flowd.Frame) error) error {
+	for count := 1; ; count++ {
+		frame, err := flowd.Deserialize(in)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("frame %d: %s", count, err)
+		}
+		if err = handle(frame); err != nil {
+			return fmt.Errorf("frame %d: %s", count, err)
+		}
+		if in.Buffered() == 0 {
+			if err = out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// serialize writes the frame in V2 format or in V1 format including its version marker
+func serialize(frame *flowd.Frame, out *bufio.Writer, v1 bool) error {
+	if !v1 {
+		return frame.Serialize(out)
+	}
+	if err := out.WriteByte('1'); err != nil {
+		return err
+	}
+	return frame.SerializeV1(out)
+}
+
+// encode writes a frame for each JSON frame of the input
+func encode(in *bufio.Reader, out *bufio.Writer, v1 bool) error {
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+	for count := 1; ; count++ {
+		var jsonFrame JSONFrame
+		if err := decoder.Decode(&jsonFrame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("JSON frame %d: %s", count, err)
+		}
+		frame := &flowd.Frame{Type: jsonFrame.Type, BodyType: jsonFrame.BodyType, Port: jsonFrame.Port, Extensions: jsonFrame.Headers}
+		if frame.Type == "" {
+			frame.Type = "data"
+		}
+		switch {
+		case jsonFrame.Body != nil && jsonFrame.BodyBase64 != nil:
+			return fmt.Errorf("JSON frame %d: expected either body or bodyBase64, got both", count)
+		case jsonFrame.Body != nil:
+			frame.Body = []byte(*jsonFrame.Body)
+		case jsonFrame.BodyBase64 != nil:
+			body, err := base64.StdEncoding.DecodeString(*jsonFrame.BodyBase64)
+			if err != nil {
+				return fmt.Errorf("JSON frame %d: bodyBase64: %s", count, err)
+			}
+			frame.Body = body
+		}
+		if err := serialize(frame, out, v1); err != nil {
+			return fmt.Errorf("JSON frame %d: %s", count, err)
+		}
+		// NOTE: the JSON decoder reads ahead, so whether more input is buffered is unknown
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// decode writes the frame as JSON line
+func decode(frame *flowd.Frame, out *bufio.Writer) error {
+	jsonFrame := JSONFrame{Type: frame.Type, BodyType: frame.BodyType, Port: frame.Port}
+	if len(frame.Extensions) > 0 {
+		// NOTE: header field names of V1 frames are in canonical MIME form like Content-Type
+		jsonFrame.Headers = map[string]string{}
+		for key, value := range frame.Extensions {
+			jsonFrame.Headers[strings.ToLower(key)] = value
+		}
+	}
+	if frame.Body != nil {
+		body := string(frame.Body)
+		if printable(frame.Body) {
+			jsonFrame.Body = &body
+		} else {
+			body = base64.StdEncoding.EncodeToString(frame.Body)
+			jsonFrame.BodyBase64 = &body
+		}
+	}
+	line, err := json.Marshal(jsonFrame)
+	if err != nil {
+		return err
+	}
+	out.Write(line)
+	return out.WriteByte('\n')
+}
+
+// pretty writes the header fields of the frame as table and its body as text, or as hexdump if binary
+func pretty(frame *flowd.Frame, count int, hexdump bool, out *bufio.Writer) error {
+	fmt.Fprintf(out, "--- frame %d\n", count)
+	table := tabwriter.NewWriter(out, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(table, "frame:\t%s\n", frame.Type)
+	fmt.Fprintf(table, "type:\t%s\n", frame.BodyType)
+	if frame.Port != "" {
+		fmt.Fprintf(table, "port:\t%s\n", frame.Port)
+	}
+	keys := []string{}
+	for key := range frame.Extensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(table, "%s:\t%s\n", strings.ToLower(key), frame.Extensions[key])
+	}
+	fmt.Fprintf(table, "length:\t%d\n", len(frame.Body))
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if len(frame.Body) == 0 {
+		return nil
+	}
+	out.WriteByte('\n')
+	if hexdump || !printable(frame.Body) {
+		_, err := out.WriteString(hex.Dump(frame.Body))
+		return err
+	}
+	out.Write(frame.Body)
+	if frame.Body[len(frame.Body)-1] != '\n' {
+		return out.WriteByte('\n')
+	}
+	return nil
+}
+
+// printable returns whether the body is UTF-8 text without control characters except line breaks and tabs
+func printable(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, char := range string(body) {
+		if char < ' ' && char != '\n' && char != '\r' && char != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAll returns whether all the filter expressions match the header fields of the frame
+func matchesAll(frame *flowd.Frame, matches []*match) bool {
+	fields := map[string]string{"frame": frame.Type, "type": frame.BodyType, "length": strconv.Itoa(len(frame.Body))}
+	if frame.Port != "" {
+		fields["port"] = frame.Port
+	}
+	for key, value := range frame.Extensions {
+		fields[strings.ToLower(key)] = value
+	}
+	for _, m := range matches {
+		value, present := fields[m.field]
+		switch m.operator {
+		case "":
+			if !present {
+				return false
+			}
+		case "=":
+			if !present || value != m.value {
+				return false
+			}
+		case "!=":
+			if present && value == m.value {
+				return false
+			}
+		case "~":
+			if !present || !m.pattern.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "encode [-v1] [file...]")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0], "decode [file...]")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0], "pretty [-hex] [file...]")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0], "filter [-v] [-v1] -match [expression]... [file...]")
+	os.Exit(1)
+}